@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	apiKeyMarker       = "mtk"
+	apiKeyPrefixLength = 8
+)
+
+// NewAPIKey returns a new API key of the form mtk_<prefix>_<secret> together
+// with its lookup prefix and the hash under which it is stored.
+func NewAPIKey() (string, string, string, error) {
+	prefixBytes := make([]byte, apiKeyPrefixLength/2)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+
+	prefix := hex.EncodeToString(prefixBytes)
+	key := apiKeyMarker + "_" + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, prefix, HashAPIKey(key), nil
+}
+
+// APIKeyPrefix extracts the lookup prefix from an API key.
+func APIKeyPrefix(key string) (string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyMarker || len(parts[1]) != apiKeyPrefixLength || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func CheckAPIKey(key, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashAPIKey(key)), []byte(hash)) == 1
+}
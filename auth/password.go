@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/models"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var (
+	ErrPasswordTooShort = errors.New("password is too short")
+	ErrPasswordBreached = errors.New("password appears in a list of breached passwords")
+	ErrPasswordReused   = errors.New("password was used recently")
+)
+
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// PasswordHasher hashes new passwords with the configured algorithm and
+// verifies hashes produced by any supported algorithm or parameters, so that
+// stored hashes can be upgraded on the next successful login.
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+var (
+	hasherMu sync.RWMutex
+	hasher   = PasswordHasher{
+		Algorithm:  AlgorithmArgon2id,
+		BcryptCost: bcrypt.DefaultCost,
+		Argon2:     Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2},
+	}
+	breached = map[string]bool{}
+)
+
+// SetupPasswords configures the hashing algorithm and loads the breached
+// password list from the configured file.
+func SetupPasswords(cfg config.Config) error {
+	configured := PasswordHasher{
+		Algorithm:  cfg.PasswordAlgorithm,
+		BcryptCost: cfg.BcryptCost,
+		Argon2: Argon2Params{
+			Memory:      cfg.Argon2Memory,
+			Iterations:  cfg.Argon2Iterations,
+			Parallelism: cfg.Argon2Parallelism,
+		},
+	}
+
+	hasherMu.RLock()
+	defaults := hasher
+	hasherMu.RUnlock()
+
+	if configured.Algorithm == "" {
+		configured.Algorithm = defaults.Algorithm
+	}
+	if configured.BcryptCost == 0 {
+		configured.BcryptCost = defaults.BcryptCost
+	}
+	if configured.Argon2.Memory == 0 {
+		configured.Argon2.Memory = defaults.Argon2.Memory
+	}
+	if configured.Argon2.Iterations == 0 {
+		configured.Argon2.Iterations = defaults.Argon2.Iterations
+	}
+	if configured.Argon2.Parallelism == 0 {
+		configured.Argon2.Parallelism = defaults.Argon2.Parallelism
+	}
+
+	switch configured.Algorithm {
+	case AlgorithmArgon2id:
+	case AlgorithmBcrypt:
+		if configured.BcryptCost < bcrypt.MinCost || configured.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("BcryptCost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password algorithm %q", configured.Algorithm)
+	}
+
+	list := map[string]bool{}
+	if cfg.BreachedPasswordsFile != "" {
+		var err error
+		if list, err = loadBreachedPasswords(cfg.BreachedPasswordsFile); err != nil {
+			return err
+		}
+	}
+
+	hasherMu.Lock()
+	hasher = configured
+	breached = list
+	hasherMu.Unlock()
+	return nil
+}
+
+func HashPassword(password string) (string, error) {
+	hasherMu.RLock()
+	h := hasher
+	hasherMu.RUnlock()
+
+	if h.Algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Argon2.Iterations, h.Argon2.Memory, h.Argon2.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Argon2.Memory, h.Argon2.Iterations, h.Argon2.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether password matches hash, and whether hash was
+// produced with a different algorithm or parameters than currently configured.
+func VerifyPassword(hash, password string) (bool, bool) {
+	hasherMu.RLock()
+	h := hasher
+	hasherMu.RUnlock()
+
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2Hash(hash)
+		if err != nil {
+			return false, false
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false
+		}
+		return true, h.Algorithm != AlgorithmArgon2id || params != h.Argon2
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, h.Algorithm != AlgorithmBcrypt || err != nil || cost != h.BcryptCost
+}
+
+// ValidatePassword checks a new password against a tenant password policy and
+// the user's recent password hashes.
+func ValidatePassword(policy models.PasswordPolicy, password string, history []string) error {
+	if len([]rune(password)) < policy.MinLength {
+		return fmt.Errorf("%w: at least %d characters are required", ErrPasswordTooShort, policy.MinLength)
+	}
+
+	if policy.CheckBreached {
+		sum := sha1.Sum([]byte(password))
+		hasherMu.RLock()
+		isBreached := breached[strings.ToUpper(hex.EncodeToString(sum[:]))]
+		hasherMu.RUnlock()
+		if isBreached {
+			return ErrPasswordBreached
+		}
+	}
+
+	for _, previous := range history {
+		if ok, _ := VerifyPassword(previous, password); ok {
+			return ErrPasswordReused
+		}
+	}
+	return nil
+}
+
+func decodeArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+	var (
+		params  Argon2Params
+		version int
+	)
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+// loadBreachedPasswords reads a breached password list. Each line is either a
+// SHA-1 hex digest, optionally followed by ":count" as in the Have I Been Pwned
+// downloads, or a plaintext password.
+func loadBreachedPasswords(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if digest, _, _ := strings.Cut(line, ":"); isSHA1Hex(digest) {
+			list[strings.ToUpper(digest)] = true
+			continue
+		}
+		sum := sha1.Sum([]byte(line))
+		list[strings.ToUpper(hex.EncodeToString(sum[:]))] = true
+	}
+	return list, scanner.Err()
+}
+
+func isSHA1Hex(value string) bool {
+	if len(value) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
@@ -0,0 +1,73 @@
+package auth
+
+const (
+	RolePlatformAdmin = "platform-admin"
+	RoleTenantAdmin   = "tenant-admin"
+
+	PermTenantsList     = "tenants:list"
+	PermTenantsCreate   = "tenants:create"
+	PermTenantsRead     = "tenants:read"
+	PermTenantsUpdate   = "tenants:update"
+	PermTenantsDelete   = "tenants:delete"
+	PermTenantsRestore  = "tenants:restore"
+	PermUsersRead       = "users:read"
+	PermUsersWrite      = "users:write"
+	PermRolesRead       = "roles:read"
+	PermRolesWrite      = "roles:write"
+	PermMessagesPublish = "messages:publish"
+	PermMessagesConsume = "messages:consume"
+	PermAPIKeysRead     = "api-keys:read"
+	PermAPIKeysWrite    = "api-keys:write"
+	PermSystemRead      = "system:read"
+)
+
+// TenantPermissions are the permissions that can be granted within a single
+// tenant, and therefore the only ones custom roles may contain. Every other
+// permission is reserved to platform admins.
+var TenantPermissions = []string{
+	PermTenantsRead,
+	PermTenantsUpdate,
+	PermUsersRead,
+	PermUsersWrite,
+	PermRolesRead,
+	PermRolesWrite,
+	PermMessagesPublish,
+	PermMessagesConsume,
+	PermAPIKeysRead,
+	PermAPIKeysWrite,
+}
+
+// BuiltinRoles maps the built-in role names to their permissions. Platform
+// admins are granted every permission on every tenant and are not listed.
+var BuiltinRoles = map[string][]string{
+	RoleTenantAdmin: TenantPermissions,
+	RoleTenantMember: {
+		PermTenantsRead,
+		PermMessagesPublish,
+		PermMessagesConsume,
+	},
+}
+
+func IsBuiltinRole(name string) bool {
+	_, ok := BuiltinRoles[name]
+	return ok || name == RolePlatformAdmin
+}
+
+func IsTenantPermission(permission string) bool {
+	for _, p := range TenantPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether role is in roles. It works the same for scopes.
+func HasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
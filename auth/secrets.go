@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"jatis_mobile_api/config"
+	"sync"
+)
+
+const secretsKeyLength = 32
+
+var (
+	ErrNoSecretsKey  = errors.New("no secrets key configured")
+	ErrInvalidSecret = errors.New("secret cannot be decrypted")
+)
+
+var (
+	secretsMu     sync.RWMutex
+	secretsCipher cipher.AEAD
+)
+
+// SetupSecrets configures the AES-256-GCM key used to encrypt secrets stored
+// in the database, such as tenant database connection strings. The key is
+// optional as long as no secrets need to be stored.
+func SetupSecrets(cfg config.Config) error {
+	if cfg.SecretsKey == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(cfg.SecretsKey)
+	if err != nil {
+		return fmt.Errorf("SecretsKey is not valid base64: %w", err)
+	}
+	if len(key) != secretsKeyLength {
+		return fmt.Errorf("SecretsKey must be %d bytes, got %d", secretsKeyLength, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	secretsMu.Lock()
+	secretsCipher = gcm
+	secretsMu.Unlock()
+	return nil
+}
+
+// EncryptSecret encrypts plaintext with a random nonce, which is prepended to
+// the returned ciphertext.
+func EncryptSecret(plaintext string) ([]byte, error) {
+	secretsMu.RLock()
+	gcm := secretsCipher
+	secretsMu.RUnlock()
+	if gcm == nil {
+		return nil, ErrNoSecretsKey
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(plaintext), nil), nil
+}
+
+func DecryptSecret(ciphertext []byte) (string, error) {
+	secretsMu.RLock()
+	gcm := secretsCipher
+	secretsMu.RUnlock()
+	if gcm == nil {
+		return "", ErrNoSecretsKey
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", ErrInvalidSecret
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrInvalidSecret
+	}
+	return string(plaintext), nil
+}
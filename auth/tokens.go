@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"jatis_mobile_api/config"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	RoleTenantMember = "tenant-member"
+
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	minSigningKeyLength    = 32
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims describe the authenticated principal. For requests authenticated
+// with an API key, APIKeyID is set and Scopes replace role permissions.
+type Claims struct {
+	UserID   int      `json:"uid"`
+	TenantID int      `json:"tid"`
+	Roles    []string `json:"roles"`
+	APIKeyID int      `json:"-"`
+	Scopes   []string `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// TokenManager signs access tokens with the active key and verifies them
+// against every configured key, so keys can be rotated by adding a new key,
+// making it active, and removing the old one once its tokens have expired.
+type TokenManager struct {
+	keys            map[string][]byte
+	activeKeyID     string
+	issuer          string
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+}
+
+func NewTokenManager(cfg config.Config) (*TokenManager, error) {
+	keys := make(map[string][]byte, len(cfg.JWTKeys))
+	for _, key := range cfg.JWTKeys {
+		if key.ID == "" {
+			return nil, errors.New("JWT key ID is required")
+		}
+		if len(key.Secret) < minSigningKeyLength {
+			return nil, fmt.Errorf("JWT key %q must be at least %d bytes", key.ID, minSigningKeyLength)
+		}
+		keys[key.ID] = []byte(key.Secret)
+	}
+	if _, ok := keys[cfg.JWTActiveKeyID]; !ok {
+		return nil, fmt.Errorf("active JWT key %q is not configured", cfg.JWTActiveKeyID)
+	}
+
+	manager := &TokenManager{
+		keys:            keys,
+		activeKeyID:     cfg.JWTActiveKeyID,
+		issuer:          cfg.JWTIssuer,
+		accessTokenTTL:  cfg.AccessTokenTTL,
+		refreshTokenTTL: cfg.RefreshTokenTTL,
+	}
+	if manager.accessTokenTTL == 0 {
+		manager.accessTokenTTL = defaultAccessTokenTTL
+	}
+	if manager.refreshTokenTTL == 0 {
+		manager.refreshTokenTTL = defaultRefreshTokenTTL
+	}
+	return manager, nil
+}
+
+func (m *TokenManager) AccessTokenTTL() time.Duration {
+	return m.accessTokenTTL
+}
+
+func (m *TokenManager) RefreshTokenTTL() time.Duration {
+	return m.refreshTokenTTL
+}
+
+func (m *TokenManager) IssueAccessToken(userID, tenantID int, roles []string) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		UserID:   userID,
+		TenantID: tenantID,
+		Roles:    roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   fmt.Sprint(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.accessTokenTTL)),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = m.activeKeyID
+	return token.SignedString(m.keys[m.activeKeyID])
+}
+
+func (m *TokenManager) ParseAccessToken(tokenString string) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	}
+	if m.issuer != "" {
+		options = append(options, jwt.WithIssuer(m.issuer))
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		key, ok := m.keys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+		return key, nil
+	}, options...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return &claims, nil
+}
+
+// NewRefreshToken returns an opaque refresh token and the hash under which it
+// is stored. Only the hash is ever persisted.
+func NewRefreshToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashRefreshToken(token), nil
+}
+
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
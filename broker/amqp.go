@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"context"
+
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// AMQP is the Broker backed by the RabbitMQ connection of the rabbitmq
+// package.
+type AMQP struct{}
+
+func NewAMQP() *AMQP {
+	return &AMQP{}
+}
+
+func (*AMQP) DeclareTenantQueue(ctx context.Context, queueName string) error {
+	return rabbitmq.DeclareQueue(ctx, queueName)
+}
+
+func (*AMQP) BindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	return rabbitmq.BindQueue(ctx, queueName, exchangeName, routingKey)
+}
+
+func (*AMQP) UnbindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	return rabbitmq.UnbindQueue(ctx, queueName, exchangeName, routingKey)
+}
+
+func (*AMQP) Publish(ctx context.Context, exchangeName, routingKey string, msg Message) error {
+	return rabbitmq.Publish(ctx, exchangeName, routingKey, amqp091.Publishing{
+		Headers:     amqp091.Table(msg.Headers),
+		ContentType: msg.ContentType,
+		MessageId:   msg.MessageID,
+		Type:        msg.Type,
+		Body:        msg.Body,
+	})
+}
+
+func (*AMQP) Consume(ctx context.Context, tenantID int, queueName, tag string, prefetch int) (ConsumerInfo, error) {
+	return rabbitmq.StartConsumer(tenantID, queueName, tag, prefetch)
+}
+
+func (*AMQP) Stream(ctx context.Context, tenantID int, queueName, tag string, prefetch int, handler Handler) error {
+	return rabbitmq.StreamConsumer(ctx, tenantID, queueName, tag, prefetch, handler)
+}
+
+func (*AMQP) StopConsuming(ctx context.Context, tenantID int, tag string) error {
+	return rabbitmq.StopConsumer(tenantID, tag)
+}
+
+func (*AMQP) Consumers(tenantID int) []ConsumerInfo {
+	return rabbitmq.ListConsumers(tenantID)
+}
+
+func (*AMQP) MoveMessages(ctx context.Context, fromQueue, toQueue string) (int, error) {
+	return rabbitmq.MoveMessages(ctx, fromQueue, toQueue)
+}
+
+func (*AMQP) DeleteQueue(ctx context.Context, queueName string) (int, error) {
+	return rabbitmq.DeleteQueue(ctx, queueName)
+}
+
+func (*AMQP) QueueStats(ctx context.Context, queueName string) (QueueStats, error) {
+	messages, consumers, err := rabbitmq.QueueStats(ctx, queueName)
+	return QueueStats{Messages: messages, Consumers: consumers}, err
+}
+
+func (*AMQP) DeadLetters(ctx context.Context, queueName string, limit int) ([]DeadLetter, error) {
+	return rabbitmq.ListDeadLetters(ctx, queueName, limit)
+}
+
+func (*AMQP) ReplayDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return rabbitmq.ReplayDeadLetters(ctx, queueName, messageIDs, limit)
+}
+
+func (*AMQP) DiscardDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return rabbitmq.DiscardDeadLetters(ctx, queueName, messageIDs, limit)
+}
@@ -0,0 +1,91 @@
+// Package broker abstracts the message broker used by the handlers, so that
+// they can run against RabbitMQ in production and against an in-memory
+// broker in tests.
+package broker
+
+import (
+	"context"
+	"errors"
+
+	"jatis_mobile_api/rabbitmq"
+)
+
+// Broker is the set of broker operations the handlers rely on. Tenant queues
+// are bound to amq.direct and come with a dead-letter queue and retry queues;
+// consumed messages are dispatched to the handlers registered with
+// rabbitmq.RegisterHandler.
+type Broker interface {
+	// DeclareTenantQueue declares a tenant queue with its dead-letter and
+	// retry queues.
+	DeclareTenantQueue(ctx context.Context, queueName string) error
+	BindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error
+	UnbindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error
+	// Publish publishes a mandatory message and waits for the broker to
+	// confirm it. It returns ErrUnroutable when no queue is bound for the
+	// routing key. A message without an ID is given one from NewMessageID.
+	Publish(ctx context.Context, exchangeName, routingKey string, msg Message) error
+	Consume(ctx context.Context, tenantID int, queueName, tag string, prefetch int) (ConsumerInfo, error)
+	// Stream consumes a queue like Consume, but passes its messages to
+	// handler instead of the registered handlers, until ctx is done or the
+	// consumer is stopped. The stream ends at the first error of handler,
+	// and the messages handler has not returned nil for are redelivered.
+	Stream(ctx context.Context, tenantID int, queueName, tag string, prefetch int, handler Handler) error
+	StopConsuming(ctx context.Context, tenantID int, tag string) error
+	Consumers(tenantID int) []ConsumerInfo
+	// MoveMessages moves the ready messages of one queue to another.
+	MoveMessages(ctx context.Context, fromQueue, toQueue string) (int, error)
+	// DeleteQueue deletes a tenant queue with its dead-letter and retry
+	// queues and returns the number of messages it held.
+	DeleteQueue(ctx context.Context, queueName string) (int, error)
+	QueueStats(ctx context.Context, queueName string) (QueueStats, error)
+	DeadLetters(ctx context.Context, queueName string, limit int) ([]DeadLetter, error)
+	ReplayDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error)
+	DiscardDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error)
+}
+
+// Message is a message to publish.
+type Message struct {
+	ContentType string
+	Type        string
+	MessageID   string
+	Headers     map[string]interface{}
+	Body        []byte
+}
+
+type QueueStats struct {
+	Messages  int `json:"messages"`
+	Consumers int `json:"consumers"`
+}
+
+type (
+	ConsumerInfo  = rabbitmq.ConsumerInfo
+	DeadLetter    = rabbitmq.DeadLetter
+	Delivery      = rabbitmq.Message
+	Handler       = rabbitmq.Handler
+	QueueSettings = rabbitmq.QueueSettings
+)
+
+// ErrNotFound is returned by brokers other than RabbitMQ for a queue or
+// exchange that does not exist.
+var ErrNotFound = errors.New("broker: queue or exchange not found")
+
+var (
+	ErrUnroutable       = rabbitmq.ErrUnroutable
+	ErrPublishNacked    = rabbitmq.ErrPublishNacked
+	ErrConsumerExists   = rabbitmq.ErrConsumerExists
+	ErrConsumerNotFound = rabbitmq.ErrConsumerNotFound
+)
+
+// IsNotFound reports whether err was caused by a queue or exchange that does
+// not exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || rabbitmq.IsNotFound(err)
+}
+
+func NewMessageID() string {
+	return rabbitmq.NewMessageID()
+}
+
+func DeadLetterQueue(queueName string) string {
+	return rabbitmq.DeadLetterQueue(queueName)
+}
@@ -0,0 +1,652 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Memory is an in-process Broker for tests. It models the parts of RabbitMQ
+// the handlers depend on: the default exchange, amq.direct and the
+// dead-letter exchange, mandatory publishing, per-consumer prefetch with
+// round-robin delivery, acks, requeues with a delivery limit, retry queues
+// with a TTL and dead-lettering. Messages are not persisted.
+type Memory struct {
+	settings rabbitmq.QueueSettings
+
+	mu        sync.Mutex
+	queues    map[string]*memoryQueue
+	bindings  map[string]map[string]map[string]bool // exchange, routing key, queues
+	consumers map[consumerKey]*memoryConsumer
+}
+
+type memoryQueue struct {
+	name      string
+	ready     []*memoryMessage
+	consumers []*memoryConsumer
+	next      int
+
+	// deadLetterKey is set on tenant queues, which dead-letter to
+	// rabbitmq.DeadLetterExchange under their own name.
+	deadLetterKey string
+	// ttl and retryKey are set on retry queues, which dead-letter expired
+	// messages to amq.direct under the name of their tenant queue.
+	ttl      time.Duration
+	retryKey string
+}
+
+type memoryMessage struct {
+	msg         Message
+	deliveries  int
+	redelivered bool
+}
+
+type consumerKey struct {
+	tenantID int
+	tag      string
+}
+
+type memoryConsumer struct {
+	info     ConsumerInfo
+	queue    *memoryQueue
+	handler  Handler
+	inFlight int
+	// unsettled holds the delivered messages the consumer has not settled
+	// yet, which are requeued when it stops.
+	unsettled []*memoryMessage
+	stopped   bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewMemory returns an empty in-memory broker whose tenant queues use the
+// given settings. Zero values fall back to the defaults of
+// rabbitmq.ConfigureQueues.
+func NewMemory(settings QueueSettings) *Memory {
+	if settings.DeliveryLimit <= 0 {
+		settings.DeliveryLimit = 10
+	}
+	if len(settings.RetryDelays) == 0 {
+		settings.RetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+	}
+	return &Memory{
+		settings: settings,
+		queues:   map[string]*memoryQueue{},
+		bindings: map[string]map[string]map[string]bool{
+			"amq.direct":                {},
+			rabbitmq.DeadLetterExchange: {},
+		},
+		consumers: map[consumerKey]*memoryConsumer{},
+	}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &amqp091.Error{Code: amqp091.NotFound, Reason: "NOT_FOUND - " + fmt.Sprintf(format, args...)}
+}
+
+func (m *Memory) DeclareTenantQueue(ctx context.Context, queueName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dlq := m.declare(DeadLetterQueue(queueName))
+	m.bind(dlq.name, rabbitmq.DeadLetterExchange, queueName)
+	for _, delay := range m.settings.RetryDelays {
+		retryQueue := m.declare(rabbitmq.RetryQueue(queueName, delay))
+		retryQueue.ttl, retryQueue.retryKey = delay, queueName
+	}
+	m.declare(queueName).deadLetterKey = queueName
+	return nil
+}
+
+func (m *Memory) declare(queueName string) *memoryQueue {
+	q, ok := m.queues[queueName]
+	if !ok {
+		q = &memoryQueue{name: queueName}
+		m.queues[queueName] = q
+	}
+	return q
+}
+
+func (m *Memory) bind(queueName, exchangeName, routingKey string) {
+	keys := m.bindings[exchangeName]
+	if keys[routingKey] == nil {
+		keys[routingKey] = map[string]bool{}
+	}
+	keys[routingKey][queueName] = true
+}
+
+func (m *Memory) BindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bindings[exchangeName]; !ok {
+		return notFound("no exchange '%s'", exchangeName)
+	}
+	if _, ok := m.queues[queueName]; !ok {
+		return notFound("no queue '%s'", queueName)
+	}
+	m.bind(queueName, exchangeName, routingKey)
+	return nil
+}
+
+func (m *Memory) UnbindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bindings[exchangeName]; !ok {
+		return notFound("no exchange '%s'", exchangeName)
+	}
+	delete(m.bindings[exchangeName][routingKey], queueName)
+	return nil
+}
+
+func (m *Memory) Publish(ctx context.Context, exchangeName, routingKey string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if msg.MessageID == "" {
+		msg.MessageID = NewMessageID()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if exchangeName != "" {
+		if _, ok := m.bindings[exchangeName]; !ok {
+			return notFound("no exchange '%s'", exchangeName)
+		}
+	}
+	if !m.route(exchangeName, routingKey, msg) {
+		return ErrUnroutable
+	}
+	return nil
+}
+
+// route enqueues a copy of msg on every queue the exchange routes the key to
+// and reports whether there was one.
+func (m *Memory) route(exchangeName, routingKey string, msg Message) bool {
+	var targets []string
+	if exchangeName == "" {
+		if _, ok := m.queues[routingKey]; ok {
+			targets = append(targets, routingKey)
+		}
+	} else {
+		for queueName := range m.bindings[exchangeName][routingKey] {
+			targets = append(targets, queueName)
+		}
+	}
+
+	for _, queueName := range targets {
+		copied := msg
+		copied.Headers = copyHeaders(msg.Headers)
+		m.enqueue(m.queues[queueName], &memoryMessage{msg: copied})
+	}
+	return len(targets) > 0
+}
+
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(headers))
+	for key, value := range headers {
+		copied[key] = value
+	}
+	return copied
+}
+
+func (m *Memory) enqueue(q *memoryQueue, message *memoryMessage) {
+	q.ready = append(q.ready, message)
+	if q.ttl > 0 {
+		time.AfterFunc(q.ttl, func() { m.expire(q, message) })
+	}
+	m.deliver(q)
+}
+
+// expire dead-letters a message of a retry queue back to its tenant queue
+// once its TTL passed.
+func (m *Memory) expire(q *memoryQueue, message *memoryMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, ready := range q.ready {
+		if ready == message {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			m.route("amq.direct", q.retryKey, withDeath(message.msg, q.name, "expired"))
+			return
+		}
+	}
+}
+
+// deadLetter routes a message of a tenant queue to its dead-letter queue. A
+// queue without dead-lettering drops it.
+func (m *Memory) deadLetter(q *memoryQueue, message *memoryMessage, reason string) {
+	if q.deadLetterKey == "" {
+		return
+	}
+	m.route(rabbitmq.DeadLetterExchange, q.deadLetterKey, withDeath(message.msg, q.name, reason))
+}
+
+// withDeath records the first time a message was dead-lettered in its
+// headers, as RabbitMQ does.
+func withDeath(msg Message, queueName, reason string) Message {
+	msg.Headers = copyHeaders(msg.Headers)
+	if _, ok := msg.Headers["x-first-death-reason"]; !ok {
+		msg.Headers["x-first-death-reason"] = reason
+		msg.Headers["x-first-death-queue"] = queueName
+		msg.Headers["x-first-death-exchange"] = ""
+	}
+	return msg
+}
+
+// deliver hands ready messages to the consumers of a queue in turn, as long
+// as one of them has not reached its prefetch.
+func (m *Memory) deliver(q *memoryQueue) {
+	for len(q.ready) > 0 && len(q.consumers) > 0 {
+		var c *memoryConsumer
+		for i := 0; i < len(q.consumers); i++ {
+			candidate := q.consumers[(q.next+i)%len(q.consumers)]
+			if candidate.inFlight < candidate.info.Prefetch {
+				c = candidate
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+
+		message := q.ready[0]
+		q.ready = q.ready[1:]
+		message.deliveries++
+		c.inFlight++
+		c.unsettled = append(c.unsettled, message)
+		go m.process(c, message)
+	}
+}
+
+// process runs the handler of a delivered message and settles it the way
+// the RabbitMQ consumers do.
+func (m *Memory) process(c *memoryConsumer, message *memoryMessage) {
+	delivery := rabbitmq.Message{
+		TenantID:    c.info.TenantID,
+		Queue:       c.info.Queue,
+		Type:        msgType(message.msg),
+		MessageID:   message.msg.MessageID,
+		Headers:     amqp091.Table(message.msg.Headers),
+		Body:        message.msg.Body,
+		Redelivered: message.redelivered,
+	}
+	var err error
+	if c.handler != nil {
+		err = rabbitmq.Run(c.ctx, c.handler, delivery)
+	} else {
+		err = rabbitmq.Dispatch(c.ctx, delivery)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := c.queue
+	settled := false
+	for i, candidate := range c.unsettled {
+		if candidate == message {
+			c.unsettled = append(c.unsettled[:i], c.unsettled[i+1:]...)
+			settled = true
+			break
+		}
+	}
+	c.inFlight--
+	c.info.MessagesProcessed++
+	if err != nil {
+		text := err.Error()
+		c.info.LastError = &text
+	}
+
+	if err != nil && c.handler != nil {
+		// A stream ends at its first error.
+		m.forget(c)
+	}
+
+	switch {
+	case m.queues[q.name] != q:
+		// The queue was deleted with the message.
+		return
+	case !settled:
+		// The message was requeued when the consumer stopped.
+	case c.stopped:
+		// The channel of a stopped consumer is closed before the message
+		// could be settled, so it is requeued.
+		m.requeue(q, message)
+	case err == nil:
+	case rabbitmq.IsPermanent(err):
+		m.deadLetter(q, message, "rejected")
+	default:
+		m.retry(q, message)
+	}
+	m.deliver(q)
+}
+
+// requeue puts an unsettled message back at the head of its queue, or
+// dead-letters it once it was delivered more than the delivery limit.
+func (m *Memory) requeue(q *memoryQueue, message *memoryMessage) {
+	if q.deadLetterKey != "" && message.deliveries > m.settings.DeliveryLimit {
+		m.deadLetter(q, message, "delivery_limit")
+		return
+	}
+	message.redelivered = true
+	q.ready = append([]*memoryMessage{message}, q.ready...)
+}
+
+// retry publishes a failed message to the retry queue of its next tier, or
+// dead-letters it once every tier was used.
+func (m *Memory) retry(q *memoryQueue, message *memoryMessage) {
+	attempt := rabbitmq.RetryCount(amqp091.Table(message.msg.Headers))
+	if attempt >= len(m.settings.RetryDelays) {
+		m.deadLetter(q, message, "rejected")
+		return
+	}
+
+	msg := message.msg
+	msg.Headers = copyHeaders(msg.Headers)
+	msg.Headers[rabbitmq.RetryCountHeader] = int32(attempt + 1)
+	if !m.route("", rabbitmq.RetryQueue(q.name, m.settings.RetryDelays[attempt]), msg) {
+		m.requeue(q, message)
+	}
+}
+
+// Consume starts a consumer; a prefetch of zero delivers up to 10 messages
+// at a time.
+func (m *Memory) Consume(ctx context.Context, tenantID int, queueName, tag string, prefetch int) (ConsumerInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.consume(tenantID, queueName, tag, prefetch, nil)
+	if err != nil {
+		return ConsumerInfo{}, err
+	}
+	return c.info, nil
+}
+
+func (m *Memory) Stream(ctx context.Context, tenantID int, queueName, tag string, prefetch int, handler Handler) error {
+	m.mu.Lock()
+	c, err := m.consume(tenantID, queueName, tag, prefetch, handler)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		m.mu.Lock()
+		m.forget(c)
+		m.mu.Unlock()
+	case <-c.ctx.Done():
+	}
+	return nil
+}
+
+// consume starts a consumer passing its messages to handler, or dispatching
+// them when handler is nil.
+func (m *Memory) consume(tenantID int, queueName, tag string, prefetch int, handler Handler) (*memoryConsumer, error) {
+	if prefetch <= 0 {
+		prefetch = 10
+	}
+	q, ok := m.queues[queueName]
+	if !ok {
+		return nil, notFound("no queue '%s'", queueName)
+	}
+	key := consumerKey{tenantID: tenantID, tag: tag}
+	if _, ok := m.consumers[key]; ok {
+		return nil, ErrConsumerExists
+	}
+
+	c := &memoryConsumer{
+		info: ConsumerInfo{
+			Tag:       tag,
+			TenantID:  tenantID,
+			Queue:     queueName,
+			State:     rabbitmq.ConsumerRunning,
+			Prefetch:  prefetch,
+			Stream:    handler != nil,
+			StartedAt: time.Now(),
+		},
+		queue:   q,
+		handler: handler,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	m.consumers[key] = c
+	q.consumers = append(q.consumers, c)
+	m.deliver(q)
+	return c, nil
+}
+
+func (m *Memory) StopConsuming(ctx context.Context, tenantID int, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := consumerKey{tenantID: tenantID, tag: tag}
+	c, ok := m.consumers[key]
+	if !ok {
+		return ErrConsumerNotFound
+	}
+	delete(m.consumers, key)
+	m.stop(c)
+	return nil
+}
+
+// forget removes a consumer, unless it was already replaced under its tag,
+// and stops it.
+func (m *Memory) forget(c *memoryConsumer) {
+	if c.stopped {
+		return
+	}
+	key := consumerKey{tenantID: c.info.TenantID, tag: c.info.Tag}
+	if m.consumers[key] == c {
+		delete(m.consumers, key)
+	}
+	m.stop(c)
+}
+
+// stop cancels a consumer and, like RabbitMQ closing its channel, requeues
+// the messages it has not settled yet.
+func (m *Memory) stop(c *memoryConsumer) {
+	c.stopped = true
+	c.cancel()
+	q := c.queue
+	for i, candidate := range q.consumers {
+		if candidate == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.next = 0
+
+	if m.queues[q.name] != q {
+		return
+	}
+	for i := len(c.unsettled) - 1; i >= 0; i-- {
+		// The handler may still be reading the delivered message.
+		message := c.unsettled[i]
+		m.requeue(q, &memoryMessage{msg: message.msg, deliveries: message.deliveries})
+	}
+	c.unsettled = nil
+	m.deliver(q)
+}
+
+func (m *Memory) Consumers(tenantID int) []ConsumerInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := []ConsumerInfo{}
+	for key, c := range m.consumers {
+		if key.tenantID == tenantID {
+			infos = append(infos, c.info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Tag < infos[j].Tag })
+	return infos
+}
+
+func (m *Memory) MoveMessages(ctx context.Context, fromQueue, toQueue string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from, ok := m.queues[fromQueue]
+	if !ok {
+		return 0, notFound("no queue '%s'", fromQueue)
+	}
+	to, ok := m.queues[toQueue]
+	if !ok {
+		return 0, notFound("no queue '%s'", toQueue)
+	}
+
+	moved := from.ready
+	from.ready = nil
+	for _, message := range moved {
+		m.enqueue(to, &memoryMessage{msg: message.msg})
+	}
+	return len(moved), nil
+}
+
+func (m *Memory) DeleteQueue(ctx context.Context, queueName string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[queueName]
+	if !ok {
+		return 0, nil
+	}
+	names := []string{queueName, DeadLetterQueue(queueName)}
+	for _, delay := range m.settings.RetryDelays {
+		names = append(names, rabbitmq.RetryQueue(queueName, delay))
+	}
+	for _, name := range names {
+		m.deleteQueue(name)
+	}
+	return len(q.ready), nil
+}
+
+func (m *Memory) deleteQueue(queueName string) {
+	q, ok := m.queues[queueName]
+	if !ok {
+		return
+	}
+	delete(m.queues, queueName)
+	for _, keys := range m.bindings {
+		for _, queues := range keys {
+			delete(queues, queueName)
+		}
+	}
+	for key, c := range m.consumers {
+		if c.queue == q {
+			delete(m.consumers, key)
+			m.stop(c)
+		}
+	}
+}
+
+func (m *Memory) QueueStats(ctx context.Context, queueName string) (QueueStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[queueName]
+	if !ok {
+		return QueueStats{}, notFound("no queue '%s'", queueName)
+	}
+	return QueueStats{Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+}
+
+func (m *Memory) DeadLetters(ctx context.Context, queueName string, limit int) ([]DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dlq, ok := m.queues[DeadLetterQueue(queueName)]
+	if !ok {
+		return nil, notFound("no queue '%s'", DeadLetterQueue(queueName))
+	}
+
+	letters := []DeadLetter{}
+	for _, message := range dlq.ready {
+		if len(letters) == limit {
+			break
+		}
+		letters = append(letters, newDeadLetter(message.msg))
+	}
+	return letters, nil
+}
+
+// msgType returns the type of a message: its type property, or else its
+// "type" header.
+func msgType(msg Message) string {
+	if msg.Type != "" {
+		return msg.Type
+	}
+	value, _ := msg.Headers["type"].(string)
+	return value
+}
+
+func newDeadLetter(msg Message) DeadLetter {
+	reason, _ := msg.Headers["x-first-death-reason"].(string)
+	return DeadLetter{
+		MessageID: msg.MessageID,
+		Type:      msgType(msg),
+		Reason:    reason,
+		Retries:   rabbitmq.RetryCount(amqp091.Table(msg.Headers)),
+		Body:      string(msg.Body),
+	}
+}
+
+func (m *Memory) ReplayDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return m.settleDeadLetters(queueName, messageIDs, limit, func(msg Message) bool {
+		headers := map[string]interface{}{}
+		for key, value := range msg.Headers {
+			switch key {
+			case rabbitmq.RetryCountHeader, "x-first-death-exchange", "x-first-death-queue", "x-first-death-reason":
+			default:
+				headers[key] = value
+			}
+		}
+		msg.Headers = headers
+		return m.route("", queueName, msg)
+	})
+}
+
+func (m *Memory) DiscardDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return m.settleDeadLetters(queueName, messageIDs, limit, func(Message) bool {
+		return true
+	})
+}
+
+// settleDeadLetters selects dead-lettered messages like
+// rabbitmq.ReplayDeadLetters and removes those the action succeeded for.
+func (m *Memory) settleDeadLetters(queueName string, messageIDs []string, limit int, action func(Message) bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dlq, ok := m.queues[DeadLetterQueue(queueName)]
+	if !ok {
+		return 0, notFound("no queue '%s'", DeadLetterQueue(queueName))
+	}
+	wanted := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+
+	settled := 0
+	var kept []*memoryMessage
+	for _, message := range dlq.ready {
+		selected := (limit <= 0 || settled < limit) && (len(messageIDs) == 0 || wanted[message.msg.MessageID])
+		if selected && action(message.msg) {
+			settled++
+			continue
+		}
+		kept = append(kept, message)
+	}
+	dlq.ready = kept
+	return settled, nil
+}
@@ -0,0 +1,650 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logs.SetupLogger()
+
+// PostgresSettings configures the Postgres broker. Zero values fall back to
+// the defaults in NewPostgres.
+type PostgresSettings struct {
+	// PollInterval bounds how long a consumer waits for a message it was not
+	// notified about, such as a retry that became due.
+	PollInterval time.Duration
+	// LockTimeout is how long a delivered message stays locked to its
+	// consumer. Locks of messages still being handled are renewed, so it only
+	// matters when an instance stops without settling its messages.
+	LockTimeout time.Duration
+}
+
+// Postgres is a Broker that stores messages in the queue_messages table, one
+// partition per tenant queue, for deployments without RabbitMQ. It follows
+// the semantics of the RabbitMQ broker: publishing is mandatory, consumers
+// claim up to their prefetch with SELECT ... FOR UPDATE SKIP LOCKED, failed
+// messages are retried after the configured delays and then dead-lettered,
+// and messages delivered more often than the delivery limit without being
+// settled are dead-lettered. Consumers are woken with LISTEN/NOTIFY.
+//
+// Bindings only exist on amq.direct; the default exchange routes to the queue
+// named by the routing key.
+type Postgres struct {
+	pool     *pgxpool.Pool
+	queues   QueueSettings
+	settings PostgresSettings
+	instance string
+
+	mu        sync.Mutex
+	consumers map[consumerKey]*postgresConsumer
+	listening bool
+}
+
+// NewPostgres returns a broker backed by the given pool. Zero queue settings
+// fall back to the defaults of rabbitmq.ConfigureQueues.
+func NewPostgres(pool *pgxpool.Pool, queues QueueSettings, settings PostgresSettings) *Postgres {
+	if queues.DeliveryLimit <= 0 {
+		queues.DeliveryLimit = 10
+	}
+	if len(queues.RetryDelays) == 0 {
+		queues.RetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+	}
+	if settings.PollInterval <= 0 {
+		settings.PollInterval = time.Second
+	}
+	if settings.LockTimeout <= 0 {
+		settings.LockTimeout = 5 * time.Minute
+	}
+
+	host, _ := os.Hostname()
+	return &Postgres{
+		pool:      pool,
+		queues:    queues,
+		settings:  settings,
+		instance:  fmt.Sprintf("%s/%d/%s", host, os.Getpid(), strconv.FormatInt(time.Now().UnixNano(), 36)),
+		consumers: map[consumerKey]*postgresConsumer{},
+	}
+}
+
+func (p *Postgres) withTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *Postgres) requireQueue(queueName string) error {
+	exists, err := models.QueueExists(p.pool, queueName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: queue %q", ErrNotFound, queueName)
+	}
+	return nil
+}
+
+func requireExchange(exchangeName string) error {
+	if exchangeName != "" && exchangeName != "amq.direct" {
+		return fmt.Errorf("%w: exchange %q", ErrNotFound, exchangeName)
+	}
+	return nil
+}
+
+func (p *Postgres) DeclareTenantQueue(ctx context.Context, queueName string) error {
+	return p.withTx(ctx, func(tx pgx.Tx) error {
+		return models.CreateQueue(tx, queueName, DeadLetterQueue(queueName))
+	})
+}
+
+func (p *Postgres) BindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	if err := requireExchange(exchangeName); err != nil {
+		return err
+	}
+	if err := p.requireQueue(queueName); err != nil {
+		return err
+	}
+	return models.BindQueue(p.pool, queueName, exchangeName, routingKey)
+}
+
+func (p *Postgres) UnbindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	if err := requireExchange(exchangeName); err != nil {
+		return err
+	}
+	return models.UnbindQueue(p.pool, queueName, exchangeName, routingKey)
+}
+
+func (p *Postgres) Publish(ctx context.Context, exchangeName, routingKey string, msg Message) error {
+	if msg.MessageID == "" {
+		msg.MessageID = NewMessageID()
+	}
+	return publishQueueMessage(p.pool, exchangeName, routingKey, models.QueueMessage{
+		MessageID:   msg.MessageID,
+		Type:        msg.Type,
+		ContentType: msg.ContentType,
+		Headers:     msg.Headers,
+		Body:        msg.Body,
+	})
+}
+
+func publishQueueMessage(db database.DBTX, exchangeName, routingKey string, message models.QueueMessage) error {
+	if err := requireExchange(exchangeName); err != nil {
+		return err
+	}
+	routed, err := models.PublishQueueMessage(db, exchangeName, routingKey, message)
+	if err != nil {
+		return err
+	}
+	if routed == 0 {
+		return ErrUnroutable
+	}
+	return nil
+}
+
+// PublishOutboxMessage publishes a message of the outbox in the transaction
+// that marks it as sent, so that it is published exactly once. Use it as
+// rabbitmq.OutboxSettings.Publish.
+func (p *Postgres) PublishOutboxMessage(ctx context.Context, tx pgx.Tx, message models.OutboxMessage) error {
+	// A savepoint keeps a failed insert from aborting the rest of the batch.
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer savepoint.Rollback(context.Background())
+
+	err = publishQueueMessage(savepoint, message.Exchange, message.RoutingKey, models.QueueMessage{
+		MessageID:   strconv.FormatInt(message.ID, 10),
+		ContentType: message.ContentType,
+		Body:        message.Body,
+	})
+	if err != nil {
+		return err
+	}
+	return savepoint.Commit(ctx)
+}
+
+// Consume starts a consumer; a prefetch of zero claims up to 10 messages at
+// a time.
+func (p *Postgres) Consume(ctx context.Context, tenantID int, queueName, tag string, prefetch int) (ConsumerInfo, error) {
+	c, err := p.consume(tenantID, queueName, tag, prefetch, nil)
+	if err != nil {
+		return ConsumerInfo{}, err
+	}
+	return c.snapshot(), nil
+}
+
+func (p *Postgres) Stream(ctx context.Context, tenantID int, queueName, tag string, prefetch int, handler Handler) error {
+	c, err := p.consume(tenantID, queueName, tag, prefetch, handler)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		p.forget(c)
+	case <-c.ctx.Done():
+	}
+	return nil
+}
+
+// consume starts a consumer passing its messages to handler, or dispatching
+// them when handler is nil.
+func (p *Postgres) consume(tenantID int, queueName, tag string, prefetch int, handler Handler) (*postgresConsumer, error) {
+	if prefetch <= 0 {
+		prefetch = 10
+	}
+	if err := p.requireQueue(queueName); err != nil {
+		return nil, err
+	}
+
+	c := &postgresConsumer{
+		broker: p,
+		info: ConsumerInfo{
+			Tag:       tag,
+			TenantID:  tenantID,
+			Queue:     queueName,
+			State:     rabbitmq.ConsumerRunning,
+			Prefetch:  prefetch,
+			Stream:    handler != nil,
+			StartedAt: time.Now(),
+		},
+		owner:   fmt.Sprintf("%s/%d/%s", p.instance, tenantID, tag),
+		wake:    make(chan struct{}, 1),
+		handler: handler,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	key := consumerKey{tenantID: tenantID, tag: tag}
+
+	p.mu.Lock()
+	if _, ok := p.consumers[key]; ok {
+		p.mu.Unlock()
+		c.cancel()
+		return nil, ErrConsumerExists
+	}
+	p.consumers[key] = c
+	if !p.listening {
+		p.listening = true
+		go p.listen()
+	}
+	p.mu.Unlock()
+
+	go c.run()
+	logs.LogWithFields(logger, logrus.InfoLevel, "Consumer started successfully", struct {
+		QueueName string
+		Tag       string
+	}{QueueName: queueName, Tag: tag})
+	return c, nil
+}
+
+// StopConsuming stops a consumer and, like RabbitMQ closing its channel,
+// unlocks the messages it has not settled yet, so that they can be moved or
+// delivered to another consumer right away.
+func (p *Postgres) StopConsuming(ctx context.Context, tenantID int, tag string) error {
+	key := consumerKey{tenantID: tenantID, tag: tag}
+
+	p.mu.Lock()
+	c, ok := p.consumers[key]
+	delete(p.consumers, key)
+	p.mu.Unlock()
+	if !ok {
+		return ErrConsumerNotFound
+	}
+
+	c.cancel()
+	if err := models.ReleaseQueueMessageLocks(p.pool, c.owner); err != nil {
+		return err
+	}
+	logs.LogWithFields(logger, logrus.InfoLevel, "Consumer stopped", struct {
+		QueueName string
+		Tag       string
+	}{QueueName: c.info.Queue, Tag: tag})
+	return nil
+}
+
+// forget removes a consumer, unless it was already replaced under its tag,
+// and stops it.
+func (p *Postgres) forget(c *postgresConsumer) {
+	key := consumerKey{tenantID: c.info.TenantID, tag: c.info.Tag}
+	p.mu.Lock()
+	if p.consumers[key] == c {
+		delete(p.consumers, key)
+	}
+	p.mu.Unlock()
+	c.cancel()
+}
+
+func (p *Postgres) Consumers(tenantID int) []ConsumerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	infos := []ConsumerInfo{}
+	for key, c := range p.consumers {
+		if key.tenantID == tenantID {
+			infos = append(infos, c.snapshot())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Tag < infos[j].Tag })
+	return infos
+}
+
+func (p *Postgres) MoveMessages(ctx context.Context, fromQueue, toQueue string) (int, error) {
+	if err := p.requireQueue(fromQueue); err != nil {
+		return 0, err
+	}
+	if err := p.requireQueue(toQueue); err != nil {
+		return 0, err
+	}
+
+	var moved int64
+	err := p.withTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		if moved, err = models.MoveQueueMessages(tx, fromQueue, toQueue); err != nil {
+			return err
+		}
+		return models.NotifyQueue(tx, toQueue)
+	})
+	return int(moved), err
+}
+
+func (p *Postgres) DeleteQueue(ctx context.Context, queueName string) (int, error) {
+	var count int
+	err := p.withTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		count, err = models.DeleteQueue(tx, queueName)
+		return err
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	for key, c := range p.consumers {
+		if c.info.Queue == queueName {
+			delete(p.consumers, key)
+			c.cancel()
+		}
+	}
+	p.mu.Unlock()
+	return count, nil
+}
+
+// QueueStats returns the ready messages of a queue and the consumers this
+// instance runs on it.
+func (p *Postgres) QueueStats(ctx context.Context, queueName string) (QueueStats, error) {
+	if err := p.requireQueue(queueName); err != nil {
+		return QueueStats{}, err
+	}
+	messages, err := models.CountQueueMessages(p.pool, queueName)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	stats := QueueStats{Messages: messages}
+	p.mu.Lock()
+	for _, c := range p.consumers {
+		if c.info.Queue == queueName {
+			stats.Consumers++
+		}
+	}
+	p.mu.Unlock()
+	return stats, nil
+}
+
+func (p *Postgres) DeadLetters(ctx context.Context, queueName string, limit int) ([]DeadLetter, error) {
+	if err := p.requireQueue(queueName); err != nil {
+		return nil, err
+	}
+	messages, err := models.ListQueueMessages(p.pool, DeadLetterQueue(queueName), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []DeadLetter{}
+	for _, message := range messages {
+		letters = append(letters, newDeadLetter(queueMessage(message)))
+	}
+	return letters, nil
+}
+
+func (p *Postgres) ReplayDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	if err := p.requireQueue(queueName); err != nil {
+		return 0, err
+	}
+
+	var replayed int64
+	err := p.withTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		replayed, err = models.RequeueQueueMessages(tx, DeadLetterQueue(queueName), queueName, messageIDs, limit)
+		if err != nil {
+			return err
+		}
+		return models.NotifyQueue(tx, queueName)
+	})
+	return int(replayed), err
+}
+
+func (p *Postgres) DiscardDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	if err := p.requireQueue(queueName); err != nil {
+		return 0, err
+	}
+	discarded, err := models.DeleteQueueMessages(p.pool, DeadLetterQueue(queueName), messageIDs, limit)
+	return int(discarded), err
+}
+
+// queueMessage returns a stored message with its retry count and dead-letter
+// reason in the headers the RabbitMQ broker uses for them.
+func queueMessage(message models.QueueMessage) Message {
+	headers := copyHeaders(message.Headers)
+	if message.Retries > 0 {
+		headers[rabbitmq.RetryCountHeader] = int32(message.Retries)
+	}
+	if message.DeadReason != nil {
+		headers["x-first-death-reason"] = *message.DeadReason
+	}
+	return Message{
+		ContentType: message.ContentType,
+		Type:        message.Type,
+		MessageID:   message.MessageID,
+		Headers:     headers,
+		Body:        message.Body,
+	}
+}
+
+// listen wakes the consumers of a queue when a message is inserted into it.
+// It holds one connection of the pool for as long as the process runs and
+// reconnects after an error; consumers poll in the meantime.
+func (p *Postgres) listen() {
+	ctx := context.Background()
+	for {
+		err := p.waitForNotifications(ctx)
+		logs.LogWithFields(logger, logrus.WarnLevel, "Queue notification listener stopped", struct{ Error error }{Error: err})
+		time.Sleep(p.settings.PollInterval)
+	}
+}
+
+func (p *Postgres) waitForNotifications(ctx context.Context) error {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN queue_messages"); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "UNLISTEN queue_messages")
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		for _, c := range p.consumers {
+			if c.info.Queue == notification.Payload {
+				c.notify()
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// postgresConsumer claims messages of a queue up to its prefetch and runs
+// their handlers, each in a goroutine of its own.
+type postgresConsumer struct {
+	broker  *Postgres
+	owner   string
+	wake    chan struct{}
+	handler Handler
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu        sync.Mutex
+	info      ConsumerInfo
+	inFlight  int
+	lockedAt  time.Time
+	lastError *string
+}
+
+func (c *postgresConsumer) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *postgresConsumer) snapshot() ConsumerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := c.info
+	info.LastError = c.lastError
+	return info
+}
+
+func (c *postgresConsumer) setLastError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	text := err.Error()
+	c.lastError = &text
+}
+
+func (c *postgresConsumer) run() {
+	ticker := time.NewTicker(c.broker.settings.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.claim(); err != nil {
+			c.setLastError(err)
+			c.mu.Lock()
+			c.info.State = rabbitmq.ConsumerRecovering
+			c.mu.Unlock()
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to claim queue messages", struct {
+				QueueName string
+				Tag       string
+				Error     error
+			}{QueueName: c.info.Queue, Tag: c.info.Tag, Error: err})
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+	}
+}
+
+// claim dead-letters messages over the delivery limit, renews the locks of
+// the messages being handled and claims as many messages as the prefetch
+// allows.
+func (c *postgresConsumer) claim() error {
+	b := c.broker
+	queueName := c.info.Queue
+
+	c.mu.Lock()
+	free := c.info.Prefetch - c.inFlight
+	renew := c.inFlight > 0 && time.Since(c.lockedAt) > b.settings.LockTimeout/2
+	c.mu.Unlock()
+
+	if renew {
+		if err := models.ExtendQueueMessageLocks(b.pool, c.owner, b.settings.LockTimeout); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.lockedAt = time.Now()
+		c.mu.Unlock()
+	}
+	if free <= 0 || c.ctx.Err() != nil {
+		return nil
+	}
+
+	if _, err := models.DeadLetterUndeliverableMessages(b.pool, queueName, DeadLetterQueue(queueName), b.queues.DeliveryLimit); err != nil {
+		return err
+	}
+	messages, err := models.ClaimQueueMessages(b.pool, queueName, c.owner, free, b.settings.LockTimeout)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.info.State = rabbitmq.ConsumerRunning
+	c.inFlight += len(messages)
+	if c.inFlight == len(messages) {
+		c.lockedAt = time.Now()
+	}
+	c.mu.Unlock()
+
+	for _, message := range messages {
+		go c.process(message)
+	}
+	if len(messages) == free {
+		// There may be more.
+		c.notify()
+	}
+	return nil
+}
+
+// process runs the handler of a claimed message and settles it like the
+// RabbitMQ consumers do. A message of a stopped consumer whose handler failed
+// is unlocked, so that it is delivered again.
+func (c *postgresConsumer) process(message models.QueueMessage) {
+	msg := queueMessage(message)
+	delivery := rabbitmq.Message{
+		TenantID:    c.info.TenantID,
+		Queue:       c.info.Queue,
+		Type:        msgType(msg),
+		MessageID:   msg.MessageID,
+		Headers:     amqp091.Table(msg.Headers),
+		Body:        msg.Body,
+		Redelivered: message.Deliveries > 1,
+	}
+	var err error
+	if c.handler != nil {
+		err = rabbitmq.Run(c.ctx, c.handler, delivery)
+	} else {
+		err = rabbitmq.Dispatch(c.ctx, delivery)
+	}
+	if err != nil && c.handler != nil {
+		// A stream ends at its first error, which releases the message.
+		c.broker.forget(c)
+	}
+
+	b := c.broker
+	queueName := c.info.Queue
+	var settleErr error
+	switch {
+	case err == nil:
+		settleErr = models.AckQueueMessage(b.pool, queueName, message.ID, c.owner)
+	case c.ctx.Err() != nil:
+		settleErr = models.ReleaseQueueMessage(b.pool, queueName, message.ID, c.owner)
+	case rabbitmq.IsPermanent(err) || message.Retries >= len(b.queues.RetryDelays):
+		settleErr = models.DeadLetterQueueMessage(b.pool, queueName, message.ID, c.owner, DeadLetterQueue(queueName), "rejected")
+	default:
+		settleErr = models.RetryQueueMessage(b.pool, queueName, message.ID, c.owner, b.queues.RetryDelays[message.Retries])
+	}
+
+	if err != nil {
+		c.setLastError(err)
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to handle message", struct {
+			QueueName string
+			Tag       string
+			MessageID string
+			Error     error
+		}{QueueName: queueName, Tag: c.info.Tag, MessageID: msg.MessageID, Error: err})
+	}
+	if settleErr != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to settle message", struct{ Error error }{Error: settleErr})
+	}
+
+	c.mu.Lock()
+	c.inFlight--
+	c.info.MessagesProcessed++
+	c.mu.Unlock()
+	c.notify()
+}
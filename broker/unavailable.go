@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnavailable is returned by every operation of Unavailable.
+var ErrUnavailable = errors.New("broker: no message broker configured")
+
+// Unavailable is the Broker of a request that was not given one, so that a
+// missing broker fails the request with ErrUnavailable instead of panicking.
+type Unavailable struct{}
+
+func (Unavailable) DeclareTenantQueue(ctx context.Context, queueName string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) BindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) UnbindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Publish(ctx context.Context, exchangeName, routingKey string, msg Message) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Consume(ctx context.Context, tenantID int, queueName, tag string, prefetch int) (ConsumerInfo, error) {
+	return ConsumerInfo{}, ErrUnavailable
+}
+
+func (Unavailable) Stream(ctx context.Context, tenantID int, queueName, tag string, prefetch int, handler Handler) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) StopConsuming(ctx context.Context, tenantID int, tag string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Consumers(tenantID int) []ConsumerInfo {
+	return []ConsumerInfo{}
+}
+
+func (Unavailable) MoveMessages(ctx context.Context, fromQueue, toQueue string) (int, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) DeleteQueue(ctx context.Context, queueName string) (int, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) QueueStats(ctx context.Context, queueName string) (QueueStats, error) {
+	return QueueStats{}, ErrUnavailable
+}
+
+func (Unavailable) DeadLetters(ctx context.Context, queueName string, limit int) ([]DeadLetter, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) ReplayDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) DiscardDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return 0, ErrUnavailable
+}
@@ -0,0 +1,200 @@
+// Command migrate applies or rolls back the database migrations outside of
+// server startup.
+//
+//	go run ./cmd/migrate [-dry-run] up [version]
+//	go run ./cmd/migrate [-dry-run] down [steps]
+//	go run ./cmd/migrate status
+//
+// With -tenant the tenant-level migrations of one tenant are applied to its
+// schema or dedicated database instead, and with -tenants to every tenant.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/migrations"
+	"jatis_mobile_api/models"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "print the statements that would run without executing them")
+	tenantID := flag.Int("tenant", 0, "migrate the schema of this tenant")
+	allTenants := flag.Bool("tenants", false, "migrate the schemas of all tenants")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: migrate [-dry-run] [-tenant id | -tenants] up [version] | down [steps] | status")
+	}
+	flag.Parse()
+
+	if err := run(*dryRun, *tenantID, *allTenants, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(dryRun bool, tenantID int, allTenants bool, args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if err := auth.SetupSecrets(cfg); err != nil {
+		return err
+	}
+	if err := database.ConnectDB(cfg.PostgresURL, database.PoolSettings{MaxConns: 2}); err != nil {
+		return err
+	}
+	defer database.Close()
+
+	logger := logs.SetupLogger()
+
+	if !allTenants {
+		migrator, closer, err := newMigrator(logger, tenantID, dryRun)
+		if err != nil {
+			return err
+		}
+		defer closer()
+		if err := execute(migrator, args); err != nil {
+			return err
+		}
+		return moveTenantRows(logger, tenantID, dryRun, args)
+	}
+
+	tenantIDs, err := models.ListTenantIDs(database.SystemDB())
+	if err != nil {
+		return err
+	}
+	for _, tenantID := range tenantIDs {
+		if args[0] == "status" {
+			fmt.Println(database.TenantSchema(tenantID) + ":")
+		}
+		migrator, closer, err := newMigrator(logger, tenantID, dryRun)
+		if err != nil {
+			return err
+		}
+		err = execute(migrator, args)
+		closer()
+		if err == nil {
+			err = moveTenantRows(logger, tenantID, dryRun, args)
+		}
+		if err != nil {
+			return fmt.Errorf("tenant %d: %w", tenantID, err)
+		}
+	}
+	return nil
+}
+
+// moveTenantRows moves the rows of a tenant with a dedicated database out of
+// the shared tables once all its migrations are applied, like the server does
+// on startup.
+func moveTenantRows(logger *logrus.Logger, tenantID int, dryRun bool, args []string) error {
+	if tenantID == 0 || dryRun || args[0] != "up" || len(args) > 1 {
+		return nil
+	}
+	tenant, err := models.GetTenantByID(database.SystemDB(), tenantID, true)
+	if err != nil || !tenant.HasDatabase() {
+		return err
+	}
+	return migrations.MoveTenantRows(context.Background(), database.SystemDB(), logger, *tenant)
+}
+
+// newMigrator returns the migrator for the shared schema or, given a tenant,
+// for the tenant schema or the dedicated database of the tenant. The returned
+// function releases the connection to a dedicated database.
+func newMigrator(logger *logrus.Logger, tenantID int, dryRun bool) (*migrations.Migrator, func(), error) {
+	var (
+		migrator *migrations.Migrator
+		err      error
+		closer   = func() {}
+	)
+	if tenantID > 0 {
+		tenant, tenantErr := models.GetTenantByID(database.SystemDB(), tenantID, true)
+		if tenantErr != nil {
+			return nil, nil, fmt.Errorf("tenant %d: %w", tenantID, tenantErr)
+		}
+		if tenant.HasDatabase() {
+			pool, poolErr := connectTenantDatabase(tenant)
+			if poolErr != nil {
+				return nil, nil, poolErr
+			}
+			closer = pool.Close
+			migrator, err = migrations.NewTenantDatabaseMigrator(pool, logger)
+		} else {
+			migrator, err = migrations.NewTenantMigrator(database.SystemDB(), logger, tenantID)
+		}
+	} else {
+		migrator, err = migrations.NewMigrator(database.SystemDB(), logger)
+	}
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+	migrator.DryRun = dryRun
+	migrator.Out = os.Stdout
+	return migrator, closer, nil
+}
+
+func connectTenantDatabase(tenant *models.Tenant) (*pgxpool.Pool, error) {
+	dsn, err := auth.DecryptSecret(tenant.EncryptedDSN)
+	if err != nil {
+		return nil, err
+	}
+	return pgxpool.Connect(context.Background(), dsn)
+}
+
+func execute(migrator *migrations.Migrator, args []string) error {
+	var err error
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		var target int64
+		if len(args) > 1 {
+			if target, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return fmt.Errorf("invalid version %q", args[1])
+			}
+		}
+		return migrator.Up(ctx, target)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		return migrator.Down(ctx, steps)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if status.Modified {
+				state += " (modified)"
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
@@ -2,18 +2,81 @@ package config
 
 import (
 	"jatis_mobile_api/logs"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+type JWTKey struct {
+	ID     string
+	Secret string
+}
+
 type Config struct {
-	RabbitMQURL string
-	PostgresURL string
-	PORT        int
+	RabbitMQURL          string
+	PostgresURL          string
+	PORT                 int
+	TenantPurgeRetention time.Duration
+	TenantResolvers      []string
+	TenantHeader         string
+	TenantBaseDomain     string
+	TenantCacheTTL       time.Duration
+	JWTKeys              []JWTKey
+	JWTActiveKeyID       string
+	JWTIssuer            string
+	AccessTokenTTL       time.Duration
+	RefreshTokenTTL      time.Duration
+
+	PasswordAlgorithm     string
+	BcryptCost            int
+	Argon2Memory          uint32
+	Argon2Iterations      uint32
+	Argon2Parallelism     uint8
+	BreachedPasswordsFile string
+	PasswordMinLength     int
+	PasswordHistorySize   int
+	PasswordCheckBreached bool
+
+	PostgresMinConns          int32
+	PostgresMaxConns          int32
+	PostgresMaxConnLifetime   time.Duration
+	PostgresMaxConnIdleTime   time.Duration
+	PostgresHealthCheckPeriod time.Duration
+	MigrateOnStartup          bool
+	TenantIsolation           string
+	TenantSchemaOnPurge       string
+	SecretsKey                string
+	TenantDatabaseAdminURL    string
+	TenantPoolMaxConns        int32
+	TenantPoolMaxOpen         int
+	TenantPoolIdleTimeout     time.Duration
+	OutboxPollInterval        time.Duration
+	OutboxBatchSize           int
+	OutboxRetryDelay          time.Duration
+	OutboxMaxRetryDelay       time.Duration
+	OutboxRetention           time.Duration
+
+	MessageBroker              string
+	PostgresQueuePollInterval  time.Duration
+	PostgresQueueLockTimeout   time.Duration
+	RabbitMQPublisherChannels  int
+	RabbitMQManagementChannels int
+	RabbitMQConsumerPrefetch   int
+	RabbitMQReconnectDelay     time.Duration
+	RabbitMQMaxReconnectDelay  time.Duration
+	RabbitMQDeliveryLimit      int
+	RabbitMQRetryDelays        []time.Duration
+
+	BootstrapTenant        string
+	BootstrapAdminEmail    string
+	BootstrapAdminPassword string
 }
 
-var logger = logs.SetupLogger()
+var (
+	logger = logs.SetupLogger()
+	loaded Config
+)
 
 func LoadConfig() (Config, error) {
 	viper.SetConfigName("config")
@@ -41,5 +104,16 @@ func LoadConfig() (Config, error) {
 		RabbitMQURL: config.RabbitMQURL,
 	})
 
+	loaded = config
 	return config, nil
 }
+
+func GetConfig() Config {
+	return loaded
+}
+
+// SetConfig replaces the configuration returned by GetConfig, for tests and
+// tools that do not read a configuration file.
+func SetConfig(config Config) {
+	loaded = config
+}
@@ -3,40 +3,171 @@ package database
 import (
 	"context"
 	"jatis_mobile_api/logs"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/sirupsen/logrus"
 )
 
+// DBTX is satisfied by both *pgxpool.Pool and pgx.Tx, so model functions can
+// run either on the pool or inside a transaction.
+type DBTX interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// PoolSettings tunes the connection pool. Zero values keep the pgxpool
+// defaults.
+type PoolSettings struct {
+	MinConns          int32
+	MaxConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+}
+
+type PoolStats struct {
+	AcquireCount         int64         `json:"acquire_count"`
+	AcquireDuration      time.Duration `json:"acquire_duration"`
+	AcquiredConns        int32         `json:"acquired_conns"`
+	CanceledAcquireCount int64         `json:"canceled_acquire_count"`
+	ConstructingConns    int32         `json:"constructing_conns"`
+	EmptyAcquireCount    int64         `json:"empty_acquire_count"`
+	IdleConns            int32         `json:"idle_conns"`
+	MaxConns             int32         `json:"max_conns"`
+	TotalConns           int32         `json:"total_conns"`
+	TenantPools          int           `json:"tenant_pools"`
+}
+
 var (
-	conn   *pgx.Conn
-	logger = logs.SetupLogger()
+	pool       *pgxpool.Pool
+	systemPool *pgxpool.Pool
+	logger     = logs.SetupLogger()
 )
 
-func ConnectDB(postgresURL string) error {
-	var err error
-	conn, err = pgx.Connect(context.Background(), postgresURL)
+func ConnectDB(postgresURL string, settings PoolSettings) error {
+	poolConfig, err := pgxpool.ParseConfig(postgresURL)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid PostgreSQL URL", struct{ Error error }{Error: err})
+		return err
+	}
+
+	if settings.MinConns > 0 {
+		poolConfig.MinConns = settings.MinConns
+	}
+	if settings.MaxConns > 0 {
+		poolConfig.MaxConns = settings.MaxConns
+	}
+	if settings.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = settings.MaxConnLifetime
+	}
+	if settings.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = settings.MaxConnIdleTime
+	}
+	if settings.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = settings.HealthCheckPeriod
+	}
+
+	pool, err = pgxpool.ConnectConfig(context.Background(), poolConfig)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to connect to PostgreSQL", struct {
+			PostgresURL string
+			Error       error
+		}{PostgresURL: postgresURL, Error: err})
+		return err
+	}
+
+	// The system pool takes the same settings, so up to twice MaxConns
+	// connections can be open.
+	systemConfig := poolConfig.Copy()
+	systemConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, "SELECT set_config('app.bypass_rls', 'on', false)")
+		return err
+	}
+	systemPool, err = pgxpool.ConnectConfig(context.Background(), systemConfig)
 	if err != nil {
+		pool.Close()
 		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to connect to PostgreSQL", struct {
 			PostgresURL string
 			Error       error
 		}{PostgresURL: postgresURL, Error: err})
 		return err
 	}
-	logs.LogWithFields(logger, logrus.InfoLevel, "Connected to PostgreSQL", struct{ PostgresURL string }{PostgresURL: postgresURL})
+	logs.LogWithFields(logger, logrus.InfoLevel, "Connected to PostgreSQL", struct {
+		PostgresURL string
+		MinConns    int32
+		MaxConns    int32
+	}{PostgresURL: postgresURL, MinConns: poolConfig.MinConns, MaxConns: poolConfig.MaxConns})
 	return nil
 }
 
-func GetDB() *pgx.Conn {
-	return conn
+// GetDB returns the pool for queries on behalf of a tenant. Its connections
+// see no rows of tenant tables until app.current_tenant is set, see
+// AcquireTenantConn and WithTenantTx.
+func GetDB() *pgxpool.Pool {
+	return pool
+}
+
+// SystemDB returns the pool for work that is not on behalf of a single
+// tenant: resolving the tenant of a request before it is authenticated,
+// administering tenants, provisioning and migrations. Its connections set
+// app.bypass_rls, so row-level security does not restrict them.
+func SystemDB() *pgxpool.Pool {
+	return systemPool
+}
+
+// WithTx runs fn in a transaction on GetDB that is committed if fn returns
+// nil and rolled back otherwise.
+func WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	return InTx(ctx, pool, fn)
+}
+
+// InTx is WithTx on db, which may be SystemDB, a tenant connection or a
+// tenant pool.
+func InTx(ctx context.Context, db DBTX, fn func(tx pgx.Tx) error) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func Ping(ctx context.Context) error {
+	return pool.Ping(ctx)
+}
+
+func Stats() PoolStats {
+	stat := pool.Stat()
+	return PoolStats{
+		AcquireCount:         stat.AcquireCount(),
+		AcquireDuration:      stat.AcquireDuration(),
+		AcquiredConns:        stat.AcquiredConns(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		ConstructingConns:    stat.ConstructingConns(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		IdleConns:            stat.IdleConns(),
+		MaxConns:             stat.MaxConns(),
+		TotalConns:           stat.TotalConns(),
+		TenantPools:          OpenTenantPools(),
+	}
 }
 
 func Close() {
-	if conn != nil {
-		if err := conn.Close(context.Background()); err != nil {
-			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to close PostgreSQL connection", struct{ Error error }{Error: err})
-		} else {
-			logs.LogWithFields(logger, logrus.InfoLevel, "PostgreSQL connection closed successfully", struct{}{})
-		}
+	closeTenantPools()
+	if systemPool != nil {
+		systemPool.Close()
+	}
+	if pool != nil {
+		pool.Close()
+		logs.LogWithFields(logger, logrus.InfoLevel, "PostgreSQL connection pool closed successfully", struct{}{})
 	}
 }
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"jatis_mobile_api/logs"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// RouterSettings limits the pools kept open for tenants with a dedicated
+// database. Zero values keep the defaults.
+type RouterSettings struct {
+	MaxConnsPerTenant int32
+	MaxOpenPools      int
+	IdleTimeout       time.Duration
+}
+
+type tenantPool struct {
+	tenantID int
+	dsn      string
+	pool     *pgxpool.Pool
+	lastUsed time.Time
+}
+
+// tenantRouter lazily opens one pool per tenant database and closes the least
+// recently used pool when too many are open, as well as pools that have not
+// been used for IdleTimeout.
+type tenantRouter struct {
+	mu       sync.Mutex
+	settings RouterSettings
+	pools    map[int]*list.Element
+	lru      *list.List
+	stop     chan struct{}
+}
+
+var router = &tenantRouter{
+	settings: RouterSettings{MaxConnsPerTenant: 5, MaxOpenPools: 50, IdleTimeout: 10 * time.Minute},
+	pools:    map[int]*list.Element{},
+	lru:      list.New(),
+}
+
+// ConfigureRouter applies settings and starts closing idle tenant pools.
+func ConfigureRouter(settings RouterSettings) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if settings.MaxConnsPerTenant > 0 {
+		router.settings.MaxConnsPerTenant = settings.MaxConnsPerTenant
+	}
+	if settings.MaxOpenPools > 0 {
+		router.settings.MaxOpenPools = settings.MaxOpenPools
+	}
+	if settings.IdleTimeout > 0 {
+		router.settings.IdleTimeout = settings.IdleTimeout
+	}
+
+	if router.stop == nil {
+		router.stop = make(chan struct{})
+		go router.closeIdlePools(router.stop)
+	}
+}
+
+// TenantPool returns the pool of the dedicated database of a tenant, opening
+// it on first use.
+func TenantPool(ctx context.Context, tenantID int, dsn string) (*pgxpool.Pool, error) {
+	router.mu.Lock()
+	if element, ok := router.pools[tenantID]; ok {
+		entry := element.Value.(*tenantPool)
+		if entry.dsn == dsn {
+			entry.lastUsed = time.Now()
+			router.lru.MoveToFront(element)
+			router.mu.Unlock()
+			return entry.pool, nil
+		}
+		router.removeLocked(element)
+	}
+	maxConns := router.settings.MaxConnsPerTenant
+	router.mu.Unlock()
+
+	// Connecting happens outside of the lock so that one unreachable tenant
+	// database does not hold up requests of other tenants.
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = maxConns
+	poolConfig.MinConns = 0
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to connect to tenant database", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenantID, Error: err})
+		return nil, err
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	// Another request may have opened the same pool in the meantime.
+	if element, ok := router.pools[tenantID]; ok && element.Value.(*tenantPool).dsn == dsn {
+		go pool.Close()
+		entry := element.Value.(*tenantPool)
+		entry.lastUsed = time.Now()
+		router.lru.MoveToFront(element)
+		return entry.pool, nil
+	}
+
+	router.pools[tenantID] = router.lru.PushFront(&tenantPool{tenantID: tenantID, dsn: dsn, pool: pool, lastUsed: time.Now()})
+	for router.lru.Len() > router.settings.MaxOpenPools {
+		router.removeLocked(router.lru.Back())
+	}
+	return pool, nil
+}
+
+// CloseTenantPool closes the pool of a tenant database, for example before the
+// database is dropped.
+func CloseTenantPool(tenantID int) {
+	router.mu.Lock()
+	element, ok := router.pools[tenantID]
+	if ok {
+		delete(router.pools, tenantID)
+		router.lru.Remove(element)
+	}
+	router.mu.Unlock()
+
+	if ok {
+		element.Value.(*tenantPool).pool.Close()
+	}
+}
+
+// removeLocked closes a pool in the background, since Close waits for
+// connections that are still in use by requests.
+func (r *tenantRouter) removeLocked(element *list.Element) {
+	entry := element.Value.(*tenantPool)
+	delete(r.pools, entry.tenantID)
+	r.lru.Remove(element)
+	go entry.pool.Close()
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Closed tenant database pool", struct{ TenantID int }{TenantID: entry.tenantID})
+}
+
+func (r *tenantRouter) closeIdlePools(stop chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			cutoff := time.Now().Add(-r.settings.IdleTimeout)
+			for element := r.lru.Back(); element != nil; {
+				entry := element.Value.(*tenantPool)
+				if entry.lastUsed.After(cutoff) {
+					break
+				}
+				previous := element.Prev()
+				r.removeLocked(element)
+				element = previous
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// closeTenantPools stops the router and closes every tenant pool.
+func closeTenantPools() {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if router.stop != nil {
+		close(router.stop)
+		router.stop = nil
+	}
+	for router.lru.Len() > 0 {
+		entry := router.lru.Remove(router.lru.Back()).(*tenantPool)
+		delete(router.pools, entry.tenantID)
+		entry.pool.Close()
+	}
+}
+
+// OpenTenantPools returns the number of open tenant database pools.
+func OpenTenantPools() int {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	return router.lru.Len()
+}
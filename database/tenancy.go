@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// IsolationShared keeps every tenant in the public schema, told apart by
+	// tenant_id columns.
+	IsolationShared = "shared"
+	// IsolationSchema additionally gives every tenant its own schema holding
+	// the tenant-level tables.
+	IsolationSchema = "schema"
+	// IsolationDatabase gives every new tenant its own database holding the
+	// tenant-level tables.
+	IsolationDatabase = "database"
+)
+
+var isolation = IsolationShared
+
+func SetIsolation(mode string) error {
+	switch mode {
+	case "", IsolationShared:
+		isolation = IsolationShared
+	case IsolationSchema, IsolationDatabase:
+		isolation = mode
+	default:
+		return fmt.Errorf("unknown tenant isolation mode %q", mode)
+	}
+	return nil
+}
+
+func Isolation() string {
+	return isolation
+}
+
+// TenantSchema returns the schema of a tenant in schema isolation mode. It is
+// derived from the tenant ID so that renaming a tenant does not move data.
+func TenantSchema(tenantID int) string {
+	return fmt.Sprintf("tenant_%d", tenantID)
+}
+
+// TenantDatabase returns the name of the dedicated database of a tenant.
+func TenantDatabase(tenantID int) string {
+	return fmt.Sprintf("tenant_%d", tenantID)
+}
+
+// AcquireTenantConn acquires a connection for queries on behalf of a tenant.
+// It sets app.current_tenant, which the row-level security policies restrict
+// rows to. In schema isolation mode its search_path also starts with the
+// tenant schema, so tenant-level tables resolve there and shared tables fall
+// through to public. The connection must be returned with ReleaseTenantConn.
+func AcquireTenantConn(ctx context.Context, tenantID int) (*pgxpool.Conn, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Exec(ctx, "SELECT set_config('app.current_tenant', $1, false)", strconv.Itoa(tenantID)); err != nil {
+		ReleaseTenantConn(conn)
+		return nil, err
+	}
+
+	if isolation == IsolationSchema {
+		schema := pgx.Identifier{TenantSchema(tenantID)}.Sanitize()
+		if _, err := conn.Exec(ctx, "SET search_path TO "+schema+", public"); err != nil {
+			ReleaseTenantConn(conn)
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ReleaseTenantConn resets the session state set by AcquireTenantConn before
+// returning the connection to the pool. A connection that cannot be reset is
+// closed rather than handed to another tenant.
+func ReleaseTenantConn(conn *pgxpool.Conn) {
+	if _, err := conn.Exec(context.Background(), "RESET app.current_tenant; RESET search_path"); err != nil {
+		conn.Conn().Close(context.Background())
+	}
+	conn.Release()
+}
+
+// WithTenantConn runs fn on a connection acquired with AcquireTenantConn,
+// for the queries of a request whose tenant is known but that has no
+// TenantDB connection, such as logging in.
+func WithTenantConn(ctx context.Context, tenantID int, fn func(db DBTX) error) error {
+	conn, err := AcquireTenantConn(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	defer ReleaseTenantConn(conn)
+	return fn(conn)
+}
+
+// WithTenantTx runs fn in a transaction restricted to the rows of a tenant,
+// for work outside of a request, which has no TenantDB connection.
+func WithTenantTx(ctx context.Context, tenantID int, fn func(tx pgx.Tx) error) error {
+	return WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT set_config('app.current_tenant', $1, true)", strconv.Itoa(tenantID)); err != nil {
+			return err
+		}
+		if isolation == IsolationSchema {
+			schema := pgx.Identifier{TenantSchema(tenantID)}.Sanitize()
+			if _, err := tx.Exec(ctx, "SET LOCAL search_path TO "+schema+", public"); err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"errors"
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// apiKeyResponse is only returned when a key is created or rotated, since it
+// is the only time the plaintext key is available.
+type apiKeyResponse struct {
+	Key    string         `json:"key"`
+	APIKey *models.APIKey `json:"api_key"`
+}
+
+func CreateAPIKeyHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	var request createAPIKeyRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for API key", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if request.Name == "" || len(request.Scopes) == 0 {
+		return c.JSON(http.StatusBadRequest, "name and scopes are required")
+	}
+	claims, _ := middleware.ClaimsFromContext(c)
+	for _, scope := range request.Scopes {
+		if !auth.IsTenantPermission(scope) {
+			return c.JSON(http.StatusBadRequest, "Scope "+scope+" cannot be granted to an API key")
+		}
+		// Callers can only grant what they hold themselves, whether they
+		// are an API key or a user.
+		if claims == nil || auth.HasRole(claims.Roles, auth.RolePlatformAdmin) {
+			continue
+		}
+		allowed, err := middleware.HasPermission(claims, scope)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to resolve permissions", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to authorize request")
+		}
+		if !allowed {
+			return c.JSON(http.StatusForbidden, "Cannot grant scope "+scope+" without holding it")
+		}
+	}
+	if request.ExpiresAt != nil && request.ExpiresAt.Before(time.Now()) {
+		return c.JSON(http.StatusBadRequest, "expires_at must be in the future")
+	}
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to generate API key", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to create API key")
+	}
+
+	apiKey := models.APIKey{
+		TenantID:  tenant.ID,
+		Name:      request.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    request.Scopes,
+		ExpiresAt: request.ExpiresAt,
+	}
+	if err := models.AddCredentialLookup(middleware.DB(c), models.CredentialAPIKey, prefix, tenant.ID); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to record API key lookup", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to create API key")
+	}
+	if err := models.CreateAPIKey(middleware.TenantDataDB(c), &apiKey); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to create API key", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "API key created successfully", struct {
+		TenantID int
+		APIKeyID int
+		Prefix   string
+	}{TenantID: tenant.ID, APIKeyID: apiKey.ID, Prefix: prefix})
+	return c.JSON(http.StatusCreated, apiKeyResponse{Key: key, APIKey: &apiKey})
+}
+
+func ListAPIKeysHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	keys, err := models.ListAPIKeys(middleware.TenantDataDB(c), tenant.ID)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to list API keys", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func RotateAPIKeyHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	keyID, err := strconv.Atoi(c.Param("keyId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid API key ID")
+	}
+
+	db := middleware.TenantDataDB(c)
+
+	apiKey, err := models.GetAPIKey(db, tenant.ID, keyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "API key not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve API key", struct {
+			TenantID int
+			APIKeyID int
+		}{TenantID: tenant.ID, APIKeyID: keyID})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	if apiKey.RevokedAt != nil {
+		return c.JSON(http.StatusConflict, "API key is revoked")
+	}
+
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to generate API key", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to rotate API key")
+	}
+	apiKey.Prefix, apiKey.KeyHash, apiKey.LastUsedAt = prefix, hash, nil
+
+	if err := models.AddCredentialLookup(middleware.DB(c), models.CredentialAPIKey, prefix, tenant.ID); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to record API key lookup", struct {
+			TenantID int
+			APIKeyID int
+			Error    error
+		}{TenantID: tenant.ID, APIKeyID: keyID, Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to rotate API key")
+	}
+
+	if err := models.RotateAPIKey(db, apiKey); errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusConflict, "API key is revoked")
+	} else if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to rotate API key", struct {
+			TenantID int
+			APIKeyID int
+			Error    error
+		}{TenantID: tenant.ID, APIKeyID: keyID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "API key rotated successfully", struct {
+		TenantID int
+		APIKeyID int
+		Prefix   string
+	}{TenantID: tenant.ID, APIKeyID: apiKey.ID, Prefix: prefix})
+	return c.JSON(http.StatusOK, apiKeyResponse{Key: key, APIKey: apiKey})
+}
+
+func RevokeAPIKeyHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	keyID, err := strconv.Atoi(c.Param("keyId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid API key ID")
+	}
+
+	if err := models.RevokeAPIKey(middleware.TenantDataDB(c), tenant.ID, keyID); errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "API key not found or already revoked")
+	} else if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to revoke API key", struct {
+			TenantID int
+			APIKeyID int
+			Error    error
+		}{TenantID: tenant.ID, APIKeyID: keyID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "API key revoked successfully", struct {
+		TenantID int
+		APIKeyID int
+	}{TenantID: tenant.ID, APIKeyID: keyID})
+	return c.JSON(http.StatusOK, "API key revoked successfully")
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type loginRequest struct {
+	Tenant   string `json:"tenant"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func LoginHandler(tokens *auth.TokenManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		logger := c.Get("logger").(*logrus.Logger)
+
+		var request loginRequest
+		if err := c.Bind(&request); err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind login request", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusBadRequest, "Invalid request body")
+		}
+		if request.Tenant == "" || request.Email == "" || request.Password == "" {
+			return c.JSON(http.StatusBadRequest, "tenant, email and password are required")
+		}
+
+		tenant, err := models.GetTenantByName(database.SystemDB(), request.Tenant, false)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve tenant for login", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to log in")
+		}
+
+		var (
+			db   database.DBTX
+			user *models.User
+		)
+		if tenant != nil {
+			var release func()
+			db, release, err = middleware.AcquireTenantData(c.Request().Context(), tenant.ID)
+			if err != nil {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to acquire tenant database", struct{ Error error }{Error: err})
+				return c.JSON(http.StatusInternalServerError, "Failed to log in")
+			}
+			defer release()
+
+			user, err = models.GetUserByEmail(db, tenant.ID, request.Email)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve user for login", struct{ Error error }{Error: err})
+				return c.JSON(http.StatusInternalServerError, "Failed to log in")
+			}
+		}
+
+		var valid, needsRehash bool
+		if user != nil {
+			valid, needsRehash = auth.VerifyPassword(user.PasswordHash, request.Password)
+		}
+		if !valid {
+			logs.LogWithFields(logger, logrus.WarnLevel, "Failed login attempt", struct {
+				TenantName string
+				Email      string
+			}{TenantName: request.Tenant, Email: request.Email})
+			return c.JSON(http.StatusUnauthorized, "Invalid credentials")
+		}
+
+		if needsRehash {
+			rehashPassword(db, logger, user, request.Password)
+		}
+
+		if err := models.SetLastLogin(db, user.TenantID, user.ID); err != nil {
+			logs.LogWithFields(logger, logrus.WarnLevel, "Failed to record last login", struct{ UserID int }{UserID: user.ID})
+		}
+
+		response, err := issueTokens(c.Request().Context(), db, tokens, user)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to issue tokens", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to log in")
+		}
+
+		logs.LogWithFields(logger, logrus.InfoLevel, "User logged in", struct {
+			UserID   int
+			TenantID int
+		}{UserID: user.ID, TenantID: user.TenantID})
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// RefreshHandler exchanges a refresh token for a new token pair. Refresh tokens
+// are single use: presenting one that was already used revokes every refresh
+// token of its user, since it has most likely been stolen.
+func RefreshHandler(tokens *auth.TokenManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		logger := c.Get("logger").(*logrus.Logger)
+
+		var request refreshRequest
+		if err := c.Bind(&request); err != nil || request.RefreshToken == "" {
+			return c.JSON(http.StatusBadRequest, "refresh_token is required")
+		}
+
+		// The tenant of the request is only known once the token is found.
+		tokenHash := auth.HashRefreshToken(request.RefreshToken)
+		tenantID, err := models.GetCredentialTenant(database.SystemDB(), models.CredentialRefreshToken, tokenHash)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "Invalid refresh token")
+		}
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to look up refresh token", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to refresh token")
+		}
+
+		db, release, err := middleware.AcquireTenantData(c.Request().Context(), tenantID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The tenant was deleted.
+			return c.JSON(http.StatusUnauthorized, "Invalid refresh token")
+		}
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to acquire tenant database", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to refresh token")
+		}
+		defer release()
+
+		stored, err := models.GetRefreshTokenByHash(db, tokenHash)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "Invalid refresh token")
+		}
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve refresh token", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to refresh token")
+		}
+
+		if time.Now().After(stored.ExpiresAt) {
+			return c.JSON(http.StatusUnauthorized, "Refresh token expired")
+		}
+
+		err = models.RevokeRefreshToken(db, stored.ID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			logs.LogWithFields(logger, logrus.WarnLevel, "Revoked refresh token reused, revoking all user tokens", struct{ UserID int }{UserID: stored.UserID})
+			if err := models.RevokeUserRefreshTokens(db, stored.UserID); err != nil {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to revoke user refresh tokens", struct{ Error error }{Error: err})
+			}
+			return c.JSON(http.StatusUnauthorized, "Invalid refresh token")
+		}
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to revoke refresh token", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to refresh token")
+		}
+
+		user, err := models.GetUserByID(db, stored.TenantID, stored.UserID, false)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, "Invalid refresh token")
+		}
+
+		response, err := issueTokens(c.Request().Context(), db, tokens, user)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to issue tokens", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to refresh token")
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// LogoutHandler revokes the given refresh token of the authenticated user. The
+// access token stays valid until it expires.
+func LogoutHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	claims, ok := middleware.ClaimsFromContext(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	var request refreshRequest
+	if err := c.Bind(&request); err != nil || request.RefreshToken == "" {
+		return c.JSON(http.StatusBadRequest, "refresh_token is required")
+	}
+
+	db, release, err := middleware.AcquireTenantData(c.Request().Context(), claims.TenantID)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to acquire tenant database", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to log out")
+	}
+	defer release()
+
+	stored, err := models.GetRefreshTokenByHash(db, auth.HashRefreshToken(request.RefreshToken))
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && stored.UserID != claims.UserID) {
+		return c.JSON(http.StatusBadRequest, "Invalid refresh token")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve refresh token", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to log out")
+	}
+
+	if err := models.RevokeRefreshToken(db, stored.ID); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to revoke refresh token", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to log out")
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "User logged out", struct{ UserID int }{UserID: claims.UserID})
+	return c.JSON(http.StatusOK, "Logged out successfully")
+}
+
+// rehashPassword upgrades a password hash created with outdated parameters.
+// Failures are only logged since the login itself succeeded.
+func rehashPassword(db database.DBTX, logger *logrus.Logger, user *models.User, password string) {
+	hash, err := auth.HashPassword(password)
+	if err == nil {
+		err = models.UpdatePasswordHash(db, user.TenantID, user.ID, hash)
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to rehash password", struct {
+			UserID int
+			Error  error
+		}{UserID: user.ID, Error: err})
+		return
+	}
+	logs.LogWithFields(logger, logrus.InfoLevel, "Password rehashed with current parameters", struct{ UserID int }{UserID: user.ID})
+}
+
+// issueTokens issues a token pair for a user, whose refresh token is stored in
+// db, the database holding the tenant-level tables of the user's tenant.
+func issueTokens(ctx context.Context, db database.DBTX, tokens *auth.TokenManager, user *models.User) (tokenResponse, error) {
+	roles, err := models.GetUserRoles(db, user.ID)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	roleNames := make([]string, 0, len(roles))
+	for _, role := range roles {
+		roleNames = append(roleNames, role.Name)
+	}
+
+	accessToken, err := tokens.IssueAccessToken(user.ID, user.TenantID, roleNames)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	err = database.WithTenantTx(ctx, user.TenantID, func(tx pgx.Tx) error {
+		return models.AddCredentialLookup(tx, models.CredentialRefreshToken, refreshHash, user.TenantID)
+	})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	err = models.CreateRefreshToken(db, &models.RefreshToken{
+		UserID:    user.ID,
+		TenantID:  user.TenantID,
+		TokenHash: refreshHash,
+		ExpiresAt: time.Now().Add(tokens.RefreshTokenTTL()),
+	})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	return tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(tokens.AccessTokenTTL().Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
@@ -1,29 +1,135 @@
 package handlers
 
 import (
+	"errors"
+	"jatis_mobile_api/broker"
 	"jatis_mobile_api/logs"
-	"jatis_mobile_api/rabbitmq"
+	"jatis_mobile_api/middleware"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
 
+// ConsumerHandler starts the default consumer of the request tenant, tagged
+// with the tenant name. Calling it again while that consumer runs does not
+// start another one.
 func ConsumerHandler(c echo.Context) error {
 	logger := c.Get("logger").(*logrus.Logger)
 
-	tenantName := c.Request().Header.Get("x-tenant-name")
-	if tenantName == "" {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "x-tenant-name header is required", struct{}{})
-		return c.JSON(http.StatusBadRequest, "x-tenant-name header is required")
+	tenant, ok := middleware.TenantFromContext(c)
+	if !ok {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Tenant is missing from request context", struct{}{})
+		return c.JSON(http.StatusBadRequest, "tenant is required")
 	}
 
-	queueName := tenantName
+	queueName := tenant.Name
 
-	if err := rabbitmq.ConsumeMessages(queueName); err != nil {
+	_, err := middleware.Broker(c).Consume(c.Request().Context(), tenant.ID, queueName, queueName, 0)
+	if errors.Is(err, broker.ErrConsumerExists) {
+		return c.JSON(http.StatusOK, "RabbitMQ consumer is already running")
+	}
+	if err != nil {
 		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to start RabbitMQ consumer", struct{ QueueName string }{QueueName: queueName})
 		return c.JSON(http.StatusInternalServerError, "Failed to start consumer")
 	}
 
-	return c.JSON(http.StatusOK, "RabbitMQ consumer started successfully and message published")
+	return c.JSON(http.StatusOK, "RabbitMQ consumer started successfully")
+}
+
+type startConsumerRequest struct {
+	Tag      string `json:"tag"`
+	Prefetch int    `json:"prefetch"`
+}
+
+func ListConsumersHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, middleware.Broker(c).Consumers(tenant.ID))
+}
+
+// StartConsumerHandler starts a consumer on the queue of the tenant. The tag
+// defaults to the tenant name, so that repeated requests without a tag do
+// not start duplicate consumers.
+func StartConsumerHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	var request startConsumerRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for consumer", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if request.Prefetch < 0 {
+		return c.JSON(http.StatusBadRequest, "prefetch must not be negative")
+	}
+	if request.Tag == "" {
+		request.Tag = tenant.Name
+	}
+
+	consumer, err := middleware.Broker(c).Consume(c.Request().Context(), tenant.ID, tenant.Name, request.Tag, request.Prefetch)
+	if errors.Is(err, broker.ErrConsumerExists) {
+		return c.JSON(http.StatusConflict, "Consumer already exists")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to start RabbitMQ consumer", struct {
+			QueueName string
+			Tag       string
+			Error     error
+		}{QueueName: tenant.Name, Tag: request.Tag, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, consumer)
+}
+
+func StopConsumerHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	if err := middleware.Broker(c).StopConsuming(c.Request().Context(), tenant.ID, c.Param("tag")); errors.Is(err, broker.ErrConsumerNotFound) {
+		return c.JSON(http.StatusNotFound, "Consumer not found")
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, "Consumer stopped successfully")
+}
+
+// QueueStatsHandler returns the number of ready messages in the queue of the
+// tenant and the number of its consumers across all instances.
+func QueueStatsHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	stats, err := middleware.Broker(c).QueueStats(c.Request().Context(), tenant.Name)
+	if broker.IsNotFound(err) {
+		return c.JSON(http.StatusNotFound, "Queue not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to get queue stats", struct {
+			QueueName string
+			Error     error
+		}{QueueName: tenant.Name, Error: err})
+		return c.JSON(publishErrorStatus(err), err.Error())
+	}
+
+	return c.JSON(http.StatusOK, stats)
 }
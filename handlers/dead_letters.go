@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"jatis_mobile_api/broker"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDeadLetterPageSize = 20
+	maxDeadLetterPageSize     = 100
+)
+
+type settleDeadLettersRequest struct {
+	MessageIDs []string `json:"message_ids"`
+	Limit      int      `json:"limit"`
+}
+
+// ListDeadLettersHandler returns messages from the dead-letter queue of the
+// tenant, oldest first, without removing them.
+func ListDeadLettersHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	limit := defaultDeadLetterPageSize
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxDeadLetterPageSize {
+			return c.JSON(http.StatusBadRequest, "limit must be between 1 and 100")
+		}
+	}
+
+	letters, err := middleware.Broker(c).DeadLetters(c.Request().Context(), tenant.Name, limit)
+	if err != nil {
+		return deadLetterError(c, logger, tenant.Name, err)
+	}
+	return c.JSON(http.StatusOK, letters)
+}
+
+// ReplayDeadLettersHandler publishes dead-lettered messages back to the
+// tenant queue.
+func ReplayDeadLettersHandler(c echo.Context) error {
+	return settleDeadLetters(c, "replayed", func(queueName string, request settleDeadLettersRequest) (int, error) {
+		return middleware.Broker(c).ReplayDeadLetters(c.Request().Context(), queueName, request.MessageIDs, request.Limit)
+	})
+}
+
+// DiscardDeadLettersHandler removes dead-lettered messages for good.
+func DiscardDeadLettersHandler(c echo.Context) error {
+	return settleDeadLetters(c, "discarded", func(queueName string, request settleDeadLettersRequest) (int, error) {
+		return middleware.Broker(c).DiscardDeadLetters(c.Request().Context(), queueName, request.MessageIDs, request.Limit)
+	})
+}
+
+// settleDeadLetters selects dead-lettered messages by ID or, without IDs, the
+// oldest limit messages, so that a request never acts on the whole queue by
+// accident.
+func settleDeadLetters(c echo.Context, action string, settle func(string, settleDeadLettersRequest) (int, error)) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	var request settleDeadLettersRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for dead letters", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if request.Limit < 0 || (len(request.MessageIDs) == 0 && request.Limit == 0) {
+		return c.JSON(http.StatusBadRequest, "message_ids or a positive limit is required")
+	}
+
+	count, err := settle(tenant.Name, request)
+	if err != nil {
+		return deadLetterError(c, logger, tenant.Name, err)
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Dead-lettered messages settled", struct {
+		QueueName string
+		Action    string
+		Count     int
+	}{QueueName: tenant.Name, Action: action, Count: count})
+	return c.JSON(http.StatusOK, map[string]int{action: count})
+}
+
+func deadLetterError(c echo.Context, logger *logrus.Logger, queueName string, err error) error {
+	if broker.IsNotFound(err) {
+		return c.JSON(http.StatusNotFound, "Dead-letter queue not found")
+	}
+	logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to access dead-letter queue", struct {
+		QueueName string
+		Error     error
+	}{QueueName: queueName, Error: err})
+	return c.JSON(publishErrorStatus(err), err.Error())
+}
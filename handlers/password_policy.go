@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+	"net/http"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type passwordPolicyRequest struct {
+	MinLength     int  `json:"min_length"`
+	CheckBreached bool `json:"check_breached"`
+	HistorySize   int  `json:"history_size"`
+}
+
+func GetPasswordPolicyHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	policy, err := tenantPasswordPolicy(middleware.TenantDataDB(c), tenant.ID)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve password policy", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+func UpdatePasswordPolicyHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	var request passwordPolicyRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for password policy", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if request.MinLength < 8 || request.HistorySize < 0 || request.HistorySize > 24 {
+		return c.JSON(http.StatusBadRequest, "min_length must be at least 8 and history_size between 0 and 24")
+	}
+
+	policy := models.PasswordPolicy{
+		TenantID:      tenant.ID,
+		MinLength:     request.MinLength,
+		CheckBreached: request.CheckBreached,
+		HistorySize:   request.HistorySize,
+	}
+	if err := models.UpsertPasswordPolicy(middleware.TenantDataDB(c), &policy); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to update password policy", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Password policy updated successfully", struct{ TenantID int }{TenantID: tenant.ID})
+	return c.JSON(http.StatusOK, policy)
+}
+
+// tenantPasswordPolicy returns the password policy of a tenant, falling back
+// to the configured defaults when the tenant has not set one.
+func tenantPasswordPolicy(db database.DBTX, tenantID int) (*models.PasswordPolicy, error) {
+	policy, err := models.GetPasswordPolicy(db, tenantID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		cfg := config.GetConfig()
+		return &models.PasswordPolicy{
+			TenantID:      tenantID,
+			MinLength:     cfg.PasswordMinLength,
+			CheckBreached: cfg.PasswordCheckBreached,
+			HistorySize:   cfg.PasswordHistorySize,
+		}, nil
+	}
+	return policy, err
+}
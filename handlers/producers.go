@@ -1,22 +1,26 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"jatis_mobile_api/broker"
 	"jatis_mobile_api/logs"
-	"jatis_mobile_api/rabbitmq"
+	"jatis_mobile_api/middleware"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+	"github.com/rabbitmq/amqp091-go"
 	"github.com/sirupsen/logrus"
 )
 
 func ProducerHandler(c echo.Context) error {
 	logger := c.Get("logger").(*logrus.Logger)
 
-	tenantName := c.Request().Header.Get("x-tenant-name")
-	if tenantName == "" {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "x-tenant-name header is required", struct{}{})
-		return c.JSON(http.StatusBadRequest, "x-tenant-name header is required")
+	tenant, ok := middleware.TenantFromContext(c)
+	if !ok {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Tenant is missing from request context", struct{}{})
+		return c.JSON(http.StatusBadRequest, "tenant is required")
 	}
 
 	var requestBody map[string]interface{}
@@ -31,17 +35,40 @@ func ProducerHandler(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, "Failed to process message")
 	}
 
-	queueName := tenantName
+	queueName := tenant.Name
 
-	if err := rabbitmq.PublishMessage("amq.direct", queueName, messageJSON); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to start RabbitMQ consumer", struct{ QueueName string }{QueueName: queueName})
-		return c.JSON(http.StatusInternalServerError, "Failed to start consumer")
+	message := broker.Message{ContentType: "application/json", MessageID: broker.NewMessageID(), Body: messageJSON}
+	if err := middleware.Broker(c).Publish(c.Request().Context(), "amq.direct", queueName, message); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to publish message", struct {
+			QueueName string
+			Error     error
+		}{QueueName: queueName, Error: err})
+		return c.JSON(publishErrorStatus(err), err.Error())
 	}
 
 	response := map[string]interface{}{
-		"tenant_name": tenantName,
+		"tenant_name": tenant.Name,
+		"message_id":  message.MessageID,
 		"message":     requestBody,
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
+
+// publishErrorStatus maps a Publish error to the status reported to
+// the producer, so that a message that never reached a queue is not mistaken
+// for a broker outage.
+func publishErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, broker.ErrUnroutable):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, broker.ErrPublishNacked):
+		return http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, amqp091.ErrClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"errors"
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type createRoleRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type assignRoleRequest struct {
+	Role string `json:"role"`
+}
+
+func ListRolesHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	roles, err := models.ListRoles(middleware.TenantDataDB(c), tenant.ID)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to list roles", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	for i := range roles {
+		if roles[i].TenantID == nil {
+			roles[i].Permissions = auth.BuiltinRoles[roles[i].Name]
+		}
+	}
+	return c.JSON(http.StatusOK, roles)
+}
+
+func CreateRoleHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	var request createRoleRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for role", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if request.Name == "" || len(request.Permissions) == 0 {
+		return c.JSON(http.StatusBadRequest, "name and permissions are required")
+	}
+	if auth.IsBuiltinRole(request.Name) {
+		return c.JSON(http.StatusConflict, "Role already exists")
+	}
+	for _, permission := range request.Permissions {
+		if !auth.IsTenantPermission(permission) {
+			return c.JSON(http.StatusBadRequest, "Permission "+permission+" cannot be granted by a tenant role")
+		}
+	}
+
+	role := models.Role{
+		TenantID:    &tenant.ID,
+		Name:        request.Name,
+		Permissions: request.Permissions,
+	}
+	if err := models.CreateRole(middleware.TenantDataDB(c), &role); err != nil {
+		if models.IsUniqueViolation(err) {
+			return c.JSON(http.StatusConflict, "Role already exists")
+		}
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to create role", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Role created successfully", struct {
+		TenantID int
+		RoleName string
+	}{TenantID: tenant.ID, RoleName: role.Name})
+	return c.JSON(http.StatusCreated, role)
+}
+
+func DeleteRoleHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	roleID, err := strconv.Atoi(c.Param("roleId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid role ID")
+	}
+
+	if err := models.DeleteRole(middleware.TenantDataDB(c), tenant.ID, roleID); errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "Role not found")
+	} else if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to delete role", struct {
+			TenantID int
+			RoleID   int
+			Error    error
+		}{TenantID: tenant.ID, RoleID: roleID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Role deleted successfully", struct {
+		TenantID int
+		RoleID   int
+	}{TenantID: tenant.ID, RoleID: roleID})
+	return c.JSON(http.StatusOK, "Role deleted successfully")
+}
+
+func ListUserRolesHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	user, err := loadPathUser(c, logger)
+	if user == nil {
+		return err
+	}
+
+	roles, err := models.GetUserRoles(middleware.TenantDataDB(c), user.ID)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to list user roles", struct {
+			UserID int
+			Error  error
+		}{UserID: user.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, roles)
+}
+
+func AssignUserRoleHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	user, err := loadPathUser(c, logger)
+	if user == nil {
+		return err
+	}
+
+	var request assignRoleRequest
+	if err := c.Bind(&request); err != nil || request.Role == "" {
+		return c.JSON(http.StatusBadRequest, "role is required")
+	}
+
+	if request.Role == auth.RolePlatformAdmin {
+		claims, ok := middleware.ClaimsFromContext(c)
+		if !ok || !auth.HasRole(claims.Roles, auth.RolePlatformAdmin) {
+			logs.LogWithFields(logger, logrus.WarnLevel, "Attempted to grant platform-admin without being one", struct{ UserID int }{UserID: user.ID})
+			return c.JSON(http.StatusForbidden, "Only platform admins can grant platform-admin")
+		}
+	}
+
+	db := middleware.TenantDataDB(c)
+
+	role, err := models.GetRoleByName(db, user.TenantID, request.Role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "Role not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve role", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := models.AssignRole(db, user.ID, role.ID); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to assign role", struct {
+			UserID int
+			RoleID int
+			Error  error
+		}{UserID: user.ID, RoleID: role.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Role assigned successfully", struct {
+		UserID   int
+		RoleName string
+	}{UserID: user.ID, RoleName: role.Name})
+	return c.JSON(http.StatusOK, role)
+}
+
+func UnassignUserRoleHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	user, err := loadPathUser(c, logger)
+	if user == nil {
+		return err
+	}
+
+	roleID, err := strconv.Atoi(c.Param("roleId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid role ID")
+	}
+
+	if err := models.UnassignRole(middleware.TenantDataDB(c), user.ID, roleID); errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "Role is not assigned to user")
+	} else if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to unassign role", struct {
+			UserID int
+			RoleID int
+			Error  error
+		}{UserID: user.ID, RoleID: roleID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Role unassigned successfully", struct {
+		UserID int
+		RoleID int
+	}{UserID: user.ID, RoleID: roleID})
+	return c.JSON(http.StatusOK, "Role unassigned successfully")
+}
+
+// loadPathUser resolves the active user named by the :userId route parameter
+// within the tenant named by :id, following the loadPathTenant conventions.
+func loadPathUser(c echo.Context, logger *logrus.Logger) (*models.User, error) {
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return nil, err
+	}
+
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	user, err := models.GetUserByID(middleware.TenantDataDB(c), tenant.ID, userID, false)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, c.JSON(http.StatusNotFound, "User not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve user", struct {
+			TenantID int
+			UserID   int
+		}{TenantID: tenant.ID, UserID: userID})
+		return nil, c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return user, nil
+}
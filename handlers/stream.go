@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"jatis_mobile_api/broker"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxStreamPrefetch = 100
+	// streamHeartbeat is how often an idle stream is written to, so that
+	// proxies keep it open and a gone client is noticed.
+	streamHeartbeat = 15 * time.Second
+	streamWriteWait = 10 * time.Second
+)
+
+// streamMessage is a message as written to a stream. A body that is not
+// JSON is written as a string.
+type streamMessage struct {
+	MessageID   string          `json:"message_id"`
+	Type        string          `json:"type"`
+	Redelivered bool            `json:"redelivered"`
+	Body        json.RawMessage `json:"body"`
+}
+
+func newStreamMessage(msg broker.Delivery) streamMessage {
+	body := json.RawMessage(msg.Body)
+	if !json.Valid(msg.Body) {
+		body, _ = json.Marshal(string(msg.Body))
+	}
+	return streamMessage{MessageID: msg.MessageID, Type: msg.Type, Redelivered: msg.Redelivered, Body: body}
+}
+
+var upgrader = websocket.Upgrader{}
+
+// StreamHandler streams the messages of the tenant queue to the client as
+// Server-Sent Events. The stream competes with the other consumers of the
+// queue; a message is acknowledged once it was written to the client, and
+// the consumer is stopped when the client disconnects.
+func StreamHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+	prefetch, err := checkStream(c, logger, tenant)
+	if prefetch == 0 {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	var mu sync.Mutex
+	write := func(frame string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := res.Write([]byte(frame)); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(streamHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := write(": keep-alive\n\n"); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err = stream(ctx, c, logger, tenant, prefetch, func(msg broker.Delivery) error {
+		data, err := json.Marshal(newStreamMessage(msg))
+		if err != nil {
+			return err
+		}
+		return write(fmt.Sprintf("id: %s\nevent: message\ndata: %s\n\n", msg.MessageID, data))
+	})
+	if err != nil {
+		write(fmt.Sprintf("event: error\ndata: %q\n\n", err.Error()))
+	}
+	return nil
+}
+
+// WebSocketHandler streams the messages of the tenant queue to the client
+// over a WebSocket, one JSON text message each, like StreamHandler. Messages
+// sent by the client are ignored.
+func WebSocketHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+	prefetch, err := checkStream(c, logger, tenant)
+	if prefetch == 0 {
+		return err
+	}
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader has written the error response.
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to upgrade to WebSocket", struct{ Error error }{Error: err})
+		return nil
+	}
+	defer conn.Close()
+
+	// The request context is not cancelled once the connection was hijacked,
+	// so a failed read is what tells that the client is gone.
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	conn.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	go func() {
+		ticker := time.NewTicker(streamHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				mu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait))
+				mu.Unlock()
+				if err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err = stream(ctx, c, logger, tenant, prefetch, func(msg broker.Delivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+		return conn.WriteJSON(newStreamMessage(msg))
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	closeCode, reason := websocket.CloseNormalClosure, ""
+	if err != nil {
+		closeCode, reason = websocket.CloseInternalServerErr, err.Error()
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason), time.Now().Add(streamWriteWait))
+	return nil
+}
+
+// checkStream validates the prefetch query parameter, which defaults to 1 so
+// that messages are written in order, and checks that the tenant queue
+// exists. It returns a zero prefetch when the response has already been
+// written.
+func checkStream(c echo.Context, logger *logrus.Logger, tenant *models.Tenant) (int, error) {
+	prefetch := 1
+	if value := c.QueryParam("prefetch"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxStreamPrefetch {
+			return 0, c.JSON(http.StatusBadRequest, fmt.Sprintf("prefetch must be between 1 and %d", maxStreamPrefetch))
+		}
+		prefetch = parsed
+	}
+
+	_, err := middleware.Broker(c).QueueStats(c.Request().Context(), tenant.Name)
+	if broker.IsNotFound(err) {
+		return 0, c.JSON(http.StatusNotFound, "Queue not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to inspect queue for stream", struct {
+			QueueName string
+			Error     error
+		}{QueueName: tenant.Name, Error: err})
+		return 0, c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return prefetch, nil
+}
+
+// stream consumes the tenant queue under a tag of its own until ctx is done,
+// write fails or the consumer is stopped. It returns the error that kept the
+// consumer from starting.
+func stream(ctx context.Context, c echo.Context, logger *logrus.Logger, tenant *models.Tenant, prefetch int, write func(broker.Delivery) error) error {
+	tag, err := streamTag()
+	if err != nil {
+		return err
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Stream opened", struct {
+		QueueName string
+		Tag       string
+	}{QueueName: tenant.Name, Tag: tag})
+
+	err = middleware.Broker(c).Stream(ctx, tenant.ID, tenant.Name, tag, prefetch, func(_ context.Context, msg broker.Delivery) error {
+		return write(msg)
+	})
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to stream queue", struct {
+			QueueName string
+			Tag       string
+			Error     error
+		}{QueueName: tenant.Name, Tag: tag, Error: err})
+		return err
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Stream closed", struct {
+		QueueName string
+		Tag       string
+	}{QueueName: tenant.Name, Tag: tag})
+	return nil
+}
+
+// streamTag returns a random consumer tag, so that the streams of a tenant
+// are listed and can be stopped like its other consumers.
+func streamTag() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "stream-" + hex.EncodeToString(b), nil
+}
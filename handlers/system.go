@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/rabbitmq"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthHandler reports whether the database can be reached. It is public so
+// that load balancers can call it without credentials.
+func HealthHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+	defer cancel()
+
+	if err := database.Ping(ctx); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Database health check failed", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func DatabaseStatsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, database.Stats())
+}
+
+// maxBrokerEvents is the number of RabbitMQ connection events kept for
+// BrokerEventsHandler.
+const maxBrokerEvents = 100
+
+type brokerEvent struct {
+	Type    rabbitmq.EventType `json:"type"`
+	Time    time.Time          `json:"time"`
+	Attempt int                `json:"attempt,omitempty"`
+	Delay   string             `json:"delay,omitempty"`
+	Queue   string             `json:"queue,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+var (
+	brokerEventsMu sync.Mutex
+	brokerEvents   = []brokerEvent{}
+)
+
+// RecordBrokerEvents keeps the most recent of the given RabbitMQ connection
+// events, as delivered by rabbitmq.Events, for BrokerEventsHandler until the
+// channel is closed.
+func RecordBrokerEvents(events <-chan rabbitmq.Event) {
+	go func() {
+		for event := range events {
+			recorded := brokerEvent{Type: event.Type, Time: event.Time, Attempt: event.Attempt, Queue: event.Queue}
+			if event.Delay > 0 {
+				recorded.Delay = event.Delay.String()
+			}
+			if event.Err != nil {
+				recorded.Error = event.Err.Error()
+			}
+
+			brokerEventsMu.Lock()
+			brokerEvents = append(brokerEvents, recorded)
+			if len(brokerEvents) > maxBrokerEvents {
+				brokerEvents = brokerEvents[len(brokerEvents)-maxBrokerEvents:]
+			}
+			brokerEventsMu.Unlock()
+		}
+	}()
+}
+
+// BrokerEventsHandler lists the recent RabbitMQ connection events of this
+// instance, newest first.
+func BrokerEventsHandler(c echo.Context) error {
+	brokerEventsMu.Lock()
+	events := make([]brokerEvent, 0, len(brokerEvents))
+	for i := len(brokerEvents) - 1; i >= 0; i-- {
+		events = append(events, brokerEvents[i])
+	}
+	brokerEventsMu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"events": events})
+}
@@ -2,80 +2,334 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/base64"
+	"errors"
+	"jatis_mobile_api/broker"
+	"jatis_mobile_api/config"
 	"jatis_mobile_api/database"
 	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/migrations"
 	"jatis_mobile_api/models"
-	"jatis_mobile_api/rabbitmq"
+	"jatis_mobile_api/provisioning"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	defaultTenantPageSize = 20
+	maxTenantPageSize     = 100
+)
+
+type createTenantRequest struct {
+	Name              string `json:"name"`
+	DedicatedDatabase bool   `json:"dedicated_database"`
+}
+
+// CreateTenantHandler provisions a tenant through the provisioning workflow.
+// A failed run is undone and returned along with the error, so that the
+// request can simply be retried.
 func CreateTenantHandler(c echo.Context) error {
 	logger := c.Get("logger").(*logrus.Logger)
-	var tenant models.Tenant
+	var request createTenantRequest
 
-	if err := c.Bind(&tenant); err != nil {
+	if err := c.Bind(&request); err != nil {
 		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for tenant", struct{ Error error }{Error: err})
 		return c.JSON(http.StatusBadRequest, err.Error())
 	}
-
-	db := database.GetDB()
-
-	var existingTenant models.Tenant
-	err := db.QueryRow(context.Background(), "SELECT id FROM tenants WHERE name = $1", tenant.Name).Scan(&existingTenant.ID)
-	if err == nil {
-		logs.LogWithFields(logger, logrus.WarnLevel, "Attempted to create tenant but it already exists", struct{ TenantName string }{TenantName: tenant.Name})
-		return c.JSON(http.StatusConflict, "Tenant already exists")
+	if request.Name == "" {
+		return c.JSON(http.StatusBadRequest, "name is required")
 	}
 
-	if err := models.CreateTenant(db, &tenant); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to create tenant", struct {
+	tenant, run, err := provisioning.ProvisionTenant(context.Background(), logger, middleware.Broker(c), request.Name, request.DedicatedDatabase)
+	switch {
+	case errors.Is(err, provisioning.ErrTenantExists):
+		logs.LogWithFields(logger, logrus.WarnLevel, "Attempted to create tenant but it already exists", struct{ TenantName string }{TenantName: request.Name})
+		return c.JSON(http.StatusConflict, "Tenant already exists")
+	case errors.Is(err, provisioning.ErrInProgress):
+		return c.JSON(http.StatusConflict, "Tenant provisioning is already in progress")
+	case err != nil:
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to provision tenant", struct {
 			TenantName string
 			Error      error
-		}{TenantName: tenant.Name, Error: err})
+		}{TenantName: request.Name, Error: err})
+		if run == nil {
+			return c.JSON(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "provisioning": run})
+	}
+
+	logger.WithField("tenant_name", tenant.Name).Info("Tenant created successfully")
+	return c.JSON(http.StatusCreated, tenant)
+}
+
+// GetTenantProvisioningHandler returns the latest provisioning run of a
+// tenant together with the status of each of its steps.
+func GetTenantProvisioningHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+	tenantIDStr := c.Param("id")
+
+	tenantID, err := strconv.Atoi(tenantIDStr)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant ID", struct{ TenantID string }{TenantID: tenantIDStr})
+		return c.JSON(http.StatusBadRequest, "Invalid tenant ID")
+	}
+
+	run, err := models.GetLatestProvisioningRun(database.SystemDB(), tenantID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "Provisioning run not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve provisioning run", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenantID, Error: err})
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
-	if err := rabbitmq.DeclareQueue(tenant.Name); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to queue tenant created to RabbitMQ", struct {
-			TenantName string
-			Error      error
-		}{TenantName: tenant.Name, Error: err})
+	return c.JSON(http.StatusOK, run)
+}
+
+type updateTenantRequest struct {
+	Name string `json:"name"`
+}
+
+// UpdateTenantHandler renames a tenant. The tenant name doubles as its queue
+// name and amq.direct routing key, so the new queue is fully set up, the
+// consumers of the old queue stopped and the old queue drained into it before
+// the row is updated. The consumers are then started again on the new queue;
+// streams end and have to be opened again. Any failure before the row is
+// updated rolls the topology back and restarts the consumers on the old queue;
+// failures cleaning up the old queue after the rename are only logged.
+func UpdateTenantHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+	tenantIDStr := c.Param("id")
+
+	tenantID, err := strconv.Atoi(tenantIDStr)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant ID", struct{ TenantID string }{TenantID: tenantIDStr})
+		return c.JSON(http.StatusBadRequest, "Invalid tenant ID")
+	}
+
+	var request updateTenantRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for tenant update", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if request.Name == "" {
+		return c.JSON(http.StatusBadRequest, "name is required")
+	}
+
+	db := database.SystemDB()
+
+	tenant, err := models.GetTenantByID(db, tenantID, false)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "Tenant not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve tenant", struct{ TenantID int }{TenantID: tenantID})
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
-	if err := rabbitmq.BindQueue(tenant.Name, "amq.direct", tenant.Name); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind queue tenant to RabbitMQ", struct {
-			TenantName string
-			Error      error
-		}{TenantName: tenant.Name, Error: err})
+	if tenant.Name == request.Name {
+		return c.JSON(http.StatusOK, tenant)
+	}
+
+	if _, err := models.GetTenantByName(db, request.Name, true); err == nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Attempted to rename tenant to an existing name", struct{ TenantName string }{TenantName: request.Name})
+		return c.JSON(http.StatusConflict, "Tenant already exists")
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to check tenant name", struct{ Error error }{Error: err})
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
-	successMessage := map[string]string{"message": "Tenant created successfully"}
-	successBody, err := json.Marshal(successMessage)
+	oldName := tenant.Name
+	ctx, b := c.Request().Context(), middleware.Broker(c)
+	// Rolling back or finishing the rename must not stop halfway when the
+	// client goes away.
+	cleanupCtx := context.WithoutCancel(ctx)
+	progress, stopped, err := switchTenantQueue(ctx, b, tenant.ID, oldName, request.Name)
 	if err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to marshal success message for RabbitMQ", struct {
-			TenantName string
-			Error      error
-		}{TenantName: tenant.Name, Error: err})
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to move tenant queue", struct {
+			OldName string
+			NewName string
+			Error   error
+		}{OldName: oldName, NewName: request.Name, Error: err})
+		rollbackTenantQueue(cleanupCtx, logger, b, oldName, request.Name, progress, stopped)
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
-	if err := rabbitmq.PublishMessage("amq.direct", tenant.Name, successBody); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to publish tenant created message to RabbitMQ", struct {
-			TenantName string
-			Error      error
-		}{TenantName: tenant.Name, Error: err})
+	if err := models.RenameTenant(db, tenant.ID, request.Name); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to rename tenant", struct {
+			OldName string
+			NewName string
+			Error   error
+		}{OldName: oldName, NewName: request.Name, Error: err})
+		rollbackTenantQueue(cleanupCtx, logger, b, oldName, request.Name, progress, stopped)
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
+	middleware.InvalidateTenant(tenant)
+	tenant.Name = request.Name
 
-	logger.WithField("tenant_name", tenant.Name).Info("Tenant created successfully")
-	return c.JSON(http.StatusCreated, tenant)
+	restartConsumers(cleanupCtx, logger, b, tenant.Name, stopped)
+	if err := b.UnbindQueue(cleanupCtx, tenant.Name, "amq.direct", oldName); err != nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to remove old routing key after rename", struct {
+			TenantName string
+			RoutingKey string
+		}{TenantName: tenant.Name, RoutingKey: oldName})
+	}
+	// Drain the old queue again, in case a message reached it after the
+	// first move, before deleting it.
+	if _, err := b.MoveMessages(cleanupCtx, oldName, tenant.Name); err != nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to drain old queue after rename", struct {
+			QueueName string
+			Error     error
+		}{QueueName: oldName, Error: err})
+	} else if _, err := b.DeleteQueue(cleanupCtx, oldName); err != nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to delete old queue after rename", struct{ QueueName string }{QueueName: oldName})
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant renamed successfully", struct {
+		OldName string
+		NewName string
+	}{OldName: oldName, NewName: tenant.Name})
+	return c.JSON(http.StatusOK, tenant)
+}
+
+const (
+	renameNothingDone = iota
+	renameQueueDeclared
+	renameQueueBound
+	renameOldQueueUnbound
+)
+
+// switchTenantQueue declares the queue for newName and moves traffic and
+// pending messages from the oldName queue into it. The old routing key stays
+// bound to the new queue so nothing published mid-rename is dropped. The
+// consumers of the old queue are stopped before its messages are moved, so
+// the messages they had not settled are requeued and moved along; they are
+// returned to be started again. It reports how far it got so a failure can be
+// rolled back precisely.
+func switchTenantQueue(ctx context.Context, b broker.Broker, tenantID int, oldName, newName string) (int, []broker.ConsumerInfo, error) {
+	if err := b.DeclareTenantQueue(ctx, newName); err != nil {
+		return renameNothingDone, nil, err
+	}
+	if err := b.BindQueue(ctx, newName, "amq.direct", newName); err != nil {
+		return renameQueueDeclared, nil, err
+	}
+	if err := b.BindQueue(ctx, newName, "amq.direct", oldName); err != nil {
+		return renameQueueDeclared, nil, err
+	}
+	if err := b.UnbindQueue(ctx, oldName, "amq.direct", oldName); err != nil {
+		return renameQueueBound, nil, err
+	}
+	stopped, err := stopConsumers(ctx, b, tenantID, oldName)
+	if err != nil {
+		return renameOldQueueUnbound, stopped, err
+	}
+	if _, err := b.MoveMessages(ctx, oldName, newName); err != nil {
+		return renameOldQueueUnbound, stopped, err
+	}
+	if err := moveDeadLetters(ctx, b, oldName, newName); err != nil {
+		return renameOldQueueUnbound, stopped, err
+	}
+	return renameOldQueueUnbound, stopped, nil
+}
+
+// stopConsumers stops the consumers of a tenant on one queue and returns the
+// ones stopped.
+func stopConsumers(ctx context.Context, b broker.Broker, tenantID int, queueName string) ([]broker.ConsumerInfo, error) {
+	var stopped []broker.ConsumerInfo
+	for _, consumer := range b.Consumers(tenantID) {
+		if consumer.Queue != queueName {
+			continue
+		}
+		err := b.StopConsuming(ctx, tenantID, consumer.Tag)
+		if errors.Is(err, broker.ErrConsumerNotFound) {
+			// It stopped on its own in the meantime.
+			continue
+		}
+		if err != nil {
+			return stopped, err
+		}
+		stopped = append(stopped, consumer)
+	}
+	return stopped, nil
+}
+
+// restartConsumers starts the stopped consumers again on the given queue,
+// except for streams, which end when stopped.
+func restartConsumers(ctx context.Context, logger *logrus.Logger, b broker.Broker, queueName string, stopped []broker.ConsumerInfo) {
+	for _, consumer := range stopped {
+		if consumer.Stream {
+			continue
+		}
+		if _, err := b.Consume(ctx, consumer.TenantID, queueName, consumer.Tag, consumer.Prefetch); err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to restart consumer after tenant rename", struct {
+				QueueName string
+				Tag       string
+				Error     error
+			}{QueueName: queueName, Tag: consumer.Tag, Error: err})
+		}
+	}
+}
+
+// moveDeadLetters moves the dead-lettered messages of one tenant queue to the
+// dead-letter queue of another. A tenant queue declared before dead-lettering
+// was introduced has no dead-letter queue; nothing is moved for it.
+func moveDeadLetters(ctx context.Context, b broker.Broker, oldName, newName string) error {
+	_, err := b.MoveMessages(ctx, broker.DeadLetterQueue(oldName), broker.DeadLetterQueue(newName))
+	if broker.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// rollbackTenantQueue undoes switchTenantQueue up to the given progress and
+// starts the consumers it stopped again on the old queue. The new queue is
+// only deleted once its messages are back in the old queue.
+func rollbackTenantQueue(ctx context.Context, logger *logrus.Logger, b broker.Broker, oldName, newName string, progress int, stopped []broker.ConsumerInfo) {
+	logFailure := func(step string, err error) {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Tenant rename rollback step failed", struct {
+			Step    string
+			OldName string
+			NewName string
+			Error   error
+		}{Step: step, OldName: oldName, NewName: newName, Error: err})
+	}
+
+	// The consumers go back to the old queue whatever else fails below.
+	defer restartConsumers(ctx, logger, b, oldName, stopped)
+
+	if progress >= renameOldQueueUnbound {
+		if err := b.BindQueue(ctx, oldName, "amq.direct", oldName); err != nil {
+			logFailure("rebind old queue", err)
+			return
+		}
+	}
+	if progress >= renameQueueBound {
+		if err := b.UnbindQueue(ctx, newName, "amq.direct", oldName); err != nil {
+			logFailure("unbind old routing key from new queue", err)
+		}
+		if _, err := b.MoveMessages(ctx, newName, oldName); err != nil {
+			logFailure("move messages back", err)
+			return
+		}
+		if err := moveDeadLetters(ctx, b, newName, oldName); err != nil {
+			logFailure("move dead-lettered messages back", err)
+			return
+		}
+	}
+	if progress >= renameQueueDeclared {
+		if _, err := b.DeleteQueue(ctx, newName); err != nil {
+			logFailure("delete new queue", err)
+		}
+	}
 }
 
 func DeleteTenantHandler(c echo.Context) error {
@@ -88,7 +342,11 @@ func DeleteTenantHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, "Invalid tenant ID")
 	}
 
-	db := database.GetDB()
+	if purge, _ := strconv.ParseBool(c.QueryParam("purge")); purge {
+		return purgeTenant(c, logger, tenantID)
+	}
+
+	db := database.SystemDB()
 
 	var tenant models.Tenant
 	err = db.QueryRow(context.Background(), "SELECT id, name FROM tenants WHERE id = $1", tenantID).Scan(&tenant.ID, &tenant.Name)
@@ -101,27 +359,245 @@ func DeleteTenantHandler(c echo.Context) error {
 		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to soft delete tenant", struct{ TenantName string }{TenantName: tenant.Name})
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
+	middleware.InvalidateTenant(&tenant)
 
-	channel, err := rabbitmq.GetChannel()
+	queueName := tenant.Name
+
+	if _, err := middleware.Broker(c).DeleteQueue(c.Request().Context(), queueName); err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant deleted successfully", struct{ TenantName string }{TenantName: tenant.Name})
+	return c.JSON(http.StatusOK, "Tenant deleted successfully")
+}
+
+func ListTenantsHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	filter := models.TenantFilter{
+		NamePrefix: c.QueryParam("name_prefix"),
+		Limit:      defaultTenantPageSize,
+	}
+
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxTenantPageSize {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant page size", struct{ Limit string }{Limit: limitStr})
+			return c.JSON(http.StatusBadRequest, "limit must be between 1 and 100")
+		}
+		filter.Limit = limit
+	}
+
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		afterID, err := decodeCursor(cursor)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant cursor", struct{ Cursor string }{Cursor: cursor})
+			return c.JSON(http.StatusBadRequest, "Invalid cursor")
+		}
+		filter.AfterID = afterID
+	}
+
+	for param, target := range map[string]**time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		value := c.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant date filter", struct {
+				Param string
+				Value string
+			}{Param: param, Value: value})
+			return c.JSON(http.StatusBadRequest, param+" must be an RFC3339 timestamp")
+		}
+		*target = &parsed
+	}
+
+	if includeDeleted := c.QueryParam("include_deleted"); includeDeleted != "" {
+		include, err := strconv.ParseBool(includeDeleted)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid include_deleted value", struct{ IncludeDeleted string }{IncludeDeleted: includeDeleted})
+			return c.JSON(http.StatusBadRequest, "include_deleted must be a boolean")
+		}
+		filter.IncludeDeleted = include
+	}
+
+	tenants, hasMore, err := models.ListTenants(database.SystemDB(), filter)
 	if err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to get RabbitMQ channel", struct{ TenantName string }{TenantName: tenant.Name})
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to list tenants", struct{ Error error }{Error: err})
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
-	defer channel.Close()
 
-	queueName := tenant.Name
+	response := map[string]interface{}{
+		"tenants":     tenants,
+		"next_cursor": nil,
+	}
+	if hasMore {
+		response["next_cursor"] = encodeCursor(tenants[len(tenants)-1].ID)
+	}
 
-	messageCount, err := channel.QueueDelete(queueName, false, false, false)
+	return c.JSON(http.StatusOK, response)
+}
+
+func GetTenantHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+	tenantIDStr := c.Param("id")
+
+	tenantID, err := strconv.Atoi(tenantIDStr)
 	if err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to delete queue", struct{ QueueName string }{QueueName: queueName})
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant ID", struct{ TenantID string }{TenantID: tenantIDStr})
+		return c.JSON(http.StatusBadRequest, "Invalid tenant ID")
+	}
+
+	includeDeleted, _ := strconv.ParseBool(c.QueryParam("include_deleted"))
+	tenant, err := models.GetTenantByID(database.SystemDB(), tenantID, includeDeleted)
+	return respondWithTenant(c, logger, tenant, err)
+}
+
+func GetTenantByNameHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+	tenantName := c.Param("name")
+
+	includeDeleted, _ := strconv.ParseBool(c.QueryParam("include_deleted"))
+	tenant, err := models.GetTenantByName(database.SystemDB(), tenantName, includeDeleted)
+	return respondWithTenant(c, logger, tenant, err)
+}
+
+func respondWithTenant(c echo.Context, logger *logrus.Logger, tenant *models.Tenant, err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Tenant not found", struct{ Path string }{Path: c.Request().URL.Path})
+		return c.JSON(http.StatusNotFound, "Tenant not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve tenant", struct{ Error error }{Error: err})
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
+	return c.JSON(http.StatusOK, tenant)
+}
 
-	logs.LogWithFields(logger, logrus.InfoLevel, "Queue deleted successfully", struct {
-		QueueName    string
-		MessageCount int
-	}{QueueName: queueName, MessageCount: messageCount})
+func encodeCursor(lastID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(lastID)))
+}
 
-	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant deleted successfully", struct{ TenantName string }{TenantName: tenant.Name})
-	return c.JSON(http.StatusOK, "Tenant deleted successfully")
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	lastID, err := strconv.Atoi(string(raw))
+	if err != nil || lastID < 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return lastID, nil
+}
+
+// purgeTenant physically removes a tenant that has been soft-deleted for at
+// least the configured retention window, freeing its name for reuse.
+func purgeTenant(c echo.Context, logger *logrus.Logger, tenantID int) error {
+	db := database.SystemDB()
+
+	tenant, err := models.GetTenantByID(db, tenantID, true)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "Tenant not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve tenant", struct{ TenantID int }{TenantID: tenantID})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if tenant.DeletedAt == nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Attempted to purge a tenant that is not deleted", struct{ TenantName string }{TenantName: tenant.Name})
+		return c.JSON(http.StatusConflict, "Tenant must be deleted before it can be purged")
+	}
+
+	purgeAfter := tenant.DeletedAt.Add(config.GetConfig().TenantPurgeRetention)
+	if time.Now().Before(purgeAfter) {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Attempted to purge a tenant inside its retention window", struct {
+			TenantName string
+			PurgeAfter time.Time
+		}{TenantName: tenant.Name, PurgeAfter: purgeAfter})
+		return c.JSON(http.StatusConflict, map[string]interface{}{
+			"message":     "Tenant is still inside its retention window",
+			"purge_after": purgeAfter,
+		})
+	}
+
+	if _, err := middleware.Broker(c).DeleteQueue(c.Request().Context(), tenant.Name); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to delete queue for purged tenant", struct{ TenantName string }{TenantName: tenant.Name})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	archive := config.GetConfig().TenantSchemaOnPurge == "archive"
+	if err := migrations.RemoveTenantStorage(context.Background(), database.SystemDB(), logger, tenant, archive); err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := models.PurgeTenant(db, tenant.ID); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to purge tenant", struct {
+			TenantName string
+			Error      error
+		}{TenantName: tenant.Name, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant purged successfully", struct{ TenantName string }{TenantName: tenant.Name})
+	return c.JSON(http.StatusOK, "Tenant purged successfully")
+}
+
+func RestoreTenantHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+	tenantIDStr := c.Param("id")
+
+	tenantID, err := strconv.Atoi(tenantIDStr)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant ID", struct{ TenantID string }{TenantID: tenantIDStr})
+		return c.JSON(http.StatusBadRequest, "Invalid tenant ID")
+	}
+
+	db := database.SystemDB()
+
+	tenant, err := models.GetTenantByID(db, tenantID, true)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "Tenant not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve tenant", struct{ TenantID int }{TenantID: tenantID})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if tenant.DeletedAt == nil {
+		return c.JSON(http.StatusConflict, "Tenant is not deleted")
+	}
+
+	b := middleware.Broker(c)
+	if err := b.DeclareTenantQueue(c.Request().Context(), tenant.Name); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to redeclare queue for restored tenant", struct {
+			TenantName string
+			Error      error
+		}{TenantName: tenant.Name, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := b.BindQueue(c.Request().Context(), tenant.Name, "amq.direct", tenant.Name); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to rebind queue for restored tenant", struct {
+			TenantName string
+			Error      error
+		}{TenantName: tenant.Name, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := models.RestoreTenant(db, tenant.ID); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to restore tenant", struct {
+			TenantName string
+			Error      error
+		}{TenantName: tenant.Name, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	tenant.DeletedAt = nil
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant restored successfully", struct{ TenantName string }{TenantName: tenant.Name})
+	return c.JSON(http.StatusOK, tenant)
 }
@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"errors"
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUserPageSize = 20
+	maxUserPageSize     = 100
+)
+
+type createUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type updateUserRequest struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+	Password *string `json:"password"`
+}
+
+func CreateUserHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	var request createUserRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for user", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	if request.Username == "" || request.Email == "" || request.Password == "" {
+		return c.JSON(http.StatusBadRequest, "username, email and password are required")
+	}
+
+	db := middleware.TenantDataDB(c)
+
+	policy, err := tenantPasswordPolicy(db, tenant.ID)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve password policy", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to create user")
+	}
+	if err := auth.ValidatePassword(*policy, request.Password, nil); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	passwordHash, err := auth.HashPassword(request.Password)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to hash password", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to create user")
+	}
+
+	user := models.User{
+		TenantID:     tenant.ID,
+		Username:     request.Username,
+		Email:        request.Email,
+		PasswordHash: passwordHash,
+	}
+	// The user is only created together with its default role and first
+	// password history entry.
+	err = database.InTx(c.Request().Context(), db, func(tx pgx.Tx) error {
+		if err := models.CreateUser(tx, &user); err != nil {
+			return err
+		}
+		if err := models.AddPasswordHistory(tx, user.ID, user.PasswordHash, policy.HistorySize); err != nil {
+			return err
+		}
+		role, err := models.GetRoleByName(tx, tenant.ID, auth.RoleTenantMember)
+		if err != nil {
+			return err
+		}
+		return models.AssignRole(tx, user.ID, role.ID)
+	})
+	if models.IsUniqueViolation(err) {
+		return c.JSON(http.StatusConflict, "User with this email already exists")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to create user", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to create user")
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "User created successfully", struct {
+		TenantID int
+		UserID   int
+	}{TenantID: tenant.ID, UserID: user.ID})
+	return c.JSON(http.StatusCreated, user)
+}
+
+func ListUsersHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	filter := models.UserFilter{Limit: defaultUserPageSize}
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxUserPageSize {
+			return c.JSON(http.StatusBadRequest, "limit must be between 1 and 100")
+		}
+		filter.Limit = limit
+	}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		afterID, err := decodeCursor(cursor)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "Invalid cursor")
+		}
+		filter.AfterID = afterID
+	}
+	filter.IncludeDeleted, _ = strconv.ParseBool(c.QueryParam("include_deleted"))
+
+	users, hasMore, err := models.ListUsers(middleware.TenantDataDB(c), tenant.ID, filter)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to list users", struct {
+			TenantID int
+			Error    error
+		}{TenantID: tenant.ID, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	response := map[string]interface{}{
+		"users":       users,
+		"next_cursor": nil,
+	}
+	if hasMore {
+		response["next_cursor"] = encodeCursor(users[len(users)-1].ID)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func GetUserHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	includeDeleted, _ := strconv.ParseBool(c.QueryParam("include_deleted"))
+	user, err := models.GetUserByID(middleware.TenantDataDB(c), tenant.ID, userID, includeDeleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "User not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve user", struct {
+			TenantID int
+			UserID   int
+		}{TenantID: tenant.ID, UserID: userID})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func UpdateUserHandler(c echo.Context) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	var request updateUserRequest
+	if err := c.Bind(&request); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind request for user update", struct{ Error error }{Error: err})
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	db := middleware.TenantDataDB(c)
+
+	user, err := models.GetUserByID(db, tenant.ID, userID, false)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "User not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve user", struct {
+			TenantID int
+			UserID   int
+		}{TenantID: tenant.ID, UserID: userID})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if request.Username != nil {
+		user.Username = *request.Username
+	}
+	if request.Email != nil {
+		user.Email = *request.Email
+	}
+	var policy *models.PasswordPolicy
+	if request.Password != nil {
+		policy, err = tenantPasswordPolicy(db, tenant.ID)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve password policy", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to update user")
+		}
+
+		history, err := models.GetPasswordHistory(db, user.ID, policy.HistorySize)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve password history", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to update user")
+		}
+		if err := auth.ValidatePassword(*policy, *request.Password, history); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		user.PasswordHash, err = auth.HashPassword(*request.Password)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to hash password", struct{ Error error }{Error: err})
+			return c.JSON(http.StatusInternalServerError, "Failed to update user")
+		}
+	}
+	if user.Username == "" || user.Email == "" {
+		return c.JSON(http.StatusBadRequest, "username and email cannot be empty")
+	}
+
+	// A new password is only stored together with its password history
+	// entry, so that it cannot be reused once it is changed again.
+	err = database.InTx(c.Request().Context(), db, func(tx pgx.Tx) error {
+		if err := models.UpdateUser(tx, user); err != nil {
+			return err
+		}
+		if policy == nil {
+			return nil
+		}
+		return models.AddPasswordHistory(tx, user.ID, user.PasswordHash, policy.HistorySize)
+	})
+	if models.IsUniqueViolation(err) {
+		return c.JSON(http.StatusConflict, "User with this email already exists")
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "User not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to update user", struct {
+			TenantID int
+			UserID   int
+			Error    error
+		}{TenantID: tenant.ID, UserID: userID, Error: err})
+		return c.JSON(http.StatusInternalServerError, "Failed to update user")
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "User updated successfully", struct {
+		TenantID int
+		UserID   int
+	}{TenantID: tenant.ID, UserID: user.ID})
+	return c.JSON(http.StatusOK, user)
+}
+
+func DeleteUserHandler(c echo.Context) error {
+	return changeUserDeletion(c, models.SoftDeleteUser, "deleted")
+}
+
+func RestoreUserHandler(c echo.Context) error {
+	return changeUserDeletion(c, models.RestoreUser, "restored")
+}
+
+func changeUserDeletion(c echo.Context, change func(database.DBTX, int, int) error, action string) error {
+	logger := c.Get("logger").(*logrus.Logger)
+
+	tenant, err := loadPathTenant(c, logger)
+	if tenant == nil {
+		return err
+	}
+
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	db := middleware.TenantDataDB(c)
+
+	if err := change(db, tenant.ID, userID); errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, "User not found or already "+action)
+	} else if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to change user deletion state", struct {
+			TenantID int
+			UserID   int
+			Action   string
+			Error    error
+		}{TenantID: tenant.ID, UserID: userID, Action: action, Error: err})
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	if action == "deleted" {
+		if err := models.RevokeUserRefreshTokens(db, userID); err != nil {
+			logs.LogWithFields(logger, logrus.WarnLevel, "Failed to revoke refresh tokens of deleted user", struct{ UserID int }{UserID: userID})
+		}
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "User "+action+" successfully", struct {
+		TenantID int
+		UserID   int
+	}{TenantID: tenant.ID, UserID: userID})
+	return c.JSON(http.StatusOK, "User "+action+" successfully")
+}
+
+// loadPathTenant resolves the active tenant named by the :id route parameter.
+// When it returns a nil tenant the error response has already been written and
+// the returned error must be returned by the handler as is.
+func loadPathTenant(c echo.Context, logger *logrus.Logger) (*models.Tenant, error) {
+	tenantIDStr := c.Param("id")
+
+	tenantID, err := strconv.Atoi(tenantIDStr)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant ID", struct{ TenantID string }{TenantID: tenantIDStr})
+		return nil, c.JSON(http.StatusBadRequest, "Invalid tenant ID")
+	}
+
+	var tenant *models.Tenant
+	lookup := func(db database.DBTX) error {
+		tenant, err = models.GetTenantByID(db, tenantID, false)
+		return err
+	}
+	if db, ok := c.Get(middleware.DBContextKey).(database.DBTX); ok {
+		err = lookup(db)
+	} else {
+		// Streams hold no TenantDB connection for as long as they run, so
+		// the tenant is looked up on one held just for the query.
+		err = database.WithTenantConn(c.Request().Context(), tenantID, lookup)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, c.JSON(http.StatusNotFound, "Tenant not found")
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to retrieve tenant", struct{ TenantID int }{TenantID: tenantID})
+		return nil, c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return tenant, nil
+}
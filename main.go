@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/broker"
 	"jatis_mobile_api/config"
 	"jatis_mobile_api/database"
+	"jatis_mobile_api/handlers"
 	"jatis_mobile_api/logs"
 	"jatis_mobile_api/middleware"
 	"jatis_mobile_api/migrations"
+	"jatis_mobile_api/models"
+	"jatis_mobile_api/provisioning"
 	"jatis_mobile_api/rabbitmq"
 	"jatis_mobile_api/routes"
-	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
@@ -26,66 +33,242 @@ func main() {
 	}
 
 	logger.Info("Connecting to database...")
-	if err := database.ConnectDB(cfg.PostgresURL); err != nil {
+	if err := database.ConnectDB(cfg.PostgresURL, database.PoolSettings{
+		MinConns:          cfg.PostgresMinConns,
+		MaxConns:          cfg.PostgresMaxConns,
+		MaxConnLifetime:   cfg.PostgresMaxConnLifetime,
+		MaxConnIdleTime:   cfg.PostgresMaxConnIdleTime,
+		HealthCheckPeriod: cfg.PostgresHealthCheckPeriod,
+	}); err != nil {
 		logs.LogWithFields(logger, logrus.ErrorLevel, "Could not connect to database", struct {
 			PostgresURL string
 			Error       error
 		}{PostgresURL: cfg.PostgresURL, Error: err})
 		return
 	}
+	defer database.Close()
 
-	logger.Info("Running migrations...")
-	db := database.GetDB()
+	if err := database.SetIsolation(cfg.TenantIsolation); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant isolation configuration", struct{ Error error }{Error: err})
+		return
+	}
+	database.ConfigureRouter(database.RouterSettings{
+		MaxConnsPerTenant: cfg.TenantPoolMaxConns,
+		MaxOpenPools:      cfg.TenantPoolMaxOpen,
+		IdleTimeout:       cfg.TenantPoolIdleTimeout,
+	})
 
-	if err := migrations.CreateTenantsTable(db, logger); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to create tenants table", struct{ Error error }{Error: err})
+	if err := auth.SetupSecrets(cfg); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid secrets configuration", struct{ Error error }{Error: err})
+		return
+	}
+	if database.Isolation() == database.IsolationDatabase && cfg.SecretsKey == "" {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "SecretsKey is required to store tenant database connection strings", struct{}{})
 		return
 	}
 
-	logger.Info("Connecting to RabbitMQ...")
-	if err := rabbitmq.ConnectRabbitMQ(cfg.RabbitMQURL); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Could not connect to RabbitMQ", struct {
-			RabbitMQURL string
-			Error       error
-		}{RabbitMQURL: cfg.RabbitMQURL, Error: err})
+	if cfg.MigrateOnStartup {
+		logger.Info("Running migrations...")
+		migrator, err := migrations.NewMigrator(database.SystemDB(), logger)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to load migrations", struct{ Error error }{Error: err})
+			return
+		}
+		if err := migrator.Up(context.Background(), 0); err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to run migrations", struct{ Error error }{Error: err})
+			return
+		}
+		if database.Isolation() == database.IsolationSchema {
+			if err := migrations.MigrateTenantSchemas(context.Background(), database.SystemDB(), logger); err != nil {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to run tenant migrations", struct{ Error error }{Error: err})
+				return
+			}
+		}
+		if err := migrations.MigrateTenantDatabases(context.Background(), database.SystemDB(), logger); err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to run tenant database migrations", struct{ Error error }{Error: err})
+			return
+		}
+	}
+
+	// Messages without a handler of their own are logged and acknowledged.
+	rabbitmq.RegisterHandler(rabbitmq.AnyTenant, rabbitmq.AnyType, rabbitmq.LogHandler)
+
+	messageBroker, outboxPublish, err := setupBroker(cfg)
+	if err != nil {
+		return
+	}
+
+	rabbitmq.StartOutboxRelay(context.Background(), rabbitmq.OutboxSettings{
+		PollInterval:  cfg.OutboxPollInterval,
+		BatchSize:     cfg.OutboxBatchSize,
+		RetryDelay:    cfg.OutboxRetryDelay,
+		MaxRetryDelay: cfg.OutboxMaxRetryDelay,
+		Retention:     cfg.OutboxRetention,
+		Publish:       outboxPublish,
+	})
+
+	// Finish or undo tenants whose provisioning was interrupted by a restart.
+	go provisioning.ResumeRunning(context.Background(), logger, messageBroker)
+
+	if err := auth.SetupPasswords(cfg); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid password configuration", struct{ Error error }{Error: err})
 		return
 	}
 
-	go monitorRabbitMQConnection(cfg.RabbitMQURL)
+	if err := bootstrapPlatformAdmin(cfg, messageBroker); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bootstrap platform admin", struct{ Error error }{Error: err})
+		return
+	}
+
+	tokens, err := auth.NewTokenManager(cfg)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid JWT configuration", struct{ Error error }{Error: err})
+		return
+	}
+
+	tenantResolver, err := middleware.TenantResolverFromConfig(cfg)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid tenant resolver configuration", struct{ Error error }{Error: err})
+		return
+	}
 
 	e := echo.New()
 	e.Use(middleware.LoggerMiddleware)
+	e.Use(middleware.WithBroker(messageBroker))
 	e.Use(middleware.PerformanceLogger(logger))
-	routes.RegisterTenantRoutes(e)
+	e.Use(middleware.Authenticate(tokens, routes.PublicPaths...))
+	routes.RegisterAuthRoutes(e, tokens)
+	routes.RegisterTenantRoutes(e, tenantResolver)
+	routes.RegisterUserRoutes(e)
+	routes.RegisterRoleRoutes(e)
+	routes.RegisterAPIKeyRoutes(e)
+	routes.RegisterSystemRoutes(e)
 
 	address := fmt.Sprintf(":%d", cfg.PORT)
 	logs.LogWithFields(logger, logrus.InfoLevel, "Starting server", struct{ Port int }{Port: cfg.PORT})
 	e.Logger.Fatal(e.Start(address))
 }
 
-func monitorRabbitMQConnection(url string) {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+// setupBroker connects to the message broker selected by MessageBroker. With
+// the Postgres broker, it also returns the function the outbox relay
+// publishes with.
+func setupBroker(cfg config.Config) (broker.Broker, func(context.Context, pgx.Tx, models.OutboxMessage) error, error) {
+	queues := rabbitmq.QueueSettings{
+		DeliveryLimit: cfg.RabbitMQDeliveryLimit,
+		RetryDelays:   cfg.RabbitMQRetryDelays,
+	}
+
+	switch cfg.MessageBroker {
+	case "", "rabbitmq":
+		rabbitmq.ConfigureChannels(rabbitmq.ChannelSettings{
+			PublisherChannels:  cfg.RabbitMQPublisherChannels,
+			ManagementChannels: cfg.RabbitMQManagementChannels,
+			ConsumerPrefetch:   cfg.RabbitMQConsumerPrefetch,
+		})
+		rabbitmq.ConfigureQueues(queues)
+		rabbitmq.ConfigureReconnect(rabbitmq.ReconnectSettings{
+			InitialDelay: cfg.RabbitMQReconnectDelay,
+			MaxDelay:     cfg.RabbitMQMaxReconnectDelay,
+		})
+
+		// Subscribed for the lifetime of the process, before connecting so
+		// that no event is missed.
+		events, _ := rabbitmq.Events(16)
+		handlers.RecordBrokerEvents(events)
+
+		logger.Info("Connecting to RabbitMQ...")
+		if err := rabbitmq.ConnectRabbitMQ(cfg.RabbitMQURL); err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Could not connect to RabbitMQ", struct {
+				RabbitMQURL string
+				Error       error
+			}{RabbitMQURL: cfg.RabbitMQURL, Error: err})
+			return nil, nil, err
+		}
+		return broker.NewAMQP(), nil, nil
+
+	case "postgres":
+		logger.Info("Using Postgres as message broker...")
+		b := broker.NewPostgres(database.GetDB(), queues, broker.PostgresSettings{
+			PollInterval: cfg.PostgresQueuePollInterval,
+			LockTimeout:  cfg.PostgresQueueLockTimeout,
+		})
+		return b, b.PublishOutboxMessage, nil
+
+	default:
+		err := fmt.Errorf("unknown message broker %q", cfg.MessageBroker)
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Invalid message broker configuration", struct{ Error error }{Error: err})
+		return nil, nil, err
+	}
+}
+
+// bootstrapPlatformAdmin creates the configured bootstrap tenant and platform
+// admin user if they do not exist yet, so that a fresh installation has
+// someone who can log in and create tenants.
+func bootstrapPlatformAdmin(cfg config.Config, messageBroker broker.Broker) error {
+	if cfg.BootstrapAdminEmail == "" {
+		return nil
+	}
 
-	isActive := false
+	db := database.SystemDB()
 
-	for range ticker.C {
-		if rabbitmq.IsClosed() {
-			if isActive {
-				logs.LogWithFields(logger, logrus.ErrorLevel, "RabbitMQ connection is closed!", struct{}{})
-				isActive = false
-			}
-			if err := rabbitmq.ConnectRabbitMQ(url); err != nil {
-				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to reconnect to RabbitMQ", struct{ RabbitMQURL string }{RabbitMQURL: url})
-			} else {
-				logs.LogWithFields(logger, logrus.InfoLevel, "Reconnected to RabbitMQ successfully", struct{}{})
-				isActive = true
-			}
-		} else {
-			if !isActive {
-				logs.LogWithFields(logger, logrus.InfoLevel, "RabbitMQ connection is active", struct{}{})
-				isActive = true
-			}
+	tenant, err := models.GetTenantByName(db, cfg.BootstrapTenant, true)
+	if errors.Is(err, pgx.ErrNoRows) {
+		tenant = &models.Tenant{Name: cfg.BootstrapTenant}
+		if err := models.CreateTenant(db, tenant); err != nil {
+			return err
+		}
+		if err := migrations.SetupTenantStorage(context.Background(), db, logger, tenant, false); err != nil {
+			return err
+		}
+		if err := messageBroker.DeclareTenantQueue(context.Background(), tenant.Name); err != nil {
+			return err
 		}
+		if err := messageBroker.BindQueue(context.Background(), tenant.Name, "amq.direct", tenant.Name); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	data, release, err := middleware.AcquireTenantData(context.Background(), tenant.ID)
+	if err != nil {
+		return err
 	}
+	defer release()
+
+	if _, err := models.GetUserByEmail(data, tenant.ID, cfg.BootstrapAdminEmail); err == nil {
+		return nil
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	passwordHash, err := auth.HashPassword(cfg.BootstrapAdminPassword)
+	if err != nil {
+		return err
+	}
+	user := models.User{
+		TenantID:     tenant.ID,
+		Username:     "admin",
+		Email:        cfg.BootstrapAdminEmail,
+		PasswordHash: passwordHash,
+	}
+	err = database.InTx(context.Background(), data, func(tx pgx.Tx) error {
+		if err := models.CreateUser(tx, &user); err != nil {
+			return err
+		}
+		role, err := models.GetRoleByName(tx, tenant.ID, auth.RolePlatformAdmin)
+		if err != nil {
+			return err
+		}
+		return models.AssignRole(tx, user.ID, role.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Bootstrap platform admin created", struct {
+		TenantName string
+		Email      string
+	}{TenantName: tenant.Name, Email: user.Email})
+	return nil
 }
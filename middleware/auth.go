@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ClaimsContextKey = "claims"
+	APIKeyHeader     = "x-api-key"
+)
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// Authenticate requires either a valid bearer access token or a valid API key
+// in the x-api-key header on every route except the given public route paths.
+func Authenticate(tokens *auth.TokenManager, publicPaths ...string) echo.MiddlewareFunc {
+	public := make(map[string]bool, len(publicPaths))
+	for _, path := range publicPaths {
+		public[path] = true
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if public[c.Path()] {
+				return next(c)
+			}
+
+			logger := c.Get("logger").(*logrus.Logger)
+
+			var (
+				claims *auth.Claims
+				err    error
+			)
+			if apiKey := c.Request().Header.Get(APIKeyHeader); apiKey != "" {
+				claims, err = authenticateAPIKey(logger, apiKey)
+			} else {
+				header := c.Request().Header.Get(echo.HeaderAuthorization)
+				tokenString, found := strings.CutPrefix(header, "Bearer ")
+				if !found || tokenString == "" {
+					logs.LogWithFields(logger, logrus.WarnLevel, "Missing credentials", struct{ Path string }{Path: c.Request().URL.Path})
+					return c.JSON(http.StatusUnauthorized, "Unauthorized")
+				}
+				claims, err = tokens.ParseAccessToken(tokenString)
+			}
+			if err != nil {
+				logs.LogWithFields(logger, logrus.WarnLevel, "Invalid credentials", struct {
+					Path  string
+					Error error
+				}{Path: c.Request().URL.Path, Error: err})
+				return c.JSON(http.StatusUnauthorized, "Unauthorized")
+			}
+
+			c.Set(ClaimsContextKey, claims)
+			c.Set(TenantIDContextKey, claims.TenantID)
+			return next(c)
+		}
+	}
+}
+
+func authenticateAPIKey(logger *logrus.Logger, apiKey string) (*auth.Claims, error) {
+	prefix, ok := auth.APIKeyPrefix(apiKey)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	// The tenant of the request is only known once the key is found.
+	tenantID, err := models.GetCredentialTenant(database.SystemDB(), models.CredentialAPIKey, prefix)
+	if err != nil {
+		return nil, errInvalidAPIKey
+	}
+	db, release, err := AcquireTenantData(context.Background(), tenantID)
+	if err != nil {
+		return nil, errInvalidAPIKey
+	}
+	defer release()
+
+	key, err := models.GetAPIKeyByPrefix(db, prefix)
+	if err != nil || !auth.CheckAPIKey(apiKey, key.KeyHash) {
+		return nil, errInvalidAPIKey
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return nil, errInvalidAPIKey
+	}
+
+	if err := models.TouchAPIKey(db, key.ID); err != nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to record API key usage", struct{ APIKeyID int }{APIKeyID: key.ID})
+	}
+
+	return &auth.Claims{
+		TenantID: key.TenantID,
+		APIKeyID: key.ID,
+		Scopes:   key.Scopes,
+	}, nil
+}
+
+func ClaimsFromContext(c echo.Context) (*auth.Claims, bool) {
+	claims, ok := c.Get(ClaimsContextKey).(*auth.Claims)
+	return claims, ok
+}
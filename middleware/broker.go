@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"jatis_mobile_api/broker"
+
+	"github.com/labstack/echo/v4"
+)
+
+const BrokerContextKey = "broker"
+
+// WithBroker makes the message broker available to handlers through Broker,
+// so that tests can run them against an in-memory broker.
+func WithBroker(b broker.Broker) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(BrokerContextKey, b)
+			return next(c)
+		}
+	}
+}
+
+// Broker returns the message broker set up by WithBroker. Without one, every
+// broker operation fails with broker.ErrUnavailable.
+func Broker(c echo.Context) broker.Broker {
+	if b, ok := c.Get(BrokerContextKey).(broker.Broker); ok {
+		return b
+	}
+	return broker.Unavailable{}
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DBContextKey         = "db"
+	TenantDataContextKey = "tenant_data_db"
+)
+
+// TenantDB acquires a database connection on behalf of the request tenant for
+// the rest of the request and stores it in the context, where handlers get it
+// with DB. The tenant is the resolved request tenant or, on /tenants/:id
+// routes, the :id parameter. It must run after RequirePermission, so that the
+// connection is only set up for a tenant the caller may access.
+func TenantDB(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenantID, ok := requestTenantID(c)
+		if !ok {
+			return next(c)
+		}
+
+		conn, err := database.AcquireTenantConn(c.Request().Context(), tenantID)
+		if err != nil {
+			logger := c.Get("logger").(*logrus.Logger)
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to acquire tenant database connection", struct {
+				TenantID int
+				Error    error
+			}{TenantID: tenantID, Error: err})
+			return c.JSON(http.StatusServiceUnavailable, "Database unavailable")
+		}
+		defer database.ReleaseTenantConn(conn)
+
+		c.Set(DBContextKey, database.DBTX(conn))
+
+		if tenantData, err := tenantDatabase(c, tenantID); err != nil {
+			logger := c.Get("logger").(*logrus.Logger)
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to connect to tenant database", struct {
+				TenantID int
+				Error    error
+			}{TenantID: tenantID, Error: err})
+			return c.JSON(http.StatusServiceUnavailable, "Tenant database unavailable")
+		} else if tenantData != nil {
+			c.Set(TenantDataContextKey, database.DBTX(tenantData))
+		}
+
+		return next(c)
+	}
+}
+
+// tenantDatabase returns the pool of the dedicated database of the tenant, or
+// nil if it has none.
+func tenantDatabase(c echo.Context, tenantID int) (*pgxpool.Pool, error) {
+	tenant, ok := TenantFromContext(c)
+	if !ok || tenant.ID != tenantID {
+		var err error
+		tenant, err = tenantCache.resolve(TenantLookup{ID: tenantID}, tenantCacheTTL())
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return TenantDataPool(c.Request().Context(), tenant)
+}
+
+// TenantDataPool returns the pool of the dedicated database of a tenant, or
+// nil if its tenant-level tables are in the shared database.
+func TenantDataPool(ctx context.Context, tenant *models.Tenant) (*pgxpool.Pool, error) {
+	if !tenant.HasDatabase() {
+		return nil, nil
+	}
+
+	dsn, err := auth.DecryptSecret(tenant.EncryptedDSN)
+	if err != nil {
+		return nil, err
+	}
+	return database.TenantPool(ctx, tenant.ID, dsn)
+}
+
+// AcquireTenantData returns the database holding the tenant-level tables of a
+// tenant, for work that has no TenantDB connection, such as authenticating a
+// request: its dedicated database if it has one, and a connection acquired
+// with AcquireTenantConn otherwise. release must be called once done with it.
+func AcquireTenantData(ctx context.Context, tenantID int) (db database.DBTX, release func(), err error) {
+	tenant, err := tenantCache.resolve(TenantLookup{ID: tenantID}, tenantCacheTTL())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pool, err := TenantDataPool(ctx, tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pool != nil {
+		return pool, func() {}, nil
+	}
+
+	conn, err := database.AcquireTenantConn(ctx, tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { database.ReleaseTenantConn(conn) }, nil
+}
+
+// DB returns the tenant connection set up by TenantDB, or the shared pool on
+// routes without a tenant, which sees no rows of tenant tables.
+func DB(c echo.Context) database.DBTX {
+	if db, ok := c.Get(DBContextKey).(database.DBTX); ok {
+		return db
+	}
+	return database.GetDB()
+}
+
+// TenantDataDB returns the database holding the tenant-level tables of the
+// request tenant: its dedicated database if it has one, and DB otherwise.
+func TenantDataDB(c echo.Context) database.DBTX {
+	if db, ok := c.Get(TenantDataContextKey).(database.DBTX); ok {
+		return db
+	}
+	return DB(c)
+}
+
+func requestTenantID(c echo.Context) (int, bool) {
+	if tenant, ok := TenantFromContext(c); ok {
+		return tenant.ID, true
+	}
+	if tenantID, err := strconv.Atoi(c.Param("id")); err == nil {
+		return tenantID, true
+	}
+	return 0, false
+}
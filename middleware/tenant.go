@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	TenantContextKey   = "tenant"
+	TenantIDContextKey = "tenant_id"
+
+	defaultTenantHeader   = "x-tenant-name"
+	defaultTenantCacheTTL = time.Minute
+)
+
+// TenantLookup identifies a tenant either by ID or by name.
+type TenantLookup struct {
+	ID   int
+	Name string
+}
+
+// TenantStrategy extracts a tenant reference from a request. It returns false
+// when the request does not carry one, so the next strategy can be tried.
+type TenantStrategy func(c echo.Context) (TenantLookup, bool)
+
+func TenantFromHeader(header string) TenantStrategy {
+	return func(c echo.Context) (TenantLookup, bool) {
+		name := c.Request().Header.Get(header)
+		return TenantLookup{Name: name}, name != ""
+	}
+}
+
+func TenantFromSubdomain(baseDomain string) TenantStrategy {
+	suffix := "." + strings.TrimPrefix(baseDomain, ".")
+	return func(c echo.Context) (TenantLookup, bool) {
+		host := c.Request().Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return TenantLookup{}, false
+		}
+		name := strings.TrimSuffix(host, suffix)
+		if name == "" || strings.Contains(name, ".") {
+			return TenantLookup{}, false
+		}
+		return TenantLookup{Name: name}, true
+	}
+}
+
+// TenantFromPathParam reads the tenant name from a route parameter, for routes
+// registered under a tenant path prefix such as /t/:tenant.
+func TenantFromPathParam(param string) TenantStrategy {
+	return func(c echo.Context) (TenantLookup, bool) {
+		name := c.Param(param)
+		return TenantLookup{Name: name}, name != ""
+	}
+}
+
+// TenantFromTokenClaim reads the tenant ID that an authentication middleware
+// stored in the context under TenantIDContextKey.
+func TenantFromTokenClaim() TenantStrategy {
+	return func(c echo.Context) (TenantLookup, bool) {
+		tenantID, ok := c.Get(TenantIDContextKey).(int)
+		return TenantLookup{ID: tenantID}, ok && tenantID > 0
+	}
+}
+
+// TenantFromAPIKey uses the tenant an API key belongs to when the request was
+// authenticated with one, so the tenant cannot be chosen by the caller.
+func TenantFromAPIKey() TenantStrategy {
+	return func(c echo.Context) (TenantLookup, bool) {
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.APIKeyID == 0 {
+			return TenantLookup{}, false
+		}
+		return TenantLookup{ID: claims.TenantID}, true
+	}
+}
+
+func TenantStrategiesFromConfig(cfg config.Config) ([]TenantStrategy, error) {
+	names := cfg.TenantResolvers
+	if len(names) == 0 {
+		names = []string{"apikey", "header"}
+	}
+
+	header := cfg.TenantHeader
+	if header == "" {
+		header = defaultTenantHeader
+	}
+
+	strategies := make([]TenantStrategy, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "apikey":
+			strategies = append(strategies, TenantFromAPIKey())
+		case "header":
+			strategies = append(strategies, TenantFromHeader(header))
+		case "subdomain":
+			if cfg.TenantBaseDomain == "" {
+				return nil, errors.New("TenantBaseDomain is required for the subdomain tenant resolver")
+			}
+			strategies = append(strategies, TenantFromSubdomain(cfg.TenantBaseDomain))
+		case "path":
+			strategies = append(strategies, TenantFromPathParam("tenant"))
+		case "token":
+			strategies = append(strategies, TenantFromTokenClaim())
+		default:
+			return nil, fmt.Errorf("unknown tenant resolver %q", name)
+		}
+	}
+	return strategies, nil
+}
+
+func TenantResolverFromConfig(cfg config.Config) (echo.MiddlewareFunc, error) {
+	strategies, err := TenantStrategiesFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := cfg.TenantCacheTTL
+	if ttl == 0 {
+		ttl = defaultTenantCacheTTL
+	}
+	return TenantResolver(ttl, strategies...), nil
+}
+
+func tenantCacheTTL() time.Duration {
+	if ttl := config.GetConfig().TenantCacheTTL; ttl > 0 {
+		return ttl
+	}
+	return defaultTenantCacheTTL
+}
+
+// TenantResolver resolves the tenant of each request with the first strategy
+// that finds a reference, checks that it exists and is not soft-deleted, and
+// stores it in the context for TenantFromContext.
+func TenantResolver(cacheTTL time.Duration, strategies ...TenantStrategy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			logger := c.Get("logger").(*logrus.Logger)
+
+			var (
+				lookup TenantLookup
+				found  bool
+			)
+			for _, strategy := range strategies {
+				if lookup, found = strategy(c); found {
+					break
+				}
+			}
+			if !found {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Request does not identify a tenant", struct{ Path string }{Path: c.Request().URL.Path})
+				return c.JSON(http.StatusBadRequest, "tenant is required")
+			}
+
+			tenant, err := tenantCache.resolve(lookup, cacheTTL)
+			if errors.Is(err, pgx.ErrNoRows) {
+				logs.LogWithFields(logger, logrus.WarnLevel, "Request for unknown tenant", struct {
+					TenantID   int
+					TenantName string
+				}{TenantID: lookup.ID, TenantName: lookup.Name})
+				return c.JSON(http.StatusNotFound, "Tenant not found")
+			}
+			if err != nil {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to resolve tenant", struct{ Error error }{Error: err})
+				return c.JSON(http.StatusInternalServerError, "Failed to resolve tenant")
+			}
+
+			c.Set(TenantContextKey, tenant)
+			return next(c)
+		}
+	}
+}
+
+func TenantFromContext(c echo.Context) (*models.Tenant, bool) {
+	tenant, ok := c.Get(TenantContextKey).(*models.Tenant)
+	return tenant, ok
+}
+
+// InvalidateTenant drops a tenant from the resolver cache. It must be called
+// whenever a tenant is renamed or deleted.
+func InvalidateTenant(tenant *models.Tenant) {
+	tenantCache.invalidate(tenant)
+}
+
+type cachedTenant struct {
+	tenant    *models.Tenant
+	expiresAt time.Time
+}
+
+type tenantLookupCache struct {
+	mu      sync.RWMutex
+	entries map[string]cachedTenant
+}
+
+var tenantCache = &tenantLookupCache{entries: map[string]cachedTenant{}}
+
+func (tc *tenantLookupCache) resolve(lookup TenantLookup, ttl time.Duration) (*models.Tenant, error) {
+	key := cacheKey(lookup)
+
+	tc.mu.RLock()
+	entry, ok := tc.entries[key]
+	tc.mu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.tenant, nil
+	}
+
+	var (
+		tenant *models.Tenant
+		err    error
+	)
+	if lookup.ID > 0 {
+		tenant, err = models.GetTenantByID(database.SystemDB(), lookup.ID, false)
+	} else {
+		tenant, err = models.GetTenantByName(database.SystemDB(), lookup.Name, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry = cachedTenant{tenant: tenant, expiresAt: time.Now().Add(ttl)}
+	tc.mu.Lock()
+	tc.entries[cacheKey(TenantLookup{ID: tenant.ID})] = entry
+	tc.entries[cacheKey(TenantLookup{Name: tenant.Name})] = entry
+	tc.mu.Unlock()
+	return tenant, nil
+}
+
+func (tc *tenantLookupCache) invalidate(tenant *models.Tenant) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.entries, cacheKey(TenantLookup{ID: tenant.ID}))
+	delete(tc.entries, cacheKey(TenantLookup{Name: tenant.Name}))
+}
+
+func cacheKey(lookup TenantLookup) string {
+	if lookup.ID > 0 {
+		return "id:" + strconv.Itoa(lookup.ID)
+	}
+	return "name:" + lookup.Name
+}
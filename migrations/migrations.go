@@ -0,0 +1,165 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//go:embed sql/*.sql tenant/*.sql tenant_database/*.sql
+var sqlFiles embed.FS
+
+var sqlFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change. It is either written in SQL, in
+// which case Up and Down hold the statements, or in Go, in which case UpFunc
+// and DownFunc are called instead. Both run inside a transaction.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	UpFunc   func(ctx context.Context, tx pgx.Tx) error
+	DownFunc func(ctx context.Context, tx pgx.Tx) error
+}
+
+// Checksum identifies the content of the up migration, so that a migration
+// edited after it was applied can be detected. Go migrations cannot be hashed
+// and are identified by their version and name only.
+func (m Migration) Checksum() string {
+	source := m.Up
+	if m.UpFunc != nil {
+		source = fmt.Sprintf("go:%d_%s", m.Version, m.Name)
+	}
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m Migration) HasDown() bool {
+	return m.Down != "" || m.DownFunc != nil
+}
+
+var goMigrations, goTenantMigrations []Migration
+
+// Register adds a Go migration. It is meant to be called from init functions
+// in this package, next to the SQL files.
+func Register(m Migration) {
+	goMigrations = append(goMigrations, m)
+}
+
+// RegisterTenant adds a Go migration to the tenant-level migrations.
+func RegisterTenant(m Migration) {
+	goTenantMigrations = append(goTenantMigrations, m)
+}
+
+// Load returns the embedded SQL migrations and the registered Go migrations,
+// ordered by version.
+func Load() ([]Migration, error) {
+	return load("sql", goMigrations)
+}
+
+// LoadTenant returns the tenant-level migrations, which are applied to every
+// tenant schema in schema isolation mode.
+func LoadTenant() ([]Migration, error) {
+	return load("tenant", goTenantMigrations)
+}
+
+// LoadTenantDatabase returns the tenant-level migrations for dedicated tenant
+// databases. These have no shared tables to reference, so the up migrations in
+// tenant_database replace those of the same version.
+func LoadTenantDatabase() ([]Migration, error) {
+	migrations, err := LoadTenant()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(sqlFiles, "tenant_database")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		match := sqlFileName.FindStringSubmatch(entry.Name())
+		if match == nil || match[3] != "up" {
+			return nil, fmt.Errorf("invalid tenant database migration file name %q", entry.Name())
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+
+		content, err := sqlFiles.ReadFile(path.Join("tenant_database", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		replaced := false
+		for i := range migrations {
+			if migrations[i].Version == version && migrations[i].Name == match[2] {
+				migrations[i].Up = string(content)
+				replaced = true
+			}
+		}
+		if !replaced {
+			return nil, fmt.Errorf("tenant database migration %s replaces no tenant migration", entry.Name())
+		}
+	}
+	return migrations, nil
+}
+
+func load(dir string, goMigrations []Migration) ([]Migration, error) {
+	byVersion := map[int64]*Migration{}
+
+	entries, err := fs.ReadDir(sqlFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		match := sqlFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+
+		content, err := sqlFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	for i := range goMigrations {
+		m := goMigrations[i]
+		if _, ok := byVersion[m.Version]; ok {
+			return nil, fmt.Errorf("migration version %d is used more than once", m.Version)
+		}
+		byVersion[m.Version] = &m
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" && m.UpFunc == nil {
+			return nil, fmt.Errorf("migration %d_%s has no up migration", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
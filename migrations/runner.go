@@ -0,0 +1,323 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrChecksumMismatch = errors.New("applied migration was modified")
+
+// Status is a known migration together with whether and when it was applied.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+	Modified  bool
+}
+
+type applied struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// Migrator applies and rolls back the migrations returned by Load, or those
+// returned by LoadTenant to a tenant schema. With DryRun set, nothing is
+// executed and the statements that would run are written to Out instead.
+type Migrator struct {
+	DryRun bool
+	Out    io.Writer
+
+	pool       *pgxpool.Pool
+	logger     *logrus.Logger
+	migrations []Migration
+	schema     string
+}
+
+func NewMigrator(pool *pgxpool.Pool, logger *logrus.Logger) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{Out: io.Discard, pool: pool, logger: logger, migrations: migrations}, nil
+}
+
+// NewTenantMigrator returns a migrator for the schema of a tenant, which keeps
+// its own schema_migrations table. The schema is created on the first Up.
+func NewTenantMigrator(pool *pgxpool.Pool, logger *logrus.Logger, tenantID int) (*Migrator, error) {
+	migrations, err := LoadTenant()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		Out:        io.Discard,
+		pool:       pool,
+		logger:     logger,
+		migrations: migrations,
+		schema:     database.TenantSchema(tenantID),
+	}, nil
+}
+
+// NewTenantDatabaseMigrator returns a migrator for the dedicated database of a
+// tenant, which pool must be connected to. The migrations returned by
+// LoadTenantDatabase are applied to its public schema.
+func NewTenantDatabaseMigrator(pool *pgxpool.Pool, logger *logrus.Logger) (*Migrator, error) {
+	migrations, err := LoadTenantDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{Out: io.Discard, pool: pool, logger: logger, migrations: migrations}, nil
+}
+
+// Up applies every pending migration up to and including target, or all of
+// them if target is 0. It refuses to run when an applied migration has been
+// modified since.
+func (m *Migrator) Up(ctx context.Context, target int64) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		done, err := m.appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		known := map[int64]bool{}
+		for _, migration := range m.migrations {
+			known[migration.Version] = true
+			if a, ok := done[migration.Version]; ok && a.checksum != migration.Checksum() {
+				return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, migration.Version, migration.Name)
+			}
+		}
+		for version := range done {
+			if !known[version] {
+				logs.LogWithFields(m.logger, logrus.WarnLevel, "Database has a migration unknown to this build", struct{ Version int64 }{Version: version})
+			}
+		}
+
+		for _, migration := range m.migrations {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			if err := m.run(ctx, conn, migration, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the last steps applied migrations, newest first.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		done, err := m.appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+			if !migration.HasDown() {
+				return fmt.Errorf("migration %d_%s cannot be rolled back", migration.Version, migration.Name)
+			}
+			if err := m.run(ctx, conn, migration, false); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	done, err := m.appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Migration: migration}
+		if a, ok := done[migration.Version]; ok {
+			appliedAt := a.appliedAt
+			status.AppliedAt = &appliedAt
+			status.Modified = a.checksum != migration.Checksum()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) run(ctx context.Context, conn *pgxpool.Conn, migration Migration, up bool) error {
+	direction, query, fn := "up", migration.Up, migration.UpFunc
+	if !up {
+		direction, query, fn = "down", migration.Down, migration.DownFunc
+	}
+
+	if m.DryRun {
+		if m.schema != "" {
+			fmt.Fprintf(m.Out, "-- %s: %d_%s (%s)\n", m.schema, migration.Version, migration.Name, direction)
+		} else {
+			fmt.Fprintf(m.Out, "-- %d_%s (%s)\n", migration.Version, migration.Name, direction)
+		}
+		if fn != nil {
+			fmt.Fprintln(m.Out, "-- Go migration")
+		} else {
+			fmt.Fprintln(m.Out, query)
+		}
+		return nil
+	}
+
+	err := conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		if fn != nil {
+			err = fn(ctx, tx)
+		} else {
+			_, err = tx.Exec(ctx, query)
+		}
+		if err != nil {
+			return err
+		}
+
+		if up {
+			_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+				migration.Version, migration.Name, migration.Checksum())
+		} else {
+			_, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+		}
+		return err
+	})
+	if err != nil {
+		logs.LogWithFields(m.logger, logrus.ErrorLevel, "Migration failed", struct {
+			Schema    string
+			Version   int64
+			Name      string
+			Direction string
+			Error     error
+		}{Schema: m.schema, Version: migration.Version, Name: migration.Name, Direction: direction, Error: err})
+		return err
+	}
+
+	logs.LogWithFields(m.logger, logrus.InfoLevel, "Migration applied", struct {
+		Schema    string
+		Version   int64
+		Name      string
+		Direction string
+	}{Schema: m.schema, Version: migration.Version, Name: migration.Name, Direction: direction})
+	return nil
+}
+
+// withLock runs fn on a dedicated connection holding the migration advisory
+// lock of the schema, so that only one of several instances starting at the
+// same time migrates it. Advisory locks belong to a session, so the same
+// connection must be used for locking, migrating and unlocking.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if m.schema != "" {
+		if err := m.useSchema(ctx, conn); err != nil {
+			return err
+		}
+		defer conn.Exec(context.Background(), `RESET search_path`)
+	}
+
+	if !m.DryRun {
+		lockKey := "schema_migrations:" + m.schema
+		var locked bool
+		if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, lockKey).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked {
+			logs.LogWithFields(m.logger, logrus.InfoLevel, "Waiting for another instance to finish migrating", struct{ Schema string }{Schema: m.schema})
+			if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock(hashtext($1))`, lockKey); err != nil {
+				return err
+			}
+		}
+		defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock(hashtext($1))`, lockKey)
+
+		if _, err := conn.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version BIGINT PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            checksum VARCHAR(64) NOT NULL,
+            applied_at TIMESTAMP DEFAULT now()
+        )`); err != nil {
+			return err
+		}
+	}
+
+	return fn(conn)
+}
+
+// useSchema points the search_path of conn at the tenant schema, creating it
+// unless this is a dry run. Unqualified names in tenant migrations, including
+// schema_migrations, then resolve to the tenant schema first.
+func (m *Migrator) useSchema(ctx context.Context, conn *pgxpool.Conn) error {
+	schema := pgx.Identifier{m.schema}.Sanitize()
+	if !m.DryRun {
+		if _, err := conn.Exec(ctx, `CREATE SCHEMA IF NOT EXISTS `+schema); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Exec(ctx, `SET search_path TO `+schema+`, public`)
+	return err
+}
+
+// appliedMigrations returns the applied migrations by version. A missing
+// schema_migrations table, which a dry run does not create, means none.
+func (m *Migrator) appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int64]applied, error) {
+	schema := m.schema
+	if schema == "" {
+		schema = "public"
+	}
+
+	var exists bool
+	if err := conn.QueryRow(ctx, `
+        SELECT EXISTS (
+            SELECT 1 FROM information_schema.tables
+            WHERE table_schema = $1 AND table_name = 'schema_migrations'
+        )`, schema).Scan(&exists); err != nil {
+		return nil, err
+	}
+	done := map[int64]applied{}
+	if !exists {
+		return done, nil
+	}
+
+	rows, err := conn.Query(ctx, `SELECT version, checksum, applied_at FROM `+pgx.Identifier{schema, "schema_migrations"}.Sanitize())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		var a applied
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		done[version] = a
+	}
+	return done, rows.Err()
+}
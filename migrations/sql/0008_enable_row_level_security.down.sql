@@ -0,0 +1,36 @@
+DROP POLICY IF EXISTS tenant_isolation ON password_history;
+ALTER TABLE password_history NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE password_history DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON user_roles;
+ALTER TABLE user_roles NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE user_roles DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON role_permissions;
+ALTER TABLE role_permissions NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE role_permissions DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS builtin_roles_read ON roles;
+DROP POLICY IF EXISTS tenant_isolation ON roles;
+ALTER TABLE roles NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE roles DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON password_policies;
+ALTER TABLE password_policies NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE password_policies DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON api_keys;
+ALTER TABLE api_keys NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE api_keys DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON refresh_tokens;
+ALTER TABLE refresh_tokens NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE refresh_tokens DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON users;
+ALTER TABLE users NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE users DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON tenants;
+ALTER TABLE tenants NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE tenants DISABLE ROW LEVEL SECURITY;
@@ -0,0 +1,60 @@
+-- Tenant-scoped connections set app.current_tenant, and these policies then
+-- only let them see and write rows of that tenant. Connections that have not
+-- set it, such as the ones authenticating a request before its tenant is
+-- known, are not restricted. FORCE makes the policies apply to the table
+-- owner too; superusers and roles with BYPASSRLS always bypass them.
+ALTER TABLE tenants ENABLE ROW LEVEL SECURITY;
+ALTER TABLE tenants FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON tenants
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+ALTER TABLE users ENABLE ROW LEVEL SECURITY;
+ALTER TABLE users FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON users
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+ALTER TABLE refresh_tokens ENABLE ROW LEVEL SECURITY;
+ALTER TABLE refresh_tokens FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON refresh_tokens
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+ALTER TABLE api_keys ENABLE ROW LEVEL SECURITY;
+ALTER TABLE api_keys FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON api_keys
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+ALTER TABLE password_policies ENABLE ROW LEVEL SECURITY;
+ALTER TABLE password_policies FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON password_policies
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+-- Built-in roles have no tenant and can be read, but not changed, by every
+-- tenant.
+ALTER TABLE roles ENABLE ROW LEVEL SECURITY;
+ALTER TABLE roles FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON roles
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+CREATE POLICY builtin_roles_read ON roles FOR SELECT
+    USING (tenant_id IS NULL);
+
+-- Tables without a tenant_id follow the visibility of the row they belong to.
+ALTER TABLE role_permissions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE role_permissions FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON role_permissions
+    USING (role_id IN (SELECT id FROM roles WHERE tenant_id IS NOT NULL));
+
+ALTER TABLE user_roles ENABLE ROW LEVEL SECURITY;
+ALTER TABLE user_roles FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON user_roles
+    USING (user_id IN (SELECT id FROM users));
+
+ALTER TABLE password_history ENABLE ROW LEVEL SECURITY;
+ALTER TABLE password_history FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON password_history
+    USING (user_id IN (SELECT id FROM users));
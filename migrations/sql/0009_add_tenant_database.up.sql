@@ -0,0 +1 @@
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS encrypted_dsn BYTEA NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS tenant_provisioning_steps;
+DROP TABLE IF EXISTS tenant_provisioning_runs;
@@ -0,0 +1,33 @@
+-- Provisioning runs are not tied to the tenants table by a foreign key, so
+-- that the record of a failed run survives the compensation deleting the
+-- tenant row.
+CREATE TABLE IF NOT EXISTS tenant_provisioning_runs (
+    id SERIAL PRIMARY KEY,
+    tenant_id INT NULL,
+    tenant_name VARCHAR(255) NOT NULL,
+    dedicated_database BOOLEAN NOT NULL DEFAULT false,
+    status VARCHAR(32) NOT NULL,
+    error TEXT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS tenant_provisioning_runs_tenant_id_idx ON tenant_provisioning_runs (tenant_id, id);
+-- At most one unfinished run per tenant name.
+CREATE UNIQUE INDEX IF NOT EXISTS tenant_provisioning_runs_unfinished_idx ON tenant_provisioning_runs (tenant_name)
+    WHERE status IN ('running', 'compensation_failed');
+
+CREATE TABLE IF NOT EXISTS tenant_provisioning_steps (
+    run_id INT NOT NULL REFERENCES tenant_provisioning_runs(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    error TEXT NULL,
+    updated_at TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (run_id, name)
+);
+
+ALTER TABLE tenant_provisioning_runs ENABLE ROW LEVEL SECURITY;
+ALTER TABLE tenant_provisioning_runs FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON tenant_provisioning_runs
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
@@ -0,0 +1,16 @@
+-- Messages written in the same transaction as the change they announce and
+-- published to RabbitMQ afterwards by the outbox relay.
+CREATE TABLE IF NOT EXISTS outbox_messages (
+    id BIGSERIAL PRIMARY KEY,
+    exchange VARCHAR(255) NOT NULL,
+    routing_key VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL DEFAULT 'application/json',
+    body BYTEA NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NULL,
+    available_at TIMESTAMP NOT NULL DEFAULT now(),
+    created_at TIMESTAMP DEFAULT now(),
+    sent_at TIMESTAMP NULL
+);
+CREATE INDEX IF NOT EXISTS outbox_messages_pending_idx ON outbox_messages (available_at, id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_messages_sent_at_idx ON outbox_messages (sent_at) WHERE sent_at IS NOT NULL;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS queue_messages;
+DROP FUNCTION IF EXISTS notify_queue_message();
+DROP TABLE IF EXISTS queue_bindings;
+DROP TABLE IF EXISTS queues;
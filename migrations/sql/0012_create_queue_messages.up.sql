@@ -0,0 +1,47 @@
+-- Queues of the Postgres message broker. Every tenant queue stores its
+-- messages and those of its dead-letter queue in a partition of its own.
+CREATE TABLE IF NOT EXISTS queues (
+    name VARCHAR(255) PRIMARY KEY,
+    dead_letter_queue VARCHAR(255) NOT NULL UNIQUE,
+    partition_name VARCHAR(63) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS queue_bindings (
+    exchange VARCHAR(255) NOT NULL,
+    routing_key VARCHAR(255) NOT NULL,
+    queue VARCHAR(255) NOT NULL REFERENCES queues (name) ON DELETE CASCADE,
+    PRIMARY KEY (exchange, routing_key, queue)
+);
+
+CREATE TABLE IF NOT EXISTS queue_messages (
+    id BIGSERIAL,
+    queue VARCHAR(255) NOT NULL,
+    message_id VARCHAR(255) NOT NULL DEFAULT '',
+    type VARCHAR(255) NOT NULL DEFAULT '',
+    content_type VARCHAR(255) NOT NULL DEFAULT '',
+    headers JSONB NOT NULL DEFAULT '{}',
+    body BYTEA NOT NULL,
+    retries INT NOT NULL DEFAULT 0,
+    deliveries INT NOT NULL DEFAULT 0,
+    dead_reason VARCHAR(255) NULL,
+    available_at TIMESTAMP NOT NULL DEFAULT now(),
+    locked_by VARCHAR(255) NULL,
+    locked_until TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (queue, id)
+) PARTITION BY LIST (queue);
+CREATE INDEX IF NOT EXISTS queue_messages_due_idx ON queue_messages (queue, available_at, id);
+CREATE INDEX IF NOT EXISTS queue_messages_locked_by_idx ON queue_messages (locked_by) WHERE locked_by IS NOT NULL;
+
+-- Wake consumers listening for new messages of a queue.
+CREATE OR REPLACE FUNCTION notify_queue_message() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('queue_messages', NEW.queue);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER queue_messages_notify
+    AFTER INSERT ON queue_messages
+    FOR EACH ROW EXECUTE FUNCTION notify_queue_message();
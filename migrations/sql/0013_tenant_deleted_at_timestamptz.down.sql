@@ -0,0 +1 @@
+ALTER TABLE tenants ALTER COLUMN deleted_at TYPE TIMESTAMP;
@@ -0,0 +1,3 @@
+-- deleted_at was filled by NOW() in the session time zone, which is how the
+-- existing values are read when converting them.
+ALTER TABLE tenants ALTER COLUMN deleted_at TYPE TIMESTAMPTZ;
@@ -0,0 +1,34 @@
+DROP POLICY IF EXISTS tenant_isolation ON tenant_provisioning_runs;
+CREATE POLICY tenant_isolation ON tenant_provisioning_runs
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON roles;
+CREATE POLICY tenant_isolation ON roles
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON password_policies;
+CREATE POLICY tenant_isolation ON password_policies
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON api_keys;
+CREATE POLICY tenant_isolation ON api_keys
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON refresh_tokens;
+CREATE POLICY tenant_isolation ON refresh_tokens
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON users;
+CREATE POLICY tenant_isolation ON users
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON tenants;
+CREATE POLICY tenant_isolation ON tenants
+    USING (COALESCE(current_setting('app.current_tenant', true), '') = ''
+        OR id = NULLIF(current_setting('app.current_tenant', true), '')::int);
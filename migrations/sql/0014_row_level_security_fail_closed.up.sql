@@ -0,0 +1,40 @@
+-- The policies of 0008 and 0010 let connections that had not set
+-- app.current_tenant see every row, so a query that forgot to scope itself
+-- saw all tenants. They now deny such connections. Work that is not on behalf
+-- of a single tenant, such as authenticating a request before its tenant is
+-- known, runs on connections that set app.bypass_rls instead.
+
+DROP POLICY IF EXISTS tenant_isolation ON tenants;
+CREATE POLICY tenant_isolation ON tenants
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON users;
+CREATE POLICY tenant_isolation ON users
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON refresh_tokens;
+CREATE POLICY tenant_isolation ON refresh_tokens
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON api_keys;
+CREATE POLICY tenant_isolation ON api_keys
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON password_policies;
+CREATE POLICY tenant_isolation ON password_policies
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON roles;
+CREATE POLICY tenant_isolation ON roles
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
+
+DROP POLICY IF EXISTS tenant_isolation ON tenant_provisioning_runs;
+CREATE POLICY tenant_isolation ON tenant_provisioning_runs
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
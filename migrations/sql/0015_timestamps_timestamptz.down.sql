@@ -0,0 +1,51 @@
+ALTER TABLE queue_messages
+    ALTER COLUMN available_at TYPE TIMESTAMP,
+    ALTER COLUMN locked_until TYPE TIMESTAMP,
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+
+ALTER TABLE queues
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+
+ALTER TABLE outbox_messages
+    ALTER COLUMN available_at TYPE TIMESTAMP,
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN sent_at TYPE TIMESTAMP;
+
+ALTER TABLE tenant_provisioning_steps
+    ALTER COLUMN updated_at TYPE TIMESTAMP;
+
+ALTER TABLE tenant_provisioning_runs
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN updated_at TYPE TIMESTAMP;
+
+ALTER TABLE password_history
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+
+ALTER TABLE password_policies
+    ALTER COLUMN updated_at TYPE TIMESTAMP;
+
+ALTER TABLE api_keys
+    ALTER COLUMN expires_at TYPE TIMESTAMP,
+    ALTER COLUMN revoked_at TYPE TIMESTAMP,
+    ALTER COLUMN last_used_at TYPE TIMESTAMP,
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+
+ALTER TABLE user_roles
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+
+ALTER TABLE roles
+    ALTER COLUMN created_at TYPE TIMESTAMP;
+
+ALTER TABLE refresh_tokens
+    ALTER COLUMN expires_at TYPE TIMESTAMP,
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN revoked_at TYPE TIMESTAMP;
+
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE TIMESTAMP,
+    ALTER COLUMN updated_at TYPE TIMESTAMP,
+    ALTER COLUMN last_login TYPE TIMESTAMP,
+    ALTER COLUMN deleted_at TYPE TIMESTAMP;
+
+ALTER TABLE tenants
+    ALTER COLUMN created_at TYPE TIMESTAMP;
@@ -0,0 +1,56 @@
+-- Like tenants.deleted_at in 0013, every other timestamp is an instant that
+-- is compared with NOW() or with times from Go, so it is stored as
+-- TIMESTAMPTZ. Existing values were written by NOW() or by the application
+-- in the time zone of the session, which is how they are read when
+-- converting them.
+ALTER TABLE tenants
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN updated_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN last_login TYPE TIMESTAMPTZ,
+    ALTER COLUMN deleted_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE refresh_tokens
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN revoked_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE roles
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE user_roles
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE api_keys
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN revoked_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN last_used_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE password_policies
+    ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE password_history
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE tenant_provisioning_runs
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE tenant_provisioning_steps
+    ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE outbox_messages
+    ALTER COLUMN available_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN sent_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE queues
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE queue_messages
+    ALTER COLUMN available_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN locked_until TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ;
@@ -0,0 +1,25 @@
+-- In schema and database isolation mode, refresh tokens and API keys live in
+-- the storage of their tenant, so a request presenting one first looks up
+-- here which tenant it belongs to. lookup_key is the hash of a refresh token
+-- or the prefix of an API key, neither of which lets anyone authenticate.
+CREATE TABLE IF NOT EXISTS credential_lookups (
+    kind VARCHAR(32) NOT NULL,
+    lookup_key VARCHAR(64) NOT NULL,
+    tenant_id INT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    PRIMARY KEY (kind, lookup_key)
+);
+
+INSERT INTO credential_lookups (kind, lookup_key, tenant_id, created_at)
+SELECT 'refresh_token', token_hash, tenant_id, created_at FROM refresh_tokens
+ON CONFLICT DO NOTHING;
+
+INSERT INTO credential_lookups (kind, lookup_key, tenant_id, created_at)
+SELECT 'api_key', prefix, tenant_id, created_at FROM api_keys
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE credential_lookups ENABLE ROW LEVEL SECURITY;
+ALTER TABLE credential_lookups FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON credential_lookups
+    USING (current_setting('app.bypass_rls', true) = 'on'
+        OR tenant_id = NULLIF(current_setting('app.current_tenant', true), '')::int);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS password_policies (
+    tenant_id INT PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    min_length INT NOT NULL,
+    check_breached BOOLEAN NOT NULL,
+    history_size INT NOT NULL,
+    updated_at TIMESTAMP DEFAULT now()
+);
@@ -0,0 +1,10 @@
+-- Dedicated tenant databases have no shared tables to reference.
+DO $$
+BEGIN
+    IF to_regclass('tenants') IS NOT NULL THEN
+        ALTER TABLE password_policies ADD CONSTRAINT password_policies_tenant_id_fkey
+            FOREIGN KEY (tenant_id) REFERENCES tenants(id) ON DELETE CASCADE;
+        ALTER TABLE password_history ADD CONSTRAINT password_history_user_id_fkey
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+    END IF;
+END $$;
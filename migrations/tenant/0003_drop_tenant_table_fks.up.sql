@@ -0,0 +1,5 @@
+-- Tenant schemas created before dedicated tenant databases existed reference
+-- the shared tables, which a dedicated database does not have. Dropping the
+-- references keeps both kinds of tenant storage alike.
+ALTER TABLE password_policies DROP CONSTRAINT IF EXISTS password_policies_tenant_id_fkey;
+ALTER TABLE password_history DROP CONSTRAINT IF EXISTS password_history_user_id_fkey;
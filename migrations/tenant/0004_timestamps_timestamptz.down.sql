@@ -0,0 +1,2 @@
+ALTER TABLE password_history ALTER COLUMN created_at TYPE TIMESTAMP;
+ALTER TABLE password_policies ALTER COLUMN updated_at TYPE TIMESTAMP;
@@ -0,0 +1,3 @@
+-- Timestamps are instants, stored as TIMESTAMPTZ like in the shared tables.
+ALTER TABLE password_policies ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+ALTER TABLE password_history ALTER COLUMN created_at TYPE TIMESTAMPTZ;
@@ -0,0 +1,44 @@
+-- A tenant schema hands its rows back to the shared tables, mapping roles by
+-- name. The rows of a dedicated database are dropped with its tables.
+DO $$
+DECLARE
+    owner_id INT := substring(current_schema() FROM '^tenant_(\d+)$')::int;
+BEGIN
+    IF owner_id IS NOT NULL THEN
+        INSERT INTO public.users (id, tenant_id, username, email, password_hash, created_at, updated_at, last_login, deleted_at)
+        SELECT id, tenant_id, username, email, password_hash, created_at, updated_at, last_login, deleted_at
+        FROM users;
+
+        INSERT INTO public.refresh_tokens (id, user_id, tenant_id, token_hash, expires_at, created_at, revoked_at)
+        SELECT id, user_id, tenant_id, token_hash, expires_at, created_at, revoked_at
+        FROM refresh_tokens;
+
+        INSERT INTO public.roles (tenant_id, name, created_at)
+        SELECT tenant_id, name, created_at
+        FROM roles WHERE tenant_id IS NOT NULL;
+
+        INSERT INTO public.role_permissions (role_id, permission)
+        SELECT pr.id, rp.permission
+        FROM role_permissions rp
+        JOIN roles r ON r.id = rp.role_id
+        JOIN public.roles pr ON pr.name = r.name AND pr.tenant_id = owner_id
+        WHERE r.tenant_id IS NOT NULL;
+
+        INSERT INTO public.user_roles (user_id, role_id, created_at)
+        SELECT ur.user_id, pr.id, ur.created_at
+        FROM user_roles ur
+        JOIN roles r ON r.id = ur.role_id
+        JOIN public.roles pr ON pr.name = r.name AND COALESCE(pr.tenant_id, 0) = COALESCE(r.tenant_id, 0);
+
+        INSERT INTO public.api_keys (id, tenant_id, name, prefix, key_hash, scopes, expires_at, revoked_at, last_used_at, created_at)
+        SELECT id, tenant_id, name, prefix, key_hash, scopes, expires_at, revoked_at, last_used_at, created_at
+        FROM api_keys;
+
+        PERFORM setval(pg_get_serial_sequence('public.users', 'id'), COALESCE(max(id), 0) + 1, false) FROM public.users;
+        PERFORM setval(pg_get_serial_sequence('public.refresh_tokens', 'id'), COALESCE(max(id), 0) + 1, false) FROM public.refresh_tokens;
+        PERFORM setval(pg_get_serial_sequence('public.api_keys', 'id'), COALESCE(max(id), 0) + 1, false) FROM public.api_keys;
+    END IF;
+
+    -- Qualified, so that a missing table does not resolve to public.
+    EXECUTE format('DROP TABLE IF EXISTS %1$I.api_keys, %1$I.user_roles, %1$I.role_permissions, %1$I.roles, %1$I.refresh_tokens, %1$I.users', current_schema());
+END $$;
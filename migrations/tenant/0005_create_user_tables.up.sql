@@ -0,0 +1,116 @@
+-- Users, their credentials and their roles belong to a single tenant, so
+-- they live next to the password tables. Like those, they reference no other
+-- table, which a dedicated tenant database would not have. Built-in roles are
+-- kept in every tenant's roles table, so that roles are assigned alike.
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    tenant_id INT NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    updated_at TIMESTAMPTZ DEFAULT now(),
+    last_login TIMESTAMPTZ NULL,
+    deleted_at TIMESTAMPTZ NULL,
+    UNIQUE (tenant_id, email)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    tenant_id INT NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    revoked_at TIMESTAMPTZ NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id SERIAL PRIMARY KEY,
+    tenant_id INT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS roles_tenant_name_idx ON roles (COALESCE(tenant_id, 0), name);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id INT NOT NULL,
+    permission VARCHAR(255) NOT NULL,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL,
+    role_id INT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    tenant_id INT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    prefix VARCHAR(16) UNIQUE NOT NULL,
+    key_hash VARCHAR(64) NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMPTZ NULL,
+    revoked_at TIMESTAMPTZ NULL,
+    last_used_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- A tenant schema takes over the rows of its tenant from the shared tables,
+-- keeping their IDs. Dedicated databases cannot read the shared database and
+-- are filled by MigrateTenantDatabases instead.
+DO $$
+DECLARE
+    owner_id INT := substring(current_schema() FROM '^tenant_(\d+)$')::int;
+BEGIN
+    IF owner_id IS NULL THEN
+        RETURN;
+    END IF;
+    IF to_regclass('public.credential_lookups') IS NULL THEN
+        RAISE EXCEPTION 'the shared migrations must be applied before the tenant migrations';
+    END IF;
+
+    INSERT INTO users (id, tenant_id, username, email, password_hash, created_at, updated_at, last_login, deleted_at)
+    SELECT id, tenant_id, username, email, password_hash, created_at, updated_at, last_login, deleted_at
+    FROM public.users WHERE tenant_id = owner_id;
+
+    INSERT INTO refresh_tokens (id, user_id, tenant_id, token_hash, expires_at, created_at, revoked_at)
+    SELECT id, user_id, tenant_id, token_hash, expires_at, created_at, revoked_at
+    FROM public.refresh_tokens WHERE tenant_id = owner_id;
+
+    INSERT INTO roles (id, tenant_id, name, created_at)
+    SELECT id, tenant_id, name, created_at
+    FROM public.roles WHERE tenant_id IS NULL OR tenant_id = owner_id;
+
+    INSERT INTO role_permissions (role_id, permission)
+    SELECT rp.role_id, rp.permission
+    FROM public.role_permissions rp JOIN public.roles r ON r.id = rp.role_id
+    WHERE r.tenant_id = owner_id;
+
+    INSERT INTO user_roles (user_id, role_id, created_at)
+    SELECT ur.user_id, ur.role_id, ur.created_at
+    FROM public.user_roles ur JOIN public.users u ON u.id = ur.user_id
+    WHERE u.tenant_id = owner_id;
+
+    INSERT INTO api_keys (id, tenant_id, name, prefix, key_hash, scopes, expires_at, revoked_at, last_used_at, created_at)
+    SELECT id, tenant_id, name, prefix, key_hash, scopes, expires_at, revoked_at, last_used_at, created_at
+    FROM public.api_keys WHERE tenant_id = owner_id;
+
+    PERFORM setval(pg_get_serial_sequence('users', 'id'), COALESCE(max(id), 0) + 1, false) FROM users;
+    PERFORM setval(pg_get_serial_sequence('refresh_tokens', 'id'), COALESCE(max(id), 0) + 1, false) FROM refresh_tokens;
+    PERFORM setval(pg_get_serial_sequence('roles', 'id'), COALESCE(max(id), 0) + 1, false) FROM roles;
+    PERFORM setval(pg_get_serial_sequence('api_keys', 'id'), COALESCE(max(id), 0) + 1, false) FROM api_keys;
+
+    -- Deleting the users also deletes their refresh tokens, roles and
+    -- password history in the shared tables.
+    DELETE FROM public.api_keys WHERE tenant_id = owner_id;
+    DELETE FROM public.roles WHERE tenant_id = owner_id;
+    DELETE FROM public.users WHERE tenant_id = owner_id;
+END $$;
+
+INSERT INTO roles (tenant_id, name)
+VALUES (NULL, 'platform-admin'), (NULL, 'tenant-admin'), (NULL, 'tenant-member')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,168 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// CreateTenantDatabase creates the dedicated database of a tenant, applies the
+// tenant migrations to it and stores its encrypted connection string on the
+// tenant. Databases are created through TenantDatabaseAdminURL, or PostgresURL
+// if it is not set, and the tenant connects with the same credentials.
+func CreateTenantDatabase(ctx context.Context, db database.DBTX, logger *logrus.Logger, tenant *models.Tenant) error {
+	adminURL := tenantAdminURL()
+	dsn, err := tenantDSN(adminURL, tenant.ID)
+	if err != nil {
+		return err
+	}
+	encryptedDSN, err := auth.EncryptSecret(dsn)
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, adminURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	name := database.TenantDatabase(tenant.ID)
+	_, err = conn.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{name}.Sanitize())
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42P04" {
+		// duplicate_database: left over from an earlier attempt, which the
+		// migrations below pick up.
+		err = nil
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Unable to create tenant database", struct {
+			Database string
+			Error    error
+		}{Database: name, Error: err})
+		return err
+	}
+
+	if err := MigrateTenantDatabase(ctx, logger, dsn); err != nil {
+		return err
+	}
+
+	if err := models.SetTenantDSN(db, tenant.ID, encryptedDSN); err != nil {
+		return err
+	}
+	tenant.EncryptedDSN = encryptedDSN
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant database created", struct{ Database string }{Database: name})
+	return nil
+}
+
+// MigrateTenantDatabase applies pending tenant migrations to a dedicated
+// tenant database.
+func MigrateTenantDatabase(ctx context.Context, logger *logrus.Logger, dsn string) error {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return err
+	}
+	poolConfig.MaxConns = 1
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	migrator, err := NewTenantDatabaseMigrator(pool, logger)
+	if err != nil {
+		return err
+	}
+	return migrator.Up(ctx, 0)
+}
+
+// MigrateTenantDatabases applies pending tenant migrations to the dedicated
+// databases of all tenants that have one, and moves their rows there with
+// MoveTenantRowsToDatabases.
+func MigrateTenantDatabases(ctx context.Context, pool *pgxpool.Pool, logger *logrus.Logger) error {
+	tenants, err := models.ListTenantDatabases(pool)
+	if err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		dsn, err := auth.DecryptSecret(tenant.EncryptedDSN)
+		if err != nil {
+			return fmt.Errorf("decrypting database of tenant %d: %w", tenant.ID, err)
+		}
+		if err := MigrateTenantDatabase(ctx, logger, dsn); err != nil {
+			return fmt.Errorf("migrating database of tenant %d: %w", tenant.ID, err)
+		}
+	}
+	return MoveTenantRowsToDatabases(ctx, pool, logger)
+}
+
+// DropTenantDatabase closes the pool of the dedicated database of a tenant and
+// drops the database or, with archive set, renames it to
+// archived_tenant_<id>_<unix time>.
+func DropTenantDatabase(ctx context.Context, logger *logrus.Logger, tenantID int, archive bool) error {
+	database.CloseTenantPool(tenantID)
+
+	conn, err := pgx.Connect(ctx, tenantAdminURL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	name := database.TenantDatabase(tenantID)
+	query := "DROP DATABASE IF EXISTS " + pgx.Identifier{name}.Sanitize() + " WITH (FORCE)"
+	if archive {
+		archived := fmt.Sprintf("archived_%s_%d", name, time.Now().Unix())
+		query = "ALTER DATABASE " + pgx.Identifier{name}.Sanitize() + " RENAME TO " + pgx.Identifier{archived}.Sanitize()
+	}
+	if _, err := conn.Exec(ctx, query); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Unable to remove tenant database", struct {
+			Database string
+			Archive  bool
+			Error    error
+		}{Database: name, Archive: archive, Error: err})
+		return err
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant database removed", struct {
+		Database string
+		Archive  bool
+	}{Database: name, Archive: archive})
+	return nil
+}
+
+func tenantAdminURL() string {
+	cfg := config.GetConfig()
+	if cfg.TenantDatabaseAdminURL != "" {
+		return cfg.TenantDatabaseAdminURL
+	}
+	return cfg.PostgresURL
+}
+
+// tenantDSN points adminURL at the database of a tenant. Only URL connection
+// strings are supported, since the database name has to be replaced.
+func tenantDSN(adminURL string, tenantID int) (string, error) {
+	if !strings.HasPrefix(adminURL, "postgres://") && !strings.HasPrefix(adminURL, "postgresql://") {
+		return "", errors.New("tenant databases require a postgres:// connection URL")
+	}
+	u, err := url.Parse(adminURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/" + database.TenantDatabase(tenantID)
+	return u.String(), nil
+}
@@ -0,0 +1,9 @@
+-- Tenant-level tables may live in a dedicated tenant database, so they cannot
+-- reference the shared tables.
+CREATE TABLE IF NOT EXISTS password_policies (
+    tenant_id INT PRIMARY KEY,
+    min_length INT NOT NULL,
+    check_breached BOOLEAN NOT NULL,
+    history_size INT NOT NULL,
+    updated_at TIMESTAMP DEFAULT now()
+);
@@ -0,0 +1,150 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// MoveTenantRowsToDatabases moves the rows of every tenant with a dedicated
+// database from the shared users, credential and role tables into its
+// database. Tenant migration 5 does the same for tenant schemas, but cannot
+// reach the shared database from a dedicated one. Tenants whose rows were
+// moved already are skipped.
+func MoveTenantRowsToDatabases(ctx context.Context, pool *pgxpool.Pool, logger *logrus.Logger) error {
+	tenants, err := models.ListTenantDatabases(pool)
+	if err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		if err := MoveTenantRows(ctx, pool, logger, tenant); err != nil {
+			return fmt.Errorf("moving rows of tenant %d: %w", tenant.ID, err)
+		}
+	}
+	return nil
+}
+
+// MoveTenantRows moves the rows of a tenant with a dedicated database, which
+// must have been migrated, as MoveTenantRowsToDatabases does.
+func MoveTenantRows(ctx context.Context, shared database.DBTX, logger *logrus.Logger, tenant models.Tenant) error {
+	var rows int
+	err := shared.QueryRow(ctx, `
+		SELECT (SELECT count(*) FROM users WHERE tenant_id = $1)
+			+ (SELECT count(*) FROM roles WHERE tenant_id = $1)
+			+ (SELECT count(*) FROM api_keys WHERE tenant_id = $1)`, tenant.ID).Scan(&rows)
+	if err != nil || rows == 0 {
+		return err
+	}
+
+	dsn, err := auth.DecryptSecret(tenant.EncryptedDSN)
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	// Rows keep their IDs, except for roles, whose built-in ones the tenant
+	// database has of its own, so permissions and assignments follow roles by
+	// name. Rows copied by an earlier attempt are skipped.
+	copies := []struct{ query, insert string }{
+		{
+			"SELECT id, tenant_id, username, email, password_hash, created_at, updated_at, last_login, deleted_at FROM users WHERE tenant_id = $1",
+			"INSERT INTO users (id, tenant_id, username, email, password_hash, created_at, updated_at, last_login, deleted_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING",
+		},
+		{
+			"SELECT id, user_id, tenant_id, token_hash, expires_at, created_at, revoked_at FROM refresh_tokens WHERE tenant_id = $1",
+			"INSERT INTO refresh_tokens (id, user_id, tenant_id, token_hash, expires_at, created_at, revoked_at) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING",
+		},
+		{
+			"SELECT id, tenant_id, name, prefix, key_hash, scopes, expires_at, revoked_at, last_used_at, created_at FROM api_keys WHERE tenant_id = $1",
+			"INSERT INTO api_keys (id, tenant_id, name, prefix, key_hash, scopes, expires_at, revoked_at, last_used_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT DO NOTHING",
+		},
+		{
+			"SELECT tenant_id, name, created_at FROM roles WHERE tenant_id = $1",
+			"INSERT INTO roles (tenant_id, name, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		},
+		{
+			"SELECT r.name, rp.permission FROM role_permissions rp JOIN roles r ON r.id = rp.role_id WHERE r.tenant_id = $1",
+			"INSERT INTO role_permissions (role_id, permission) SELECT id, $2::varchar FROM roles WHERE tenant_id IS NOT NULL AND name = $1 ON CONFLICT DO NOTHING",
+		},
+		{
+			`SELECT ur.user_id, r.name, r.tenant_id IS NULL, ur.created_at
+			FROM user_roles ur JOIN users u ON u.id = ur.user_id JOIN roles r ON r.id = ur.role_id
+			WHERE u.tenant_id = $1`,
+			"INSERT INTO user_roles (user_id, role_id, created_at) SELECT $1::int, id, $4::timestamptz FROM roles WHERE name = $2 AND (tenant_id IS NULL) = $3 ON CONFLICT DO NOTHING",
+		},
+	}
+	err = database.InTx(ctx, conn, func(tx pgx.Tx) error {
+		for _, c := range copies {
+			if err := copyRows(ctx, shared, tx, c.query, c.insert, tenant.ID); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"users", "refresh_tokens", "api_keys"} {
+			if _, err := tx.Exec(ctx, fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE(max(id), 0) + 1, false) FROM %[1]s", table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deleting the users also deletes their refresh tokens and roles in the
+	// shared tables.
+	err = database.InTx(ctx, shared, func(tx pgx.Tx) error {
+		for _, table := range []string{"api_keys", "roles", "users"} {
+			if _, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE tenant_id = $1", tenant.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Moved tenant rows to tenant database", struct{ TenantID int }{TenantID: tenant.ID})
+	return nil
+}
+
+// copyRows inserts every row that query returns on from into to with insert,
+// which takes the columns of the row as its parameters.
+func copyRows(ctx context.Context, from database.DBTX, to pgx.Tx, query, insert string, args ...interface{}) error {
+	rows, err := from.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	var values [][]interface{}
+	for rows.Next() {
+		row, err := rows.Values()
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		values = append(values, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range values {
+		if _, err := to.Exec(ctx, insert, row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// CreateTenantSchema creates the schema of a tenant and applies the tenant
+// migrations to it.
+func CreateTenantSchema(ctx context.Context, pool *pgxpool.Pool, logger *logrus.Logger, tenantID int) error {
+	migrator, err := NewTenantMigrator(pool, logger, tenantID)
+	if err != nil {
+		return err
+	}
+	return migrator.Up(ctx, 0)
+}
+
+// MigrateTenantSchemas applies pending tenant migrations to the schemas of all
+// tenants, including soft-deleted ones so that they can be restored.
+func MigrateTenantSchemas(ctx context.Context, pool *pgxpool.Pool, logger *logrus.Logger) error {
+	tenantIDs, err := models.ListTenantIDs(pool)
+	if err != nil {
+		return err
+	}
+	for _, tenantID := range tenantIDs {
+		if err := CreateTenantSchema(ctx, pool, logger, tenantID); err != nil {
+			return fmt.Errorf("migrating schema of tenant %d: %w", tenantID, err)
+		}
+	}
+	return nil
+}
+
+// DropTenantSchema removes the schema of a tenant. With archive set, the
+// schema is renamed to archived_tenant_<id>_<unix time> instead, so its data
+// can still be recovered by hand.
+func DropTenantSchema(ctx context.Context, db database.DBTX, logger *logrus.Logger, tenantID int, archive bool) error {
+	schema := database.TenantSchema(tenantID)
+
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = $1)", schema).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	query := "DROP SCHEMA " + pgx.Identifier{schema}.Sanitize() + " CASCADE"
+	if archive {
+		archived := fmt.Sprintf("archived_%s_%d", schema, time.Now().Unix())
+		query = "ALTER SCHEMA " + pgx.Identifier{schema}.Sanitize() + " RENAME TO " + pgx.Identifier{archived}.Sanitize()
+	}
+	if _, err := db.Exec(ctx, query); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Unable to remove tenant schema", struct {
+			Schema  string
+			Archive bool
+			Error   error
+		}{Schema: schema, Archive: archive, Error: err})
+		return err
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Tenant schema removed", struct {
+		Schema  string
+		Archive bool
+	}{Schema: schema, Archive: archive})
+	return nil
+}
@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"context"
+
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/models"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// SetupTenantStorage creates what a new tenant needs for the tenant isolation
+// mode: a schema in schema mode and a dedicated database in database mode, or
+// whenever dedicated is set.
+func SetupTenantStorage(ctx context.Context, pool *pgxpool.Pool, logger *logrus.Logger, tenant *models.Tenant, dedicated bool) error {
+	if dedicated || database.Isolation() == database.IsolationDatabase {
+		return CreateTenantDatabase(ctx, pool, logger, tenant)
+	}
+	if database.Isolation() == database.IsolationSchema {
+		return CreateTenantSchema(ctx, pool, logger, tenant.ID)
+	}
+	return nil
+}
+
+// RemoveTenantStorage removes the schema and dedicated database of a tenant,
+// or archives them with archive set.
+func RemoveTenantStorage(ctx context.Context, pool *pgxpool.Pool, logger *logrus.Logger, tenant *models.Tenant, archive bool) error {
+	if tenant.HasDatabase() {
+		if err := DropTenantDatabase(ctx, logger, tenant.ID, archive); err != nil {
+			return err
+		}
+	}
+	if database.Isolation() == database.IsolationSchema {
+		return DropTenantSchema(ctx, pool, logger, tenant.ID, archive)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"jatis_mobile_api/database"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type APIKey struct {
+	ID         int        `db:"id"`
+	TenantID   int        `db:"tenant_id"`
+	Name       string     `db:"name"`
+	Prefix     string     `db:"prefix"`
+	KeyHash    string     `db:"key_hash" json:"-"`
+	Scopes     []string   `db:"scopes"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+const apiKeyColumns = "id, tenant_id, name, prefix, key_hash, scopes, expires_at, revoked_at, last_used_at, created_at"
+
+func CreateAPIKey(db database.DBTX, key *APIKey) error {
+	return db.QueryRow(context.Background(),
+		"INSERT INTO api_keys (tenant_id, name, prefix, key_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		key.TenantID, key.Name, key.Prefix, key.KeyHash, key.Scopes, key.ExpiresAt).Scan(&key.ID, &key.CreatedAt)
+}
+
+func ListAPIKeys(db database.DBTX, tenantID int) ([]APIKey, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE tenant_id = $1 ORDER BY id", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func GetAPIKey(db database.DBTX, tenantID, keyID int) (*APIKey, error) {
+	return scanAPIKey(db.QueryRow(context.Background(),
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE tenant_id = $1 AND id = $2", tenantID, keyID))
+}
+
+func GetAPIKeyByPrefix(db database.DBTX, prefix string) (*APIKey, error) {
+	return scanAPIKey(db.QueryRow(context.Background(),
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = $1", prefix))
+}
+
+// RotateAPIKey replaces the secret of an active API key. The previous key
+// stops working immediately.
+func RotateAPIKey(db database.DBTX, key *APIKey) error {
+	return execAffectingOne(db,
+		"UPDATE api_keys SET prefix = $1, key_hash = $2, last_used_at = NULL WHERE tenant_id = $3 AND id = $4 AND revoked_at IS NULL",
+		key.Prefix, key.KeyHash, key.TenantID, key.ID)
+}
+
+func RevokeAPIKey(db database.DBTX, tenantID, keyID int) error {
+	return execAffectingOne(db,
+		"UPDATE api_keys SET revoked_at = NOW() WHERE tenant_id = $1 AND id = $2 AND revoked_at IS NULL", tenantID, keyID)
+}
+
+func TouchAPIKey(db database.DBTX, keyID int) error {
+	_, err := db.Exec(context.Background(), "UPDATE api_keys SET last_used_at = NOW() WHERE id = $1", keyID)
+	return err
+}
+
+func scanAPIKey(row pgx.Row) (*APIKey, error) {
+	var key APIKey
+	err := row.Scan(&key.ID, &key.TenantID, &key.Name, &key.Prefix, &key.KeyHash, &key.Scopes,
+		&key.ExpiresAt, &key.RevokedAt, &key.LastUsedAt, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"context"
+
+	"jatis_mobile_api/database"
+)
+
+// Kinds of credentials in credential_lookups.
+const (
+	CredentialRefreshToken = "refresh_token"
+	CredentialAPIKey       = "api_key"
+)
+
+// AddCredentialLookup records which tenant a refresh token, by its hash, or an
+// API key, by its prefix, belongs to. It must be added before the credential
+// itself, which may live in the storage of the tenant. An API key prefix that
+// is already taken is reported as a unique violation.
+func AddCredentialLookup(db database.DBTX, kind, lookupKey string, tenantID int) error {
+	_, err := db.Exec(context.Background(),
+		"INSERT INTO credential_lookups (kind, lookup_key, tenant_id) VALUES ($1, $2, $3)",
+		kind, lookupKey, tenantID)
+	return err
+}
+
+// GetCredentialTenant returns the ID of the tenant a credential belongs to, or
+// pgx.ErrNoRows for an unknown credential.
+func GetCredentialTenant(db database.DBTX, kind, lookupKey string) (int, error) {
+	var tenantID int
+	err := db.QueryRow(context.Background(),
+		"SELECT tenant_id FROM credential_lookups WHERE kind = $1 AND lookup_key = $2",
+		kind, lookupKey).Scan(&tenantID)
+	return tenantID, err
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"jatis_mobile_api/database"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+const uniqueViolationCode = "23505"
+
+// IsUniqueViolation reports whether err was caused by a unique constraint.
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
+// execAffectingOne runs a statement that must change exactly one row and
+// returns pgx.ErrNoRows when it changed none.
+func execAffectingOne(db database.DBTX, query string, args ...interface{}) error {
+	tag, err := db.Exec(context.Background(), query, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"jatis_mobile_api/database"
+)
+
+type OutboxMessage struct {
+	ID          int64      `db:"id"`
+	Exchange    string     `db:"exchange"`
+	RoutingKey  string     `db:"routing_key"`
+	ContentType string     `db:"content_type"`
+	Body        []byte     `db:"body"`
+	Attempts    int        `db:"attempts"`
+	LastError   *string    `db:"last_error"`
+	AvailableAt time.Time  `db:"available_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	SentAt      *time.Time `db:"sent_at"`
+}
+
+// EnqueueOutboxMessage stores a message for the outbox relay to publish. Pass
+// the transaction of the change the message announces, so that the message
+// exists if and only if the change was committed.
+func EnqueueOutboxMessage(db database.DBTX, message *OutboxMessage) error {
+	if message.ContentType == "" {
+		message.ContentType = "application/json"
+	}
+	return db.QueryRow(context.Background(),
+		"INSERT INTO outbox_messages (exchange, routing_key, content_type, body) VALUES ($1, $2, $3, $4) RETURNING id, available_at, created_at",
+		message.Exchange, message.RoutingKey, message.ContentType, message.Body).Scan(&message.ID, &message.AvailableAt, &message.CreatedAt)
+}
+
+// ClaimOutboxMessages locks up to limit unsent messages that are due, oldest
+// first. Messages locked by another relay are skipped, so it must be called
+// inside a transaction that is held until the messages are marked.
+func ClaimOutboxMessages(db database.DBTX, limit int) ([]OutboxMessage, error) {
+	rows, err := db.Query(context.Background(), `
+		SELECT id, exchange, routing_key, content_type, body, attempts, last_error, available_at, created_at, sent_at
+		FROM outbox_messages
+		WHERE sent_at IS NULL AND available_at <= now()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		var m OutboxMessage
+		if err := rows.Scan(&m.ID, &m.Exchange, &m.RoutingKey, &m.ContentType, &m.Body, &m.Attempts, &m.LastError, &m.AvailableAt, &m.CreatedAt, &m.SentAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func MarkOutboxMessageSent(db database.DBTX, id int64) error {
+	return execAffectingOne(db, "UPDATE outbox_messages SET sent_at = now(), attempts = attempts + 1, last_error = NULL WHERE id = $1", id)
+}
+
+// MarkOutboxMessageFailed records a failed attempt and makes the message due
+// again after retryIn.
+func MarkOutboxMessageFailed(db database.DBTX, id int64, lastError string, retryIn time.Duration) error {
+	return execAffectingOne(db,
+		"UPDATE outbox_messages SET attempts = attempts + 1, last_error = $2, available_at = now() + $3 * interval '1 second' WHERE id = $1",
+		id, lastError, retryIn.Seconds())
+}
+
+// PruneOutboxMessages deletes messages sent longer ago than olderThan and
+// returns how many were deleted.
+func PruneOutboxMessages(db database.DBTX, olderThan time.Duration) (int64, error) {
+	tag, err := db.Exec(context.Background(), "DELETE FROM outbox_messages WHERE sent_at < now() - $1 * interval '1 second'", olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"jatis_mobile_api/database"
+)
+
+type PasswordPolicy struct {
+	TenantID      int       `db:"tenant_id"`
+	MinLength     int       `db:"min_length"`
+	CheckBreached bool      `db:"check_breached"`
+	HistorySize   int       `db:"history_size"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+func GetPasswordPolicy(db database.DBTX, tenantID int) (*PasswordPolicy, error) {
+	var policy PasswordPolicy
+	err := db.QueryRow(context.Background(),
+		"SELECT tenant_id, min_length, check_breached, history_size, updated_at FROM password_policies WHERE tenant_id = $1",
+		tenantID).Scan(&policy.TenantID, &policy.MinLength, &policy.CheckBreached, &policy.HistorySize, &policy.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func UpsertPasswordPolicy(db database.DBTX, policy *PasswordPolicy) error {
+	return db.QueryRow(context.Background(), `
+		INSERT INTO password_policies (tenant_id, min_length, check_breached, history_size, updated_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (tenant_id) DO UPDATE
+		SET min_length = EXCLUDED.min_length, check_breached = EXCLUDED.check_breached,
+			history_size = EXCLUDED.history_size, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at`,
+		policy.TenantID, policy.MinLength, policy.CheckBreached, policy.HistorySize).Scan(&policy.UpdatedAt)
+}
+
+// AddPasswordHistory records a password hash for a user and keeps only the
+// most recent keep entries.
+func AddPasswordHistory(db database.DBTX, userID int, passwordHash string, keep int) error {
+	if keep < 1 {
+		keep = 1
+	}
+	if _, err := db.Exec(context.Background(),
+		"INSERT INTO password_history (user_id, password_hash) VALUES ($1, $2)", userID, passwordHash); err != nil {
+		return err
+	}
+	_, err := db.Exec(context.Background(), `
+		DELETE FROM password_history WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2
+		)`, userID, keep)
+	return err
+}
+
+func GetPasswordHistory(db database.DBTX, userID, limit int) ([]string, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT password_hash FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+func UpdatePasswordHash(db database.DBTX, tenantID, userID int, passwordHash string) error {
+	return execAffectingOne(db, "UPDATE users SET password_hash = $1 WHERE tenant_id = $2 AND id = $3", passwordHash, tenantID, userID)
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"jatis_mobile_api/database"
+)
+
+const (
+	ProvisioningRunning            = "running"
+	ProvisioningCompleted          = "completed"
+	ProvisioningFailed             = "failed"
+	ProvisioningCompensationFailed = "compensation_failed"
+
+	StepPending     = "pending"
+	StepDone        = "done"
+	StepFailed      = "failed"
+	StepCompensated = "compensated"
+)
+
+type ProvisioningRun struct {
+	ID                int                `db:"id"`
+	TenantID          *int               `db:"tenant_id"`
+	TenantName        string             `db:"tenant_name"`
+	DedicatedDatabase bool               `db:"dedicated_database"`
+	Status            string             `db:"status"`
+	Error             *string            `db:"error"`
+	CreatedAt         time.Time          `db:"created_at"`
+	UpdatedAt         time.Time          `db:"updated_at"`
+	Steps             []ProvisioningStep `db:"-"`
+}
+
+type ProvisioningStep struct {
+	Position  int       `db:"position"`
+	Name      string    `db:"name"`
+	Status    string    `db:"status"`
+	Error     *string   `db:"error"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+const provisioningRunColumns = "id, tenant_id, tenant_name, dedicated_database, status, error, created_at, updated_at"
+
+// CreateProvisioningRun records a new run together with its pending steps.
+// Only one unfinished run per tenant name can exist at a time; a second one
+// fails with a unique violation.
+func CreateProvisioningRun(db database.DBTX, run *ProvisioningRun, steps []string) error {
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx,
+		"INSERT INTO tenant_provisioning_runs (tenant_name, dedicated_database, status) VALUES ($1, $2, $3) RETURNING id, created_at, updated_at",
+		run.TenantName, run.DedicatedDatabase, ProvisioningRunning).Scan(&run.ID, &run.CreatedAt, &run.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	run.Status = ProvisioningRunning
+
+	run.Steps = make([]ProvisioningStep, 0, len(steps))
+	for i, name := range steps {
+		step := ProvisioningStep{Position: i + 1, Name: name, Status: StepPending}
+		err := tx.QueryRow(ctx,
+			"INSERT INTO tenant_provisioning_steps (run_id, position, name, status) VALUES ($1, $2, $3, $4) RETURNING updated_at",
+			run.ID, step.Position, step.Name, step.Status).Scan(&step.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		run.Steps = append(run.Steps, step)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetUnfinishedProvisioningRun returns the run for a tenant name that is
+// still running or whose compensation failed, if any.
+func GetUnfinishedProvisioningRun(db database.DBTX, tenantName string) (*ProvisioningRun, error) {
+	return getProvisioningRun(db, "SELECT "+provisioningRunColumns+" FROM tenant_provisioning_runs WHERE tenant_name = $1 AND status IN ('running', 'compensation_failed')", tenantName)
+}
+
+// GetLatestProvisioningRun returns the most recent run of a tenant.
+func GetLatestProvisioningRun(db database.DBTX, tenantID int) (*ProvisioningRun, error) {
+	return getProvisioningRun(db, "SELECT "+provisioningRunColumns+" FROM tenant_provisioning_runs WHERE tenant_id = $1 ORDER BY id DESC LIMIT 1", tenantID)
+}
+
+// ListRunningProvisioningRuns returns the runs that are still running, for
+// example because the process running them stopped.
+func ListRunningProvisioningRuns(db database.DBTX) ([]ProvisioningRun, error) {
+	rows, err := db.Query(context.Background(), "SELECT "+provisioningRunColumns+" FROM tenant_provisioning_runs WHERE status = 'running' ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []ProvisioningRun{}
+	for rows.Next() {
+		var run ProvisioningRun
+		if err := rows.Scan(&run.ID, &run.TenantID, &run.TenantName, &run.DedicatedDatabase, &run.Status, &run.Error, &run.CreatedAt, &run.UpdatedAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func getProvisioningRun(db database.DBTX, query string, arg interface{}) (*ProvisioningRun, error) {
+	var run ProvisioningRun
+	err := db.QueryRow(context.Background(), query, arg).Scan(
+		&run.ID, &run.TenantID, &run.TenantName, &run.DedicatedDatabase, &run.Status, &run.Error, &run.CreatedAt, &run.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Steps, err = GetProvisioningSteps(db, run.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// GetProvisioningSteps returns the steps of a run in execution order.
+func GetProvisioningSteps(db database.DBTX, runID int) ([]ProvisioningStep, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT position, name, status, error, updated_at FROM tenant_provisioning_steps WHERE run_id = $1 ORDER BY position", runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []ProvisioningStep{}
+	for rows.Next() {
+		var step ProvisioningStep
+		if err := rows.Scan(&step.Position, &step.Name, &step.Status, &step.Error, &step.UpdatedAt); err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
+
+func SetProvisioningRunTenant(db database.DBTX, runID int, tenantID int) error {
+	return execAffectingOne(db, "UPDATE tenant_provisioning_runs SET tenant_id = $1, updated_at = NOW() WHERE id = $2", tenantID, runID)
+}
+
+func SetProvisioningRunStatus(db database.DBTX, runID int, status string, runErr *string) error {
+	return execAffectingOne(db, "UPDATE tenant_provisioning_runs SET status = $1, error = $2, updated_at = NOW() WHERE id = $3", status, runErr, runID)
+}
+
+func SetProvisioningStepStatus(db database.DBTX, runID int, name string, status string, stepErr *string) error {
+	return execAffectingOne(db, "UPDATE tenant_provisioning_steps SET status = $1, error = $2, updated_at = NOW() WHERE run_id = $3 AND name = $4", status, stepErr, runID, name)
+}
@@ -0,0 +1,312 @@
+package models
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"jatis_mobile_api/database"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// QueueMessage is a message of a queue of the Postgres message broker.
+type QueueMessage struct {
+	ID          int64                  `db:"id"`
+	Queue       string                 `db:"queue"`
+	MessageID   string                 `db:"message_id"`
+	Type        string                 `db:"type"`
+	ContentType string                 `db:"content_type"`
+	Headers     map[string]interface{} `db:"headers"`
+	Body        []byte                 `db:"body"`
+	Retries     int                    `db:"retries"`
+	Deliveries  int                    `db:"deliveries"`
+	DeadReason  *string                `db:"dead_reason"`
+	CreatedAt   time.Time              `db:"created_at"`
+}
+
+const queueMessageColumns = "id, queue, message_id, type, content_type, headers, body, retries, deliveries, dead_reason, created_at"
+
+func scanQueueMessages(rows pgx.Rows) ([]QueueMessage, error) {
+	defer rows.Close()
+
+	var messages []QueueMessage
+	for rows.Next() {
+		var m QueueMessage
+		if err := rows.Scan(&m.ID, &m.Queue, &m.MessageID, &m.Type, &m.ContentType, &m.Headers, &m.Body, &m.Retries, &m.Deliveries, &m.DeadReason, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// CreateQueue creates a queue and the partition of queue_messages that holds
+// its messages and those of its dead-letter queue. Creating an existing queue
+// does nothing.
+func CreateQueue(db database.DBTX, name, deadLetterQueue string) error {
+	sum := md5.Sum([]byte(name))
+	partition := "queue_messages_" + hex.EncodeToString(sum[:])
+
+	var ddl string
+	err := db.QueryRow(context.Background(),
+		"SELECT format('CREATE TABLE IF NOT EXISTS %I PARTITION OF queue_messages FOR VALUES IN (%L, %L)', $1::text, $2::text, $3::text)",
+		partition, name, deadLetterQueue).Scan(&ddl)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(context.Background(), ddl); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(context.Background(),
+		"INSERT INTO queues (name, dead_letter_queue, partition_name) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING",
+		name, deadLetterQueue, partition)
+	return err
+}
+
+// QueueExists reports whether a queue or dead-letter queue exists.
+func QueueExists(db database.DBTX, name string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM queues WHERE name = $1 OR dead_letter_queue = $1)", name).Scan(&exists)
+	return exists, err
+}
+
+// DeleteQueue drops a queue with its dead-letter queue and bindings and
+// returns the number of ready messages it held. Deleting a queue that does not
+// exist returns pgx.ErrNoRows.
+func DeleteQueue(db database.DBTX, name string) (int, error) {
+	var partition string
+	err := db.QueryRow(context.Background(), "SELECT partition_name FROM queues WHERE name = $1", name).Scan(&partition)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := CountQueueMessages(db, name)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(context.Background(), "DROP TABLE IF EXISTS "+pgx.Identifier{partition}.Sanitize()); err != nil {
+		return 0, err
+	}
+	_, err = db.Exec(context.Background(), "DELETE FROM queues WHERE name = $1", name)
+	return count, err
+}
+
+func BindQueue(db database.DBTX, queue, exchange, routingKey string) error {
+	_, err := db.Exec(context.Background(),
+		"INSERT INTO queue_bindings (exchange, routing_key, queue) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		exchange, routingKey, queue)
+	return err
+}
+
+func UnbindQueue(db database.DBTX, queue, exchange, routingKey string) error {
+	_, err := db.Exec(context.Background(),
+		"DELETE FROM queue_bindings WHERE exchange = $1 AND routing_key = $2 AND queue = $3",
+		exchange, routingKey, queue)
+	return err
+}
+
+// PublishQueueMessage stores a copy of the message in every queue the routing
+// key is bound to on the exchange, or with the empty default exchange in the
+// queue named by the routing key. It returns the number of queues the message
+// was routed to.
+func PublishQueueMessage(db database.DBTX, exchange, routingKey string, message QueueMessage) (int, error) {
+	if message.Headers == nil {
+		message.Headers = map[string]interface{}{}
+	}
+	tag, err := db.Exec(context.Background(), `
+		INSERT INTO queue_messages (queue, message_id, type, content_type, headers, body)
+		SELECT queue, $3::text, $4::text, $5::text, $6::jsonb, $7::bytea FROM (
+			SELECT name AS queue FROM queues WHERE $1 = '' AND name = $2
+			UNION
+			SELECT queue FROM queue_bindings WHERE exchange = $1 AND routing_key = $2
+		) targets`,
+		exchange, routingKey, message.MessageID, message.Type, message.ContentType, message.Headers, message.Body)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// NotifyQueue wakes the consumers of a queue, for messages that became ready
+// without being inserted.
+func NotifyQueue(db database.DBTX, queue string) error {
+	_, err := db.Exec(context.Background(), "SELECT pg_notify('queue_messages', $1)", queue)
+	return err
+}
+
+// ClaimQueueMessages locks up to limit due messages of a queue for owner,
+// oldest first, until lockFor has passed. Messages locked by another
+// consumer are skipped.
+func ClaimQueueMessages(db database.DBTX, queue, owner string, limit int, lockFor time.Duration) ([]QueueMessage, error) {
+	rows, err := db.Query(context.Background(), `
+		UPDATE queue_messages
+		SET deliveries = deliveries + 1, locked_by = $2, locked_until = now() + $4 * interval '1 second'
+		WHERE queue = $1 AND id IN (
+			SELECT id FROM queue_messages
+			WHERE queue = $1 AND available_at <= now() AND (locked_until IS NULL OR locked_until < now())
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+queueMessageColumns,
+		queue, owner, limit, lockFor.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanQueueMessages(rows)
+}
+
+// ExtendQueueMessageLocks keeps the messages locked by owner locked until
+// lockFor has passed.
+func ExtendQueueMessageLocks(db database.DBTX, owner string, lockFor time.Duration) error {
+	_, err := db.Exec(context.Background(),
+		"UPDATE queue_messages SET locked_until = now() + $2 * interval '1 second' WHERE locked_by = $1",
+		owner, lockFor.Seconds())
+	return err
+}
+
+// ReleaseQueueMessageLocks unlocks the messages locked by owner, so that they
+// are delivered again.
+func ReleaseQueueMessageLocks(db database.DBTX, owner string) error {
+	_, err := db.Exec(context.Background(),
+		"UPDATE queue_messages SET locked_by = NULL, locked_until = NULL WHERE locked_by = $1",
+		owner)
+	return err
+}
+
+// DeadLetterUndeliverableMessages moves the due messages of a queue that were
+// delivered deliveryLimit times without being settled to its dead-letter
+// queue and returns how many were moved.
+func DeadLetterUndeliverableMessages(db database.DBTX, queue, deadLetterQueue string, deliveryLimit int) (int64, error) {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE queue_messages
+		SET queue = $2, dead_reason = COALESCE(dead_reason, 'delivery_limit'), locked_by = NULL, locked_until = NULL, available_at = now()
+		WHERE queue = $1 AND deliveries >= $3 AND available_at <= now() AND (locked_until IS NULL OR locked_until < now())`,
+		queue, deadLetterQueue, deliveryLimit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// AckQueueMessage deletes a message locked by owner. It returns pgx.ErrNoRows
+// when owner lost the lock.
+func AckQueueMessage(db database.DBTX, queue string, id int64, owner string) error {
+	return execAffectingOne(db, "DELETE FROM queue_messages WHERE queue = $1 AND id = $2 AND locked_by = $3", queue, id, owner)
+}
+
+// ReleaseQueueMessage unlocks a message locked by owner, so that it is
+// delivered again.
+func ReleaseQueueMessage(db database.DBTX, queue string, id int64, owner string) error {
+	return execAffectingOne(db,
+		"UPDATE queue_messages SET locked_by = NULL, locked_until = NULL WHERE queue = $1 AND id = $2 AND locked_by = $3",
+		queue, id, owner)
+}
+
+// RetryQueueMessage unlocks a message locked by owner, counts a retry and
+// makes it due again after retryIn.
+func RetryQueueMessage(db database.DBTX, queue string, id int64, owner string, retryIn time.Duration) error {
+	return execAffectingOne(db, `
+		UPDATE queue_messages
+		SET retries = retries + 1, deliveries = 0, locked_by = NULL, locked_until = NULL, available_at = now() + $4 * interval '1 second'
+		WHERE queue = $1 AND id = $2 AND locked_by = $3`,
+		queue, id, owner, retryIn.Seconds())
+}
+
+// DeadLetterQueueMessage moves a message locked by owner to a dead-letter
+// queue, keeping the reason it was first dead-lettered for.
+func DeadLetterQueueMessage(db database.DBTX, queue string, id int64, owner, deadLetterQueue, reason string) error {
+	return execAffectingOne(db, `
+		UPDATE queue_messages
+		SET queue = $4, dead_reason = COALESCE(dead_reason, $5), locked_by = NULL, locked_until = NULL, available_at = now()
+		WHERE queue = $1 AND id = $2 AND locked_by = $3`,
+		queue, id, owner, deadLetterQueue, reason)
+}
+
+// MoveQueueMessages moves the messages of a queue that are not locked to
+// another queue and returns how many were moved.
+func MoveQueueMessages(db database.DBTX, fromQueue, toQueue string) (int64, error) {
+	tag, err := db.Exec(context.Background(),
+		"UPDATE queue_messages SET queue = $2 WHERE queue = $1 AND (locked_until IS NULL OR locked_until < now())",
+		fromQueue, toQueue)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// CountQueueMessages returns the number of due messages of a queue that are
+// not locked.
+func CountQueueMessages(db database.DBTX, queue string) (int, error) {
+	var count int
+	err := db.QueryRow(context.Background(),
+		"SELECT count(*) FROM queue_messages WHERE queue = $1 AND available_at <= now() AND (locked_until IS NULL OR locked_until < now())",
+		queue).Scan(&count)
+	return count, err
+}
+
+// ListQueueMessages returns up to limit messages of a queue, oldest first,
+// without locking them.
+func ListQueueMessages(db database.DBTX, queue string, limit int) ([]QueueMessage, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT "+queueMessageColumns+" FROM queue_messages WHERE queue = $1 ORDER BY id LIMIT $2",
+		queue, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanQueueMessages(rows)
+}
+
+// RequeueQueueMessages moves messages of a queue that are not locked to
+// another queue as new messages, without their retry count and dead-letter
+// reason. Messages are selected by message ID, or all when messageIDs is
+// empty, up to limit messages when limit is positive, oldest first.
+func RequeueQueueMessages(db database.DBTX, fromQueue, toQueue string, messageIDs []string, limit int) (int64, error) {
+	tag, err := db.Exec(context.Background(), `
+		UPDATE queue_messages
+		SET queue = $4, retries = 0, deliveries = 0, dead_reason = NULL, available_at = now()
+		WHERE queue = $1 AND id IN (`+selectQueueMessageIDs+`)`,
+		fromQueue, messageIDs, queueMessageLimit(limit), toQueue)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeleteQueueMessages deletes messages of a queue selected like
+// RequeueQueueMessages.
+func DeleteQueueMessages(db database.DBTX, queue string, messageIDs []string, limit int) (int64, error) {
+	tag, err := db.Exec(context.Background(), `
+		DELETE FROM queue_messages
+		WHERE queue = $1 AND id IN (`+selectQueueMessageIDs+`)`,
+		queue, messageIDs, queueMessageLimit(limit))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+const selectQueueMessageIDs = `
+	SELECT id FROM queue_messages
+	WHERE queue = $1 AND (COALESCE(cardinality($2::text[]), 0) = 0 OR message_id = ANY($2))
+		AND (locked_until IS NULL OR locked_until < now())
+	ORDER BY id
+	LIMIT $3
+	FOR UPDATE SKIP LOCKED`
+
+// queueMessageLimit returns the LIMIT argument for limit; NULL means no
+// limit.
+func queueMessageLimit(limit int) *int {
+	if limit <= 0 {
+		return nil
+	}
+	return &limit
+}
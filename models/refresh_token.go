@@ -0,0 +1,48 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"jatis_mobile_api/database"
+)
+
+type RefreshToken struct {
+	ID        int        `db:"id"`
+	UserID    int        `db:"user_id"`
+	TenantID  int        `db:"tenant_id"`
+	TokenHash string     `db:"token_hash"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+func CreateRefreshToken(db database.DBTX, token *RefreshToken) error {
+	err := db.QueryRow(context.Background(),
+		"INSERT INTO refresh_tokens (user_id, tenant_id, token_hash, expires_at) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		token.UserID, token.TenantID, token.TokenHash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	return err
+}
+
+func GetRefreshTokenByHash(db database.DBTX, tokenHash string) (*RefreshToken, error) {
+	var token RefreshToken
+	err := db.QueryRow(context.Background(),
+		"SELECT id, user_id, tenant_id, token_hash, expires_at, created_at, revoked_at FROM refresh_tokens WHERE token_hash = $1",
+		tokenHash).Scan(&token.ID, &token.UserID, &token.TenantID, &token.TokenHash, &token.ExpiresAt, &token.CreatedAt, &token.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RevokeRefreshToken revokes a token that has not been revoked yet. It returns
+// pgx.ErrNoRows if the token was already revoked, which lets callers detect a
+// refresh token being used twice.
+func RevokeRefreshToken(db database.DBTX, tokenID int) error {
+	return execAffectingOne(db, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", tokenID)
+}
+
+func RevokeUserRefreshTokens(db database.DBTX, userID int) error {
+	_, err := db.Exec(context.Background(), "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	return err
+}
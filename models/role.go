@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"jatis_mobile_api/database"
+)
+
+// Role is either a built-in role, which has no tenant, or a custom role of a
+// single tenant.
+type Role struct {
+	ID          int       `db:"id"`
+	TenantID    *int      `db:"tenant_id"`
+	Name        string    `db:"name"`
+	Permissions []string  `db:"-"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+func CreateRole(db database.DBTX, role *Role) error {
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, "INSERT INTO roles (tenant_id, name) VALUES ($1, $2) RETURNING id, created_at",
+		role.TenantID, role.Name).Scan(&role.ID, &role.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, permission := range role.Permissions {
+		if _, err := tx.Exec(ctx, "INSERT INTO role_permissions (role_id, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			role.ID, permission); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ListRoles returns the built-in roles followed by the custom roles of a
+// tenant, with the permissions of custom roles filled in.
+func ListRoles(db database.DBTX, tenantID int) ([]Role, error) {
+	rows, err := db.Query(context.Background(), `
+		SELECT r.id, r.tenant_id, r.name, r.created_at, COALESCE(array_agg(rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		WHERE r.tenant_id IS NULL OR r.tenant_id = $1
+		GROUP BY r.id
+		ORDER BY r.tenant_id NULLS FIRST, r.id`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.TenantID, &role.Name, &role.CreatedAt, &role.Permissions); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// GetRole returns a built-in role or a custom role of the given tenant.
+func GetRole(db database.DBTX, tenantID, roleID int) (*Role, error) {
+	var role Role
+	err := db.QueryRow(context.Background(),
+		"SELECT id, tenant_id, name, created_at FROM roles WHERE id = $1 AND (tenant_id IS NULL OR tenant_id = $2)",
+		roleID, tenantID).Scan(&role.ID, &role.TenantID, &role.Name, &role.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func GetRoleByName(db database.DBTX, tenantID int, name string) (*Role, error) {
+	var role Role
+	err := db.QueryRow(context.Background(),
+		"SELECT id, tenant_id, name, created_at FROM roles WHERE name = $1 AND (tenant_id IS NULL OR tenant_id = $2) ORDER BY tenant_id NULLS FIRST LIMIT 1",
+		name, tenantID).Scan(&role.ID, &role.TenantID, &role.Name, &role.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// DeleteRole deletes a custom role of a tenant together with its permissions
+// and assignments, which tenant schemas and databases do not delete by
+// foreign key. Built-in roles cannot be deleted.
+func DeleteRole(db database.DBTX, tenantID, roleID int) error {
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := execAffectingOne(tx, "DELETE FROM roles WHERE id = $1 AND tenant_id = $2", roleID, tenantID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM role_permissions WHERE role_id = $1", roleID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM user_roles WHERE role_id = $1", roleID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func AssignRole(db database.DBTX, userID, roleID int) error {
+	_, err := db.Exec(context.Background(), "INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, roleID)
+	return err
+}
+
+func UnassignRole(db database.DBTX, userID, roleID int) error {
+	return execAffectingOne(db, "DELETE FROM user_roles WHERE user_id = $1 AND role_id = $2", userID, roleID)
+}
+
+func GetUserRoles(db database.DBTX, userID int) ([]Role, error) {
+	rows, err := db.Query(context.Background(), `
+		SELECT r.id, r.tenant_id, r.name, r.created_at
+		FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = $1
+		ORDER BY r.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.TenantID, &role.Name, &role.CreatedAt); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// GetCustomRolePermissions returns the permissions granted by the named custom
+// roles of a tenant.
+func GetCustomRolePermissions(db database.DBTX, tenantID int, roleNames []string) ([]string, error) {
+	rows, err := db.Query(context.Background(), `
+		SELECT DISTINCT rp.permission
+		FROM roles r
+		JOIN role_permissions rp ON rp.role_id = r.id
+		WHERE r.tenant_id = $1 AND r.name = ANY($2)`, tenantID, roleNames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []string
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
@@ -2,21 +2,199 @@ package models
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"jatis_mobile_api/database"
 
 	"github.com/jackc/pgx/v4"
 )
 
 type Tenant struct {
-	ID   int    `db:"id"`
-	Name string `db:"name"`
+	ID        int        `db:"id"`
+	Name      string     `db:"name"`
+	CreatedAt time.Time  `db:"created_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
+	// EncryptedDSN is the connection string of the dedicated database of the
+	// tenant, if it has one, encrypted with auth.EncryptSecret.
+	EncryptedDSN []byte `db:"encrypted_dsn" json:"-"`
+}
+
+func (t *Tenant) HasDatabase() bool {
+	return len(t.EncryptedDSN) > 0
+}
+
+type TenantFilter struct {
+	NamePrefix     string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	IncludeDeleted bool
+	AfterID        int
+	Limit          int
 }
 
-func CreateTenant(db *pgx.Conn, tenant *Tenant) error {
-	err := db.QueryRow(context.Background(), "INSERT INTO tenants (name) VALUES ($1) RETURNING id", tenant.Name).Scan(&tenant.ID)
+const tenantColumns = "id, name, created_at, deleted_at, encrypted_dsn"
+
+func CreateTenant(db database.DBTX, tenant *Tenant) error {
+	err := db.QueryRow(context.Background(), "INSERT INTO tenants (name) VALUES ($1) RETURNING id, created_at", tenant.Name).Scan(&tenant.ID, &tenant.CreatedAt)
 	return err
 }
 
-func SoftDeleteTenant(db *pgx.Conn, tenantID int) error {
+func SoftDeleteTenant(db database.DBTX, tenantID int) error {
 	_, err := db.Exec(context.Background(), "UPDATE tenants SET deleted_at = NOW() WHERE id = $1", tenantID)
 	return err
 }
+
+func RestoreTenant(db database.DBTX, tenantID int) error {
+	_, err := db.Exec(context.Background(), "UPDATE tenants SET deleted_at = NULL WHERE id = $1", tenantID)
+	return err
+}
+
+// PurgeTenant physically removes a soft-deleted tenant. Tenant-owned rows in
+// other tables are removed by their ON DELETE CASCADE foreign keys.
+func PurgeTenant(db database.DBTX, tenantID int) error {
+	return execAffectingOne(db, "DELETE FROM tenants WHERE id = $1 AND deleted_at IS NOT NULL", tenantID)
+}
+
+// DeleteTenant physically removes a tenant regardless of whether it was
+// soft-deleted. It is only meant to undo a tenant that failed provisioning.
+func DeleteTenant(db database.DBTX, tenantID int) error {
+	return execAffectingOne(db, "DELETE FROM tenants WHERE id = $1", tenantID)
+}
+
+func RenameTenant(db database.DBTX, tenantID int, name string) error {
+	return execAffectingOne(db, "UPDATE tenants SET name = $1 WHERE id = $2 AND deleted_at IS NULL", name, tenantID)
+}
+
+func SetTenantDSN(db database.DBTX, tenantID int, encryptedDSN []byte) error {
+	return execAffectingOne(db, "UPDATE tenants SET encrypted_dsn = $1 WHERE id = $2", encryptedDSN, tenantID)
+}
+
+func GetTenantByID(db database.DBTX, tenantID int, includeDeleted bool) (*Tenant, error) {
+	query := "SELECT " + tenantColumns + " FROM tenants WHERE id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	return scanTenant(db.QueryRow(context.Background(), query, tenantID))
+}
+
+func GetTenantByName(db database.DBTX, name string, includeDeleted bool) (*Tenant, error) {
+	query := "SELECT " + tenantColumns + " FROM tenants WHERE name = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	return scanTenant(db.QueryRow(context.Background(), query, name))
+}
+
+// ListTenants returns tenants ordered by id, starting after filter.AfterID.
+// It fetches one extra row so callers can tell whether another page exists.
+func ListTenants(db database.DBTX, filter TenantFilter) ([]Tenant, bool, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+
+	if filter.AfterID > 0 {
+		addCondition("id > $%d", filter.AfterID)
+	}
+	if filter.NamePrefix != "" {
+		addCondition(`name LIKE $%d ESCAPE '\'`, escapeLike(filter.NamePrefix)+"%")
+	}
+	if filter.CreatedAfter != nil {
+		addCondition("created_at >= $%d", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		addCondition("created_at < $%d", *filter.CreatedBefore)
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+
+	query := "SELECT " + tenantColumns + " FROM tenants"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit+1)
+	query += fmt.Sprintf(" ORDER BY id LIMIT $%d", len(args))
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		var tenant Tenant
+		if err := rows.Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt, &tenant.DeletedAt, &tenant.EncryptedDSN); err != nil {
+			return nil, false, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(tenants) > filter.Limit
+	if hasMore {
+		tenants = tenants[:filter.Limit]
+	}
+	return tenants, hasMore, nil
+}
+
+// ListTenantIDs returns the IDs of all tenants, including deleted ones.
+func ListTenantIDs(db database.DBTX) ([]int, error) {
+	rows, err := db.Query(context.Background(), "SELECT id FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ListTenantDatabases returns all tenants with a dedicated database,
+// including deleted ones.
+func ListTenantDatabases(db database.DBTX) ([]Tenant, error) {
+	rows, err := db.Query(context.Background(), "SELECT "+tenantColumns+" FROM tenants WHERE encrypted_dsn IS NOT NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		tenant, err := scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, *tenant)
+	}
+	return tenants, rows.Err()
+}
+
+func scanTenant(row pgx.Row) (*Tenant, error) {
+	var tenant Tenant
+	if err := row.Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt, &tenant.DeletedAt, &tenant.EncryptedDSN); err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+func escapeLike(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(value)
+}
@@ -2,8 +2,11 @@ package models
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"jatis_mobile_api/database"
+
 	"github.com/jackc/pgx/v4"
 )
 
@@ -12,32 +15,101 @@ type User struct {
 	TenantID     int        `db:"tenant_id"`
 	Username     string     `db:"username"`
 	Email        string     `db:"email"`
-	PasswordHash string     `db:"password_hash"`
+	PasswordHash string     `db:"password_hash" json:"-"`
 	CreatedAt    time.Time  `db:"created_at"`
 	UpdatedAt    time.Time  `db:"updated_at"`
 	LastLogin    *time.Time `db:"last_login"`
+	DeletedAt    *time.Time `db:"deleted_at"`
+}
+
+type UserFilter struct {
+	IncludeDeleted bool
+	AfterID        int
+	Limit          int
 }
 
-func CreateUser(db *pgx.Conn, user *User) error {
+const userColumns = "id, tenant_id, username, email, password_hash, created_at, updated_at, last_login, deleted_at"
+
+func CreateUser(db database.DBTX, user *User) error {
 	err := db.QueryRow(context.Background(),
-		"INSERT INTO users (username, tenant_id, email, password_hash, created_at, updated_at) VALUES ($1, $2, $3, $4, NOW(), NOW()) RETURNING id",
-		user.Username, user.TenantID, user.Email, user.PasswordHash).Scan(&user.ID)
+		"INSERT INTO users (username, tenant_id, email, password_hash, created_at, updated_at) VALUES ($1, $2, $3, $4, NOW(), NOW()) RETURNING id, created_at, updated_at",
+		user.Username, user.TenantID, user.Email, user.PasswordHash).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
 	return err
 }
 
-func SoftDeleteUser(db *pgx.Conn, userID int) error {
-	_, err := db.Exec(context.Background(), "UPDATE users SET deleted_at = NOW() WHERE id = $1", userID)
-	return err
+func GetUserByEmail(db database.DBTX, tenantID int, email string) (*User, error) {
+	return scanUser(db.QueryRow(context.Background(),
+		"SELECT "+userColumns+" FROM users WHERE tenant_id = $1 AND email = $2 AND deleted_at IS NULL",
+		tenantID, email))
 }
 
-func UpdateUser(db *pgx.Conn, user *User) error {
-	_, err := db.Exec(context.Background(),
-		"UPDATE users SET username = $1, email = $2, password_hash = $3, updated_at = NOW() WHERE id = $4",
-		user.Username, user.Email, user.PasswordHash, user.ID)
-	return err
+func GetUserByID(db database.DBTX, tenantID, userID int, includeDeleted bool) (*User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE tenant_id = $1 AND id = $2"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	return scanUser(db.QueryRow(context.Background(), query, tenantID, userID))
 }
 
-func SetLastLogin(db *pgx.Conn, userID int) error {
-	_, err := db.Exec(context.Background(), "UPDATE users SET last_login = NOW() WHERE id = $1", userID)
+// ListUsers returns the users of a tenant ordered by id, starting after
+// filter.AfterID, and whether another page exists.
+func ListUsers(db database.DBTX, tenantID int, filter UserFilter) ([]User, bool, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE tenant_id = $1 AND id > $2"
+	if !filter.IncludeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	query += fmt.Sprintf(" ORDER BY id LIMIT %d", filter.Limit+1)
+
+	rows, err := db.Query(context.Background(), query, tenantID, filter.AfterID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(users) > filter.Limit
+	if hasMore {
+		users = users[:filter.Limit]
+	}
+	return users, hasMore, nil
+}
+
+func SoftDeleteUser(db database.DBTX, tenantID, userID int) error {
+	return execAffectingOne(db, "UPDATE users SET deleted_at = NOW() WHERE tenant_id = $1 AND id = $2 AND deleted_at IS NULL", tenantID, userID)
+}
+
+func RestoreUser(db database.DBTX, tenantID, userID int) error {
+	return execAffectingOne(db, "UPDATE users SET deleted_at = NULL, updated_at = NOW() WHERE tenant_id = $1 AND id = $2 AND deleted_at IS NOT NULL", tenantID, userID)
+}
+
+func UpdateUser(db database.DBTX, user *User) error {
+	return db.QueryRow(context.Background(),
+		"UPDATE users SET username = $1, email = $2, password_hash = $3, updated_at = NOW() WHERE tenant_id = $4 AND id = $5 AND deleted_at IS NULL RETURNING updated_at",
+		user.Username, user.Email, user.PasswordHash, user.TenantID, user.ID).Scan(&user.UpdatedAt)
+}
+
+func SetLastLogin(db database.DBTX, tenantID, userID int) error {
+	_, err := db.Exec(context.Background(), "UPDATE users SET last_login = NOW() WHERE id = $1 AND tenant_id = $2", userID, tenantID)
 	return err
 }
+
+func scanUser(row pgx.Row) (*User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.TenantID, &user.Username, &user.Email, &user.PasswordHash,
+		&user.CreatedAt, &user.UpdatedAt, &user.LastLogin, &user.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
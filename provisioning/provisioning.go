@@ -0,0 +1,373 @@
+// Package provisioning creates tenants as a sequence of recorded steps across
+// PostgreSQL and RabbitMQ. When a step fails, the steps done so far are undone
+// in reverse order, so that a failed tenant leaves nothing behind and can
+// simply be created again.
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"jatis_mobile_api/broker"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/migrations"
+	"jatis_mobile_api/models"
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrTenantExists = errors.New("tenant already exists")
+	ErrInProgress   = errors.New("tenant provisioning is already in progress")
+)
+
+// StepError is returned when a run failed at a step.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("provisioning step %s failed: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// state is shared by the steps of one run.
+type state struct {
+	run    *models.ProvisioningRun
+	tenant *models.Tenant
+	logger *logrus.Logger
+	broker broker.Broker
+}
+
+// step is one provisioning step. Both functions must be idempotent, since a
+// run is resumed from the first step that is not done, and undo is also
+// called for the step that failed, which may have partially succeeded.
+type step struct {
+	name string
+	do   func(ctx context.Context, s *state) error
+	undo func(ctx context.Context, s *state) error
+}
+
+var steps = []step{
+	{name: "create_tenant", do: createTenantRow, undo: deleteTenantRow},
+	{name: "create_storage", do: createStorage, undo: removeStorage},
+	{name: "declare_queue", do: declareQueue, undo: deleteQueue},
+	{name: "bind_queue", do: bindQueue, undo: unbindQueue},
+	{name: "enqueue_created", do: enqueueCreated},
+}
+
+func stepNames() []string {
+	names := make([]string, len(steps))
+	for i, s := range steps {
+		names[i] = s.name
+	}
+	return names
+}
+
+// ProvisionTenant creates a tenant, resuming the unfinished run for the same
+// name if there is one, so that retrying after a crash or a failed
+// compensation is safe. It returns the run, with the status of every step,
+// also when provisioning fails.
+func ProvisionTenant(ctx context.Context, logger *logrus.Logger, b broker.Broker, name string, dedicatedDatabase bool) (*models.Tenant, *models.ProvisioningRun, error) {
+	db := database.SystemDB()
+
+	run, err := models.GetUnfinishedProvisioningRun(db, name)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, err
+	}
+
+	if run != nil && run.Status == models.ProvisioningCompensationFailed {
+		// Finish undoing the earlier attempt before starting a new one.
+		if _, err := execute(ctx, logger, b, run); err != nil {
+			return nil, run, err
+		}
+		run = nil
+	}
+
+	if run == nil {
+		if _, err := models.GetTenantByName(db, name, true); err == nil {
+			return nil, nil, ErrTenantExists
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, err
+		}
+
+		run = &models.ProvisioningRun{TenantName: name, DedicatedDatabase: dedicatedDatabase}
+		if err := models.CreateProvisioningRun(db, run, stepNames()); err != nil {
+			if models.IsUniqueViolation(err) {
+				return nil, nil, ErrInProgress
+			}
+			return nil, nil, err
+		}
+	}
+
+	tenant, err := execute(ctx, logger, b, run)
+	return tenant, run, err
+}
+
+// ResumeRunning resumes runs left running by a process that stopped, so that
+// their tenants are either completed or undone.
+func ResumeRunning(ctx context.Context, logger *logrus.Logger, b broker.Broker) {
+	runs, err := models.ListRunningProvisioningRuns(database.SystemDB())
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to list unfinished provisioning runs", struct{ Error error }{Error: err})
+		return
+	}
+	for i := range runs {
+		if _, err := execute(ctx, logger, b, &runs[i]); err != nil && !errors.Is(err, ErrInProgress) {
+			logs.LogWithFields(logger, logrus.WarnLevel, "Resumed provisioning run failed", struct {
+				RunID      int
+				TenantName string
+				Error      error
+			}{RunID: runs[i].ID, TenantName: runs[i].TenantName, Error: err})
+		}
+	}
+}
+
+// execute runs the pending steps of a run while holding an advisory lock on
+// it, so that two instances never work on the same run. A run whose
+// compensation failed is only compensated again.
+func execute(ctx context.Context, logger *logrus.Logger, b broker.Broker, run *models.ProvisioningRun) (*models.Tenant, error) {
+	db := database.SystemDB()
+
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	lockKey := fmt.Sprintf("tenant_provisioning:%d", run.ID)
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", lockKey).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrInProgress
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", lockKey)
+
+	// Reload the run now that it is locked, since another instance may have
+	// finished it in the meantime.
+	current, err := models.GetUnfinishedProvisioningRun(db, run.TenantName)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && current.ID != run.ID) {
+		return nil, ErrInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	*run = *current
+	if len(run.Steps) != len(steps) {
+		return nil, fmt.Errorf("provisioning run %d has %d steps, expected %d", run.ID, len(run.Steps), len(steps))
+	}
+
+	s := &state{run: run, logger: logger, broker: b}
+	if run.TenantID != nil {
+		s.tenant, err = models.GetTenantByID(db, *run.TenantID, true)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	failedAt := len(steps)
+	var stepErr error
+	if run.Status == models.ProvisioningCompensationFailed {
+		failedAt = len(steps) - 1
+	} else {
+		for i, st := range steps {
+			if run.Steps[i].Status == models.StepDone {
+				continue
+			}
+			if err := st.do(ctx, s); err != nil {
+				failedAt, stepErr = i, &StepError{Step: st.name, Err: err}
+				setStepStatus(logger, run, i, models.StepFailed, err)
+				break
+			}
+			setStepStatus(logger, run, i, models.StepDone, nil)
+		}
+	}
+
+	if stepErr == nil && run.Status != models.ProvisioningCompensationFailed {
+		setRunStatus(logger, run, models.ProvisioningCompleted, nil)
+		logs.LogWithFields(logger, logrus.InfoLevel, "Tenant provisioned", struct{ TenantName string }{TenantName: run.TenantName})
+		return s.tenant, nil
+	}
+
+	if err := compensate(ctx, s, failedAt); err != nil {
+		setRunStatus(logger, run, models.ProvisioningCompensationFailed, err)
+		if stepErr == nil {
+			stepErr = err
+		}
+		return nil, stepErr
+	}
+	if stepErr == nil {
+		stepErr = errors.New(derefError(run.Error))
+	}
+	setRunStatus(logger, run, models.ProvisioningFailed, stepErr)
+	return nil, stepErr
+}
+
+// compensate undoes the steps up to and including the one at index last that
+// were started, newest first. It stops at the first step that cannot be
+// undone, leaving the earlier steps for the next attempt.
+func compensate(ctx context.Context, s *state, last int) error {
+	for i := last; i >= 0; i-- {
+		status := s.run.Steps[i].Status
+		if status == models.StepPending || status == models.StepCompensated {
+			continue
+		}
+		if steps[i].undo != nil {
+			if err := steps[i].undo(ctx, s); err != nil {
+				logs.LogWithFields(s.logger, logrus.ErrorLevel, "Failed to undo provisioning step", struct {
+					TenantName string
+					Step       string
+					Error      error
+				}{TenantName: s.run.TenantName, Step: steps[i].name, Error: err})
+				return &StepError{Step: steps[i].name, Err: err}
+			}
+		}
+		setStepStatus(s.logger, s.run, i, models.StepCompensated, nil)
+	}
+	return nil
+}
+
+func setStepStatus(logger *logrus.Logger, run *models.ProvisioningRun, index int, status string, stepErr error) {
+	step := &run.Steps[index]
+	step.Status, step.Error = status, errorText(stepErr)
+	if err := models.SetProvisioningStepStatus(database.SystemDB(), run.ID, step.Name, step.Status, step.Error); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to record provisioning step", struct {
+			RunID int
+			Step  string
+			Error error
+		}{RunID: run.ID, Step: step.Name, Error: err})
+	}
+}
+
+func setRunStatus(logger *logrus.Logger, run *models.ProvisioningRun, status string, runErr error) {
+	run.Status = status
+	if runErr != nil {
+		run.Error = errorText(runErr)
+	}
+	if err := models.SetProvisioningRunStatus(database.SystemDB(), run.ID, run.Status, run.Error); err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to record provisioning run", struct {
+			RunID int
+			Error error
+		}{RunID: run.ID, Error: err})
+	}
+}
+
+func errorText(err error) *string {
+	if err == nil {
+		return nil
+	}
+	text := err.Error()
+	return &text
+}
+
+func derefError(text *string) string {
+	if text == nil {
+		return "provisioning failed"
+	}
+	return *text
+}
+
+func createTenantRow(ctx context.Context, s *state) error {
+	if s.tenant != nil {
+		return nil
+	}
+
+	tenant := &models.Tenant{Name: s.run.TenantName}
+	err := database.InTx(ctx, database.SystemDB(), func(tx pgx.Tx) error {
+		if err := models.CreateTenant(tx, tenant); err != nil {
+			return err
+		}
+		return models.SetProvisioningRunTenant(tx, s.run.ID, tenant.ID)
+	})
+	if models.IsUniqueViolation(err) {
+		return ErrTenantExists
+	}
+	if err != nil {
+		return err
+	}
+
+	s.tenant = tenant
+	s.run.TenantID = &tenant.ID
+	return nil
+}
+
+// deleteTenantRow only removes a tenant created by this run, never one that
+// made createTenantRow fail because its name was taken.
+func deleteTenantRow(ctx context.Context, s *state) error {
+	if s.tenant == nil {
+		return nil
+	}
+	err := models.DeleteTenant(database.SystemDB(), s.tenant.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func createStorage(ctx context.Context, s *state) error {
+	return migrations.SetupTenantStorage(ctx, database.SystemDB(), s.logger, s.tenant, s.run.DedicatedDatabase)
+}
+
+func removeStorage(ctx context.Context, s *state) error {
+	if s.tenant == nil {
+		return nil
+	}
+	if s.run.DedicatedDatabase || database.Isolation() == database.IsolationDatabase {
+		if err := migrations.DropTenantDatabase(ctx, s.logger, s.tenant.ID, false); err != nil {
+			return err
+		}
+	}
+	return migrations.RemoveTenantStorage(ctx, database.SystemDB(), s.logger, s.tenant, false)
+}
+
+func declareQueue(ctx context.Context, s *state) error {
+	return s.broker.DeclareTenantQueue(ctx, s.run.TenantName)
+}
+
+func deleteQueue(ctx context.Context, s *state) error {
+	_, err := s.broker.DeleteQueue(ctx, s.run.TenantName)
+	return err
+}
+
+func bindQueue(ctx context.Context, s *state) error {
+	return s.broker.BindQueue(ctx, s.run.TenantName, "amq.direct", s.run.TenantName)
+}
+
+func unbindQueue(ctx context.Context, s *state) error {
+	return s.broker.UnbindQueue(ctx, s.run.TenantName, "amq.direct", s.run.TenantName)
+}
+
+// enqueueCreated writes the "Tenant created successfully" message to the
+// outbox in the same transaction that marks the step done, so the message is
+// recorded exactly once, and only published once the queue is bound.
+func enqueueCreated(ctx context.Context, s *state) error {
+	body, err := json.Marshal(map[string]string{"message": "Tenant created successfully"})
+	if err != nil {
+		return err
+	}
+
+	err = database.InTx(ctx, database.SystemDB(), func(tx pgx.Tx) error {
+		message := &models.OutboxMessage{Exchange: "amq.direct", RoutingKey: s.run.TenantName, Body: body}
+		if err := models.EnqueueOutboxMessage(tx, message); err != nil {
+			return err
+		}
+		return models.SetProvisioningStepStatus(tx, s.run.ID, "enqueue_created", models.StepDone, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	rabbitmq.NotifyOutbox()
+	return nil
+}
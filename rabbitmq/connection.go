@@ -0,0 +1,171 @@
+package rabbitmq
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"jatis_mobile_api/logs"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+// ReconnectSettings configures the backoff between reconnection attempts.
+// Zero values fall back to the defaults in ConfigureReconnect.
+type ReconnectSettings struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+var (
+	connMu    sync.RWMutex
+	conn      *amqp091.Connection
+	stop      chan struct{}
+	reconnect = ReconnectSettings{InitialDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second}
+)
+
+// ConfigureReconnect sets the reconnection backoff. It must be called before
+// ConnectRabbitMQ.
+func ConfigureReconnect(settings ReconnectSettings) {
+	if settings.InitialDelay <= 0 {
+		settings.InitialDelay = 500 * time.Millisecond
+	}
+	if settings.MaxDelay <= 0 {
+		settings.MaxDelay = 30 * time.Second
+	}
+	reconnect = settings
+}
+
+// Backoff returns the delay before the given reconnection attempt: the
+// initial delay doubled for every attempt after the first and capped at the
+// maximum, of which a random half is taken off so that instances that lost
+// the broker together do not reconnect in lockstep.
+func (s ReconnectSettings) Backoff(attempt int) time.Duration {
+	delay := s.InitialDelay
+	for i := 1; i < attempt && delay < s.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxDelay {
+		delay = s.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// ConnectRabbitMQ dials the broker and keeps the connection up from then on:
+// when the broker closes it, the connection is dialed again with backoff and
+// the declared topology and active consumers are restored on the new one.
+func ConnectRabbitMQ(url string) error {
+	c, err := amqp091.Dial(url)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to connect to RabbitMQ", struct{ RabbitMQURL string }{RabbitMQURL: url})
+		return err
+	}
+	logs.LogWithFields(logger, logrus.InfoLevel, "Connected to RabbitMQ", struct{ RabbitMQURL string }{RabbitMQURL: url})
+
+	closed := c.NotifyClose(make(chan *amqp091.Error, 1))
+	done := make(chan struct{})
+	connMu.Lock()
+	conn, stop = c, done
+	connMu.Unlock()
+
+	go supervise(url, closed, done)
+	return nil
+}
+
+// supervise waits for the connection to be closed by anything but Close and
+// replaces it. A connection closed by Close closes the notification channel
+// without an error.
+func supervise(url string, closed chan *amqp091.Error, done chan struct{}) {
+	for {
+		amqpErr, ok := <-closed
+		if !ok || amqpErr == nil {
+			return
+		}
+		emit(Event{Type: EventDisconnected, Err: amqpErr})
+
+		closed = redial(url, done)
+		if closed == nil {
+			return
+		}
+		restore()
+	}
+}
+
+// redial dials until it succeeds and returns the close notifications of the
+// new connection, or nil when Close is called first.
+func redial(url string, done chan struct{}) chan *amqp091.Error {
+	for attempt := 1; ; attempt++ {
+		delay := reconnect.Backoff(attempt)
+		select {
+		case <-done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		c, err := amqp091.Dial(url)
+		if err != nil {
+			emit(Event{Type: EventReconnectFailed, Attempt: attempt, Delay: delay, Err: err})
+			continue
+		}
+		closed := c.NotifyClose(make(chan *amqp091.Error, 1))
+
+		connMu.Lock()
+		select {
+		case <-done:
+			connMu.Unlock()
+			c.Close()
+			return nil
+		default:
+		}
+		conn = c
+		connMu.Unlock()
+
+		emit(Event{Type: EventReconnected, Attempt: attempt})
+		return closed
+	}
+}
+
+func currentConn() *amqp091.Connection {
+	connMu.RLock()
+	defer connMu.RUnlock()
+	return conn
+}
+
+// openChannel opens a channel on the current connection.
+func openChannel() (*amqp091.Channel, error) {
+	c := currentConn()
+	if c == nil || c.IsClosed() {
+		return nil, amqp091.ErrClosed
+	}
+	return c.Channel()
+}
+
+// Close closes the pooled channels and the connection, which also closes the
+// consumer channels, and stops reconnecting.
+func Close() {
+	publishers.close()
+	managers.close()
+
+	connMu.Lock()
+	c := conn
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+	connMu.Unlock()
+
+	if c != nil {
+		if err := c.Close(); err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to close connection", struct{ Error error }{Error: err})
+		} else {
+			logs.LogWithFields(logger, logrus.InfoLevel, "Connection closed successfully", struct{ Error error }{Error: err})
+		}
+	}
+}
+
+func IsClosed() bool {
+	c := currentConn()
+	return c == nil || c.IsClosed()
+}
@@ -0,0 +1,420 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jatis_mobile_api/logs"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Consumer states reported by ListConsumers.
+const (
+	ConsumerRunning    = "running"
+	ConsumerRecovering = "recovering"
+	ConsumerCancelled  = "cancelled"
+	ConsumerFailed     = "failed"
+)
+
+var (
+	ErrConsumerExists   = errors.New("rabbitmq: consumer already exists")
+	ErrConsumerNotFound = errors.New("rabbitmq: consumer not found")
+)
+
+// ConsumerInfo describes a consumer started by this instance.
+type ConsumerInfo struct {
+	Tag      string `json:"tag"`
+	TenantID int    `json:"tenant_id"`
+	Queue    string `json:"queue"`
+	State    string `json:"state"`
+	Prefetch int    `json:"prefetch"`
+	// Stream is set on consumers started with StreamConsumer, which end
+	// once stopped rather than being started again.
+	Stream            bool      `json:"stream"`
+	MessagesProcessed uint64    `json:"messages_processed"`
+	LastError         *string   `json:"last_error"`
+	StartedAt         time.Time `json:"started_at"`
+}
+
+type consumerKey struct {
+	tenantID int
+	tag      string
+}
+
+// consumer is a subscription to a queue on a channel of its own, which is
+// not shared with publishers or other consumers. It is resubscribed when the
+// connection is restored, or when only its channel was closed, until it is
+// stopped.
+type consumer struct {
+	tenantID  int
+	queue     string
+	tag       string
+	prefetch  int
+	handler   Handler
+	startedAt time.Time
+	processed uint64
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu        sync.Mutex
+	channel   *amqp091.Channel
+	state     string
+	lastError *string
+	stopped   bool
+}
+
+var (
+	consumersMu sync.Mutex
+	consumers   = map[consumerKey]*consumer{}
+)
+
+// StartConsumer subscribes to the queue of a tenant under the given tag,
+// which must be unique for the tenant. A prefetch of zero uses the configured
+// default.
+func StartConsumer(tenantID int, queueName, tag string, prefetch int) (ConsumerInfo, error) {
+	c, err := startConsumer(tenantID, queueName, tag, prefetch, nil)
+	if err != nil {
+		return ConsumerInfo{}, err
+	}
+	return c.info(), nil
+}
+
+// StreamConsumer subscribes to the queue of a tenant like StartConsumer, but
+// passes its messages to handler instead of the registered handlers. It
+// returns once ctx is done or the consumer is stopped. The stream ends at the
+// first error of handler, and the messages it has not acknowledged are
+// requeued.
+func StreamConsumer(ctx context.Context, tenantID int, queueName, tag string, prefetch int, handler Handler) error {
+	c, err := startConsumer(tenantID, queueName, tag, prefetch, handler)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		c.forget()
+	case <-c.ctx.Done():
+	}
+	return nil
+}
+
+func startConsumer(tenantID int, queueName, tag string, prefetch int, handler Handler) (*consumer, error) {
+	if prefetch <= 0 {
+		prefetch = consumerPrefetch
+	}
+	c := &consumer{tenantID: tenantID, queue: queueName, tag: tag, prefetch: prefetch, handler: handler, startedAt: time.Now()}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	key := consumerKey{tenantID: tenantID, tag: tag}
+
+	consumersMu.Lock()
+	if _, ok := consumers[key]; ok {
+		consumersMu.Unlock()
+		return nil, ErrConsumerExists
+	}
+	consumers[key] = c
+	consumersMu.Unlock()
+
+	if err := c.start(); err != nil {
+		consumersMu.Lock()
+		delete(consumers, key)
+		consumersMu.Unlock()
+		c.cancel()
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to register consumer", struct {
+			QueueName string
+			Tag       string
+			Error     error
+		}{QueueName: queueName, Tag: tag, Error: err})
+		return nil, err
+	}
+
+	logs.LogWithFields(logger, logrus.InfoLevel, "Consumer started successfully", struct {
+		QueueName string
+		Tag       string
+	}{QueueName: queueName, Tag: tag})
+	return c, nil
+}
+
+// StopConsumer cancels a consumer and closes its channel. Unacknowledged
+// messages are requeued by the broker.
+func StopConsumer(tenantID int, tag string) error {
+	key := consumerKey{tenantID: tenantID, tag: tag}
+
+	consumersMu.Lock()
+	c, ok := consumers[key]
+	delete(consumers, key)
+	consumersMu.Unlock()
+	if !ok {
+		return ErrConsumerNotFound
+	}
+
+	c.stop()
+	logs.LogWithFields(logger, logrus.InfoLevel, "Consumer stopped", struct {
+		QueueName string
+		Tag       string
+	}{QueueName: c.queue, Tag: c.tag})
+	return nil
+}
+
+// ListConsumers returns the consumers of a tenant ordered by tag.
+func ListConsumers(tenantID int) []ConsumerInfo {
+	consumersMu.Lock()
+	var list []*consumer
+	for key, c := range consumers {
+		if key.tenantID == tenantID {
+			list = append(list, c)
+		}
+	}
+	consumersMu.Unlock()
+
+	infos := make([]ConsumerInfo, 0, len(list))
+	for _, c := range list {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Tag < infos[j].Tag })
+	return infos
+}
+
+// start subscribes the consumer on a new channel. When the deliveries end
+// without the consumer being stopped, it was cancelled by the broker because
+// its queue is gone, its channel was closed by a channel-level error, in which
+// case it is resubscribed, or it waits for the connection to be restored.
+func (c *consumer) start() error {
+	ch, err := openChannel()
+	if err != nil {
+		c.fail(err)
+		return err
+	}
+	if err := ch.Qos(c.prefetch, 0, false); err != nil {
+		ch.Close()
+		c.fail(err)
+		return err
+	}
+	cancelled := ch.NotifyCancel(make(chan string, 1))
+	closed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+
+	msgs, err := ch.Consume(
+		c.queue,
+		c.tag,
+		false, // Auto-ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		ch.Close()
+		c.fail(err)
+		return err
+	}
+
+	c.mu.Lock()
+	// The consumer may have been resubscribed in the meantime by a restored
+	// connection and by its own closed channel at once.
+	if c.stopped || (c.channel != nil && !c.channel.IsClosed()) {
+		c.mu.Unlock()
+		ch.Close()
+		return nil
+	}
+	c.channel, c.state = ch, ConsumerRunning
+	c.mu.Unlock()
+
+	go func() {
+		for msg := range msgs {
+			c.process(msg)
+		}
+
+		c.mu.Lock()
+		if c.stopped || c.channel != ch {
+			c.mu.Unlock()
+			return
+		}
+		// The cancel and close notifications are sent before the deliveries
+		// end, and the cancel notifications are closed along with the
+		// channel.
+		var byBroker bool
+		select {
+		case _, byBroker = <-cancelled:
+		default:
+		}
+		var channelErr *amqp091.Error
+		select {
+		case channelErr = <-closed:
+		default:
+		}
+		if byBroker {
+			c.state = ConsumerCancelled
+			c.mu.Unlock()
+			ch.Close()
+			return
+		}
+		c.state = ConsumerRecovering
+		c.mu.Unlock()
+
+		// A closed connection closes its channels too, and the consumer is
+		// then restored with the connection.
+		if channelErr != nil && !IsClosed() {
+			c.setLastError(channelErr)
+			c.resubscribe()
+		}
+	}()
+	return nil
+}
+
+// resubscribe subscribes a consumer whose channel was closed again, with the
+// reconnection backoff, until it succeeds, the consumer is stopped, its queue
+// is gone or the connection is lost, in which case restoring the connection
+// resubscribes it.
+func (c *consumer) resubscribe() {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(reconnect.Backoff(attempt)):
+		}
+		if IsClosed() {
+			return
+		}
+
+		err := c.start()
+		if err == nil {
+			emit(Event{Type: EventConsumerRestored, Queue: c.queue})
+			return
+		}
+		emit(Event{Type: EventRestoreFailed, Queue: c.queue, Err: err})
+		var amqpErr *amqp091.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp091.NotFound {
+			return
+		}
+	}
+}
+
+func (c *consumer) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	c.cancel()
+	if c.channel != nil {
+		c.channel.Cancel(c.tag, false)
+		c.channel.Close()
+	}
+}
+
+// forget removes the consumer, unless it was already replaced under its tag,
+// and stops it.
+func (c *consumer) forget() {
+	key := consumerKey{tenantID: c.tenantID, tag: c.tag}
+	consumersMu.Lock()
+	if consumers[key] == c {
+		delete(consumers, key)
+	}
+	consumersMu.Unlock()
+	c.stop()
+}
+
+func (c *consumer) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = ConsumerFailed
+	text := err.Error()
+	c.lastError = &text
+}
+
+func (c *consumer) setLastError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	text := err.Error()
+	c.lastError = &text
+}
+
+func (c *consumer) info() ConsumerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConsumerInfo{
+		Tag:               c.tag,
+		TenantID:          c.tenantID,
+		Queue:             c.queue,
+		State:             c.state,
+		Prefetch:          c.prefetch,
+		Stream:            c.handler != nil,
+		MessagesProcessed: atomic.LoadUint64(&c.processed),
+		LastError:         c.lastError,
+		StartedAt:         c.startedAt,
+	}
+}
+
+func activeConsumers() []*consumer {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	active := make([]*consumer, 0, len(consumers))
+	for _, c := range consumers {
+		active = append(active, c)
+	}
+	return active
+}
+
+// forgetConsumers stops the consumers of a deleted queue.
+func forgetConsumers(queueName string) {
+	consumersMu.Lock()
+	var gone []*consumer
+	for key, c := range consumers {
+		if c.queue == queueName {
+			gone = append(gone, c)
+			delete(consumers, key)
+		}
+	}
+	consumersMu.Unlock()
+
+	for _, c := range gone {
+		c.stop()
+	}
+}
+
+// process dispatches a delivery to its handler, acks it on success, retries
+// it after a delay on a retriable error and rejects it, dead-lettering it, on
+// a permanent one.
+func (c *consumer) process(msg amqp091.Delivery) {
+	defer atomic.AddUint64(&c.processed, 1)
+
+	err := handle(c.ctx, c.tenantID, c.queue, msg, c.handler)
+	if err != nil && c.handler != nil {
+		// A stream ends at its first error.
+		c.forget()
+	}
+	if err == nil {
+		if err := msg.Ack(false); err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to acknowledge message", struct{ Error error }{Error: err})
+			c.setLastError(err)
+		}
+		return
+	}
+	if c.ctx.Err() != nil {
+		// The channel of a stopped consumer is closed, so the broker
+		// requeues the message.
+		return
+	}
+
+	c.setLastError(err)
+	retriable := !IsPermanent(err)
+	logs.LogWithFields(logger, logrus.WarnLevel, "Failed to handle message", struct {
+		QueueName string
+		Tag       string
+		MessageID string
+		Retry     bool
+		Error     error
+	}{QueueName: c.queue, Tag: c.tag, MessageID: msg.MessageId, Retry: retriable, Error: err})
+
+	if retriable {
+		err = retry(c.ctx, c.queue, msg)
+	} else {
+		err = msg.Reject(false)
+	}
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to settle message", struct{ Error error }{Error: err})
+	}
+}
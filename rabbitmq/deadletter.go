@@ -0,0 +1,321 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"jatis_mobile_api/logs"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+// DeadLetterExchange routes messages dead-lettered by a tenant queue to its
+// dead-letter queue, using the tenant queue name as routing key.
+const DeadLetterExchange = "tenants.dead-letter"
+
+// RetryCountHeader counts the retry tiers a message went through.
+const RetryCountHeader = "x-retry-count"
+
+// QueueSettings configures the queues declared for every tenant. Zero values
+// fall back to the defaults in ConfigureQueues.
+type QueueSettings struct {
+	DeliveryLimit int
+	RetryDelays   []time.Duration
+}
+
+var queueSettings = QueueSettings{
+	DeliveryLimit: 10,
+	RetryDelays:   []time.Duration{time.Second, 10 * time.Second, time.Minute},
+}
+
+// ConfigureQueues sets the dead-lettering and retry settings. It must be
+// called before queues are declared.
+func ConfigureQueues(settings QueueSettings) {
+	if settings.DeliveryLimit <= 0 {
+		settings.DeliveryLimit = 10
+	}
+	if len(settings.RetryDelays) == 0 {
+		settings.RetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+	}
+	queueSettings = settings
+}
+
+// DeadLetterQueue returns the name of the dead-letter queue of a tenant
+// queue.
+func DeadLetterQueue(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// RetryQueue returns the name of the retry queue of a tenant queue that holds
+// messages for the given delay.
+func RetryQueue(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queueName, delay)
+}
+
+// declareTenantQueue declares a tenant queue together with its dead-letter
+// queue and retry queues. The tenant queue dead-letters rejected messages and
+// messages delivered more than DeliveryLimit times. Retry queues hold a
+// message for their delay and then dead-letter it back to the tenant queue
+// through amq.direct.
+//
+// Queue arguments cannot be changed once a queue exists, so a tenant queue
+// declared before dead-lettering was introduced is kept as it is; apply the
+// dead-letter settings to it with a policy.
+func declareTenantQueue(ctx context.Context, queueName string) error {
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		if err := ch.ExchangeDeclare(DeadLetterExchange, "direct", true, false, false, false, nil); err != nil {
+			return err
+		}
+		dlq := DeadLetterQueue(queueName)
+		if _, err := ch.QueueDeclare(dlq, true, false, false, false, amqp091.Table{"x-queue-type": "classic"}); err != nil {
+			return err
+		}
+		if err := ch.QueueBind(dlq, queueName, DeadLetterExchange, false, nil); err != nil {
+			return err
+		}
+		for _, delay := range queueSettings.RetryDelays {
+			_, err := ch.QueueDeclare(RetryQueue(queueName, delay), true, false, false, false, amqp091.Table{
+				"x-queue-type":              "classic",
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "amq.direct",
+				"x-dead-letter-routing-key": queueName,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		return declareQueue(ch, queueName)
+	})
+	var amqpErr *amqp091.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp091.PreconditionFailed {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Queue exists with other arguments, dead-lettering must be set by a policy", struct {
+			QueueName string
+			Error     error
+		}{QueueName: queueName, Error: err})
+		return withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+			_, err := ch.QueueDeclarePassive(queueName, true, false, false, false, nil)
+			return err
+		})
+	}
+	return err
+}
+
+// deleteCompanionQueues deletes the dead-letter and retry queues of a
+// deleted tenant queue.
+func deleteCompanionQueues(ctx context.Context, queueName string) error {
+	names := []string{DeadLetterQueue(queueName)}
+	for _, delay := range queueSettings.RetryDelays {
+		names = append(names, RetryQueue(queueName, delay))
+	}
+	return withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		for _, name := range names {
+			if _, err := ch.QueueDelete(name, false, false, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IsNotFound reports whether err was caused by a queue or exchange that does
+// not exist.
+func IsNotFound(err error) bool {
+	var amqpErr *amqp091.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp091.NotFound
+}
+
+// retry schedules a delivery that failed with a retriable error for another
+// attempt: it is published to the retry queue of the next tier and acked.
+// Once every tier was used, the delivery is rejected and dead-lettered. If the
+// retry cannot be published, the delivery is requeued instead, which the
+// delivery limit bounds.
+func retry(ctx context.Context, queueName string, msg amqp091.Delivery) error {
+	attempt := RetryCount(msg.Headers)
+	if attempt >= len(queueSettings.RetryDelays) {
+		return msg.Reject(false)
+	}
+
+	headers := amqp091.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[RetryCountHeader] = int32(attempt + 1)
+
+	delay := queueSettings.RetryDelays[attempt]
+	err := publishers.with(ctx, func(ch *pooledChannel) error {
+		return ch.publish(ctx, "", RetryQueue(queueName, delay), amqp091.Publishing{
+			Headers:       headers,
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp091.Persistent,
+			CorrelationId: msg.CorrelationId,
+			MessageId:     msg.MessageId,
+			Timestamp:     msg.Timestamp,
+			Type:          msg.Type,
+			Body:          msg.Body,
+		})
+	})
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to schedule message retry", struct {
+			QueueName string
+			MessageID string
+			Error     error
+		}{QueueName: queueName, MessageID: msg.MessageId, Error: err})
+		return msg.Nack(false, true)
+	}
+	return msg.Ack(false)
+}
+
+// RetryCount returns the retry tiers a message with the given headers went
+// through.
+func RetryCount(headers amqp091.Table) int {
+	switch value := headers[RetryCountHeader].(type) {
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	case int:
+		return value
+	default:
+		return 0
+	}
+}
+
+// DeadLetter is a message in the dead-letter queue of a tenant.
+type DeadLetter struct {
+	MessageID string `json:"message_id"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	Retries   int    `json:"retries"`
+	Body      string `json:"body"`
+}
+
+func newDeadLetter(msg amqp091.Delivery) DeadLetter {
+	reason, _ := msg.Headers["x-first-death-reason"].(string)
+	return DeadLetter{
+		MessageID: msg.MessageId,
+		Type:      messageType(msg),
+		Reason:    reason,
+		Retries:   RetryCount(msg.Headers),
+		Body:      string(msg.Body),
+	}
+}
+
+// ListDeadLetters returns up to limit messages from the dead-letter queue of
+// a tenant queue without removing them.
+func ListDeadLetters(ctx context.Context, queueName string, limit int) ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		var last uint64
+		defer func() {
+			if last > 0 {
+				ch.Nack(last, true, true)
+			}
+		}()
+
+		for len(letters) < limit {
+			msg, ok, err := ch.Get(DeadLetterQueue(queueName), false)
+			if err != nil || !ok {
+				return err
+			}
+			last = msg.DeliveryTag
+			letters = append(letters, newDeadLetter(msg))
+		}
+		return nil
+	})
+	return letters, err
+}
+
+// ReplayDeadLetters publishes dead-lettered messages back to the tenant
+// queue with a fresh retry count. See settleDeadLetters for the selection.
+func ReplayDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return settleDeadLetters(ctx, queueName, messageIDs, limit, func(msg amqp091.Delivery) error {
+		headers := amqp091.Table{}
+		for key, value := range msg.Headers {
+			switch key {
+			case RetryCountHeader, "x-death", "x-first-death-exchange", "x-first-death-queue", "x-first-death-reason",
+				"x-last-death-exchange", "x-last-death-queue", "x-last-death-reason":
+			default:
+				headers[key] = value
+			}
+		}
+		return publishers.with(ctx, func(ch *pooledChannel) error {
+			return ch.publish(ctx, "", queueName, amqp091.Publishing{
+				Headers:       headers,
+				ContentType:   msg.ContentType,
+				DeliveryMode:  amqp091.Persistent,
+				CorrelationId: msg.CorrelationId,
+				MessageId:     msg.MessageId,
+				Timestamp:     msg.Timestamp,
+				Type:          msg.Type,
+				Body:          msg.Body,
+			})
+		})
+	})
+}
+
+// DiscardDeadLetters removes dead-lettered messages for good. See
+// settleDeadLetters for the selection.
+func DiscardDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int) (int, error) {
+	return settleDeadLetters(ctx, queueName, messageIDs, limit, func(amqp091.Delivery) error {
+		return nil
+	})
+}
+
+// settleDeadLetters runs action on the messages of a dead-letter queue with
+// the given message IDs, or on every message when none are given, up to
+// limit messages when limit is positive. Messages the action succeeded for
+// are removed from the queue; all others are put back.
+func settleDeadLetters(ctx context.Context, queueName string, messageIDs []string, limit int, action func(amqp091.Delivery) error) (int, error) {
+	wanted := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+
+	settled := 0
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		var skipped []uint64
+		defer func() {
+			for _, tag := range skipped {
+				ch.Nack(tag, false, true)
+			}
+		}()
+
+		for limit <= 0 || settled < limit {
+			msg, ok, err := ch.Get(DeadLetterQueue(queueName), false)
+			if err != nil || !ok {
+				return err
+			}
+			if len(messageIDs) > 0 && !wanted[msg.MessageId] {
+				skipped = append(skipped, msg.DeliveryTag)
+				continue
+			}
+			if err := action(msg); err != nil {
+				skipped = append(skipped, msg.DeliveryTag)
+				return err
+			}
+			if err := msg.Ack(false); err != nil {
+				return err
+			}
+			settled++
+
+			if len(messageIDs) > 0 {
+				delete(wanted, msg.MessageId)
+				if len(wanted) == 0 {
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	return settled, err
+}
@@ -0,0 +1,84 @@
+package rabbitmq
+
+import (
+	"sync"
+	"time"
+
+	"jatis_mobile_api/logs"
+
+	"github.com/sirupsen/logrus"
+)
+
+type EventType string
+
+const (
+	EventDisconnected     EventType = "disconnected"
+	EventReconnectFailed  EventType = "reconnect_failed"
+	EventReconnected      EventType = "reconnected"
+	EventTopologyRestored EventType = "topology_restored"
+	EventConsumerRestored EventType = "consumer_restored"
+	EventRestoreFailed    EventType = "restore_failed"
+)
+
+// Event reports a change of the connection state. Attempt and Delay are set
+// for reconnection attempts, Queue for restored consumers and failures to
+// restore a queue, binding or consumer.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Attempt int
+	Delay   time.Duration
+	Queue   string
+	Err     error
+}
+
+var (
+	subscribersMu sync.Mutex
+	subscribers   = map[chan Event]struct{}{}
+)
+
+// Events subscribes to connection events until the returned function is
+// called. Events are dropped for a subscriber whose buffer is full, so a slow
+// subscriber never holds up reconnecting.
+func Events(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	subscribersMu.Lock()
+	subscribers[ch] = struct{}{}
+	subscribersMu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			subscribersMu.Lock()
+			delete(subscribers, ch)
+			subscribersMu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func emit(event Event) {
+	event.Time = time.Now()
+
+	level := logrus.InfoLevel
+	if event.Err != nil {
+		level = logrus.ErrorLevel
+	}
+	logs.LogWithFields(logger, level, "RabbitMQ connection event", struct {
+		Type    EventType
+		Attempt int
+		Delay   string
+		Queue   string
+		Error   error
+	}{Type: event.Type, Attempt: event.Attempt, Delay: event.Delay.String(), Queue: event.Queue, Error: event.Err})
+
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"jatis_mobile_api/logs"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+// AnyTenant and AnyType register a handler for messages of every tenant or
+// of every type.
+const (
+	AnyTenant = 0
+	AnyType   = ""
+)
+
+var ErrNoHandler = errors.New("rabbitmq: no handler registered for message")
+
+// Message is a delivery passed to a Handler.
+type Message struct {
+	TenantID    int
+	Queue       string
+	Type        string
+	MessageID   string
+	Headers     amqp091.Table
+	Body        []byte
+	Redelivered bool
+}
+
+// Handler processes a message. Returning nil acknowledges the message, an
+// error marked with Permanent rejects it and any other error requeues it.
+// The context is cancelled when the consumer is stopped.
+type Handler func(ctx context.Context, msg Message) error
+
+type handlerKey struct {
+	tenantID    int
+	messageType string
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[handlerKey]Handler{}
+)
+
+// RegisterHandler registers the handler for messages of a tenant and type,
+// replacing a previously registered one. Use AnyTenant and AnyType for
+// fallbacks: a message goes to the handler of its tenant and type, then its
+// tenant and any type, then any tenant and its type, then any tenant and
+// any type.
+func RegisterHandler(tenantID int, messageType string, handler Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[handlerKey{tenantID: tenantID, messageType: messageType}] = handler
+}
+
+// UnregisterHandler removes the handler registered for a tenant and type.
+func UnregisterHandler(tenantID int, messageType string) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	delete(handlers, handlerKey{tenantID: tenantID, messageType: messageType})
+}
+
+// HandlerFor returns the handler a message of the tenant and type is
+// dispatched to.
+func HandlerFor(tenantID int, messageType string) (Handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	for _, key := range []handlerKey{
+		{tenantID: tenantID, messageType: messageType},
+		{tenantID: tenantID, messageType: AnyType},
+		{tenantID: AnyTenant, messageType: messageType},
+		{tenantID: AnyTenant, messageType: AnyType},
+	} {
+		if handler, ok := handlers[key]; ok {
+			return handler, true
+		}
+	}
+	return nil, false
+}
+
+// LogHandler logs a message and acknowledges it. It is registered for any
+// tenant and any type on startup, so that messages without a handler of their
+// own, such as the tenant created event, are not dead-lettered.
+func LogHandler(ctx context.Context, msg Message) error {
+	logs.LogWithFields(logger, logrus.InfoLevel, "Processing message", struct {
+		TenantID  int
+		Type      string
+		MessageID string
+		Body      string
+	}{TenantID: msg.TenantID, Type: msg.Type, MessageID: msg.MessageID, Body: string(msg.Body)})
+	return nil
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks a handler error that redelivering the message will not
+// fix, such as a malformed body, so that the message is rejected instead of
+// requeued.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// messageType returns the type of a delivery: its AMQP type property, or
+// else its "type" header.
+func messageType(msg amqp091.Delivery) string {
+	if msg.Type != "" {
+		return msg.Type
+	}
+	if value, ok := msg.Headers["type"].(string); ok {
+		return value
+	}
+	return ""
+}
+
+// handle passes a delivery of a tenant queue to handler, or dispatches it
+// when handler is nil.
+func handle(ctx context.Context, tenantID int, queueName string, msg amqp091.Delivery, handler Handler) error {
+	message := Message{
+		TenantID:    tenantID,
+		Queue:       queueName,
+		Type:        messageType(msg),
+		MessageID:   msg.MessageId,
+		Headers:     msg.Headers,
+		Body:        msg.Body,
+		Redelivered: msg.Redelivered,
+	}
+	if handler == nil {
+		return Dispatch(ctx, message)
+	}
+	return Run(ctx, handler, message)
+}
+
+// Dispatch runs the handler registered for a message. A message without a
+// handler and a panicking handler are permanent errors.
+func Dispatch(ctx context.Context, msg Message) error {
+	handler, ok := HandlerFor(msg.TenantID, msg.Type)
+	if !ok {
+		return Permanent(fmt.Errorf("%w of type %q", ErrNoHandler, msg.Type))
+	}
+	return Run(ctx, handler, msg)
+}
+
+// Run passes a message to handler. A panicking handler is a permanent error.
+func Run(ctx context.Context, handler Handler, msg Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = Permanent(fmt.Errorf("handler panicked: %v", r))
+		}
+	}()
+	return handler(ctx, msg)
+}
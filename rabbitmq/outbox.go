@@ -0,0 +1,206 @@
+package rabbitmq
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/models"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outboxConfirmTimeout = 5 * time.Second
+	outboxPruneInterval  = time.Hour
+)
+
+var outboxWake = make(chan struct{}, 1)
+
+// OutboxSettings configures the outbox relay. Zero values fall back to the
+// defaults in StartOutboxRelay.
+type OutboxSettings struct {
+	PollInterval  time.Duration
+	BatchSize     int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	Retention     time.Duration
+	// Publish replaces publishing to RabbitMQ, for brokers that store
+	// messages in the database. It is called with the transaction that
+	// marks the message as sent.
+	Publish func(ctx context.Context, tx pgx.Tx, message models.OutboxMessage) error
+}
+
+func (s OutboxSettings) withDefaults() OutboxSettings {
+	if s.PollInterval <= 0 {
+		s.PollInterval = time.Second
+	}
+	if s.BatchSize <= 0 {
+		s.BatchSize = 100
+	}
+	if s.RetryDelay <= 0 {
+		s.RetryDelay = time.Second
+	}
+	if s.MaxRetryDelay <= 0 {
+		s.MaxRetryDelay = 5 * time.Minute
+	}
+	if s.Retention <= 0 {
+		s.Retention = 7 * 24 * time.Hour
+	}
+	return s
+}
+
+// Backoff returns how long a message waits before its next attempt after
+// the given number of failed attempts: RetryDelay doubled for every attempt
+// after the first, capped at MaxRetryDelay.
+func (s OutboxSettings) Backoff(attempts int) time.Duration {
+	delay := s.RetryDelay
+	for i := 1; i < attempts && delay < s.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxRetryDelay {
+		delay = s.MaxRetryDelay
+	}
+	return delay
+}
+
+// NotifyOutbox wakes the relay so that messages enqueued by a transaction
+// that just committed are published without waiting for the next poll.
+func NotifyOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartOutboxRelay publishes the messages in the outbox until ctx is done.
+// Every message is published as mandatory on a channel in confirm mode and
+// only marked as sent once the broker confirmed it, so delivery is at least
+// once; the outbox ID is sent as the message ID for consumers to deduplicate
+// on. Rows are locked with SKIP LOCKED, so several instances can run a relay.
+func StartOutboxRelay(ctx context.Context, settings OutboxSettings) {
+	relay := &outboxRelay{settings: settings.withDefaults()}
+	go relay.run(ctx)
+}
+
+type outboxRelay struct {
+	settings  OutboxSettings
+	lastPrune time.Time
+}
+
+func (r *outboxRelay) run(ctx context.Context) {
+	ticker := time.NewTicker(r.settings.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		r.relay(ctx)
+		r.prune()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-outboxWake:
+		}
+	}
+}
+
+// relay publishes due messages batch by batch until the outbox is drained or
+// a publish fails.
+func (r *outboxRelay) relay(ctx context.Context) {
+	for ctx.Err() == nil {
+		more, err := r.relayBatch(ctx)
+		if err != nil {
+			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to relay outbox messages", struct{ Error error }{Error: err})
+			return
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+func (r *outboxRelay) relayBatch(ctx context.Context) (bool, error) {
+	var ch *pooledChannel
+	publish := r.settings.Publish
+	if publish == nil {
+		var err error
+		ch, err = publishers.borrow(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer publishers.giveBack(ch)
+		publish = func(ctx context.Context, tx pgx.Tx, message models.OutboxMessage) error {
+			return publishOutboxMessage(ctx, ch, message)
+		}
+	}
+
+	more := false
+	err := database.WithTx(ctx, func(tx pgx.Tx) error {
+		messages, err := models.ClaimOutboxMessages(tx, r.settings.BatchSize)
+		if err != nil {
+			return err
+		}
+		more = len(messages) == r.settings.BatchSize
+
+		for _, message := range messages {
+			if err := publish(ctx, tx, message); err != nil {
+				more = false
+				retryIn := r.settings.Backoff(message.Attempts + 1)
+				logs.LogWithFields(logger, logrus.WarnLevel, "Failed to publish outbox message", struct {
+					ID         int64
+					RoutingKey string
+					Attempts   int
+					RetryIn    string
+					Error      error
+				}{ID: message.ID, RoutingKey: message.RoutingKey, Attempts: message.Attempts + 1, RetryIn: retryIn.String(), Error: err})
+				if err := models.MarkOutboxMessageFailed(tx, message.ID, err.Error(), retryIn); err != nil {
+					return err
+				}
+				if ch != nil && ch.broken {
+					// The rest of the batch stays due for the next poll.
+					break
+				}
+				continue
+			}
+			if err := models.MarkOutboxMessageSent(tx, message.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return more, err
+}
+
+func publishOutboxMessage(ctx context.Context, ch *pooledChannel, message models.OutboxMessage) error {
+	confirmCtx, cancel := context.WithTimeout(ctx, outboxConfirmTimeout)
+	defer cancel()
+
+	return ch.publish(confirmCtx, message.Exchange, message.RoutingKey, amqp091.Publishing{
+		ContentType:  message.ContentType,
+		DeliveryMode: amqp091.Persistent,
+		MessageId:    strconv.FormatInt(message.ID, 10),
+		Timestamp:    message.CreatedAt,
+		Body:         message.Body,
+	})
+}
+
+func (r *outboxRelay) prune() {
+	if time.Since(r.lastPrune) < outboxPruneInterval {
+		return
+	}
+	r.lastPrune = time.Now()
+
+	pruned, err := models.PruneOutboxMessages(database.GetDB(), r.settings.Retention)
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to prune outbox messages", struct{ Error error }{Error: err})
+		return
+	}
+	if pruned > 0 {
+		logs.LogWithFields(logger, logrus.InfoLevel, "Pruned sent outbox messages", struct{ Count int64 }{Count: pruned})
+	}
+}
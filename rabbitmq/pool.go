@@ -0,0 +1,154 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// borrowTimeout bounds the wait for a free channel for calls that take no
+// context.
+const borrowTimeout = 10 * time.Second
+
+// ChannelSettings sizes the channel pools. Zero values fall back to the
+// defaults in ConfigureChannels.
+type ChannelSettings struct {
+	PublisherChannels  int
+	ManagementChannels int
+	ConsumerPrefetch   int
+}
+
+var (
+	publishers       = newChannelPool(8, true)
+	managers         = newChannelPool(4, false)
+	consumerPrefetch = 10
+)
+
+// ConfigureChannels replaces the channel pools. It must be called before the
+// package is used, as channels borrowed from the old pools are not tracked.
+func ConfigureChannels(settings ChannelSettings) {
+	if settings.PublisherChannels <= 0 {
+		settings.PublisherChannels = 8
+	}
+	if settings.ManagementChannels <= 0 {
+		settings.ManagementChannels = 4
+	}
+	if settings.ConsumerPrefetch <= 0 {
+		settings.ConsumerPrefetch = 10
+	}
+	publishers = newChannelPool(settings.PublisherChannels, true)
+	managers = newChannelPool(settings.ManagementChannels, false)
+	consumerPrefetch = settings.ConsumerPrefetch
+}
+
+// pooledChannel is a channel borrowed from a pool. Channels of the publisher
+// pool are in confirm mode and collect returned messages.
+type pooledChannel struct {
+	channel *amqp091.Channel
+	returns chan amqp091.Return
+	broken  bool
+}
+
+// channelPool lends channels of the shared connection to one goroutine at a
+// time, since AMQP channels must not be used concurrently. At most size
+// channels are lent at once. A channel that was closed, for example by the
+// broker after a channel-level error or because the connection was lost, is
+// dropped on return and a new one is opened on the next borrow.
+type channelPool struct {
+	confirm bool
+	slots   chan struct{}
+
+	mu   sync.Mutex
+	idle []*pooledChannel
+}
+
+func newChannelPool(size int, confirm bool) *channelPool {
+	return &channelPool{confirm: confirm, slots: make(chan struct{}, size)}
+}
+
+func (p *channelPool) borrow(ctx context.Context) (*pooledChannel, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		ch := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !ch.channel.IsClosed() {
+			p.mu.Unlock()
+			return ch, nil
+		}
+	}
+	p.mu.Unlock()
+
+	ch, err := p.open()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (p *channelPool) giveBack(ch *pooledChannel) {
+	if ch.broken || ch.channel.IsClosed() {
+		ch.channel.Close()
+	} else {
+		p.mu.Lock()
+		p.idle = append(p.idle, ch)
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+// with runs fn on a borrowed channel and returns the channel afterwards.
+func (p *channelPool) with(ctx context.Context, fn func(ch *pooledChannel) error) error {
+	ch, err := p.borrow(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.giveBack(ch)
+	return fn(ch)
+}
+
+func (p *channelPool) open() (*pooledChannel, error) {
+	channel, err := openChannel()
+	if err != nil {
+		return nil, err
+	}
+	ch := &pooledChannel{channel: channel}
+	if p.confirm {
+		if err := channel.Confirm(false); err != nil {
+			channel.Close()
+			return nil, err
+		}
+		ch.returns = channel.NotifyReturn(make(chan amqp091.Return, 1))
+	}
+	return ch, nil
+}
+
+// close closes the idle channels. Borrowed channels are closed when they are
+// returned after the connection is gone.
+func (p *channelPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ch := range p.idle {
+		ch.channel.Close()
+	}
+	p.idle = nil
+}
+
+// withManagementChannel runs fn on a channel of the management pool, used
+// for declaring, binding and deleting queues. Waiting for a channel gives up
+// once ctx is done or after borrowTimeout.
+func withManagementChannel(ctx context.Context, fn func(ch *amqp091.Channel) error) error {
+	ctx, cancel := context.WithTimeout(ctx, borrowTimeout)
+	defer cancel()
+	return managers.with(ctx, func(ch *pooledChannel) error {
+		return fn(ch.channel)
+	})
+}
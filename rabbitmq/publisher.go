@@ -0,0 +1,63 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// defaultConfirmTimeout bounds the wait for a confirmation when the caller's
+// context has no deadline.
+const defaultConfirmTimeout = 5 * time.Second
+
+var (
+	ErrUnroutable    = errors.New("rabbitmq: message could not be routed to a queue")
+	ErrPublishNacked = errors.New("rabbitmq: message was not confirmed by the broker")
+)
+
+// publish publishes a mandatory message on a channel of the publisher pool
+// and waits for it to be confirmed. A channel is only used by one goroutine
+// at a time, which keeps a returned message attributable to the publish that
+// caused it: the broker sends basic.return before the basic.ack of the same
+// message.
+//
+// It returns ErrUnroutable when no queue is bound for the routing key,
+// ErrPublishNacked when the broker refuses the message and the context error
+// when no confirmation arrived in time.
+func (c *pooledChannel) publish(ctx context.Context, exchangeName, routingKey string, msg amqp091.Publishing) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultConfirmTimeout)
+		defer cancel()
+	}
+
+	confirmation, err := c.channel.PublishWithDeferredConfirmWithContext(ctx, exchangeName, routingKey, true, false, msg)
+	if err != nil {
+		c.broken = true
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		// The message may still be returned later and would then be taken for
+		// the next one, so the channel is not reused.
+		c.broken = true
+		return err
+	}
+
+	select {
+	case ret, ok := <-c.returns:
+		if ok {
+			return fmt.Errorf("%w: %s", ErrUnroutable, ret.ReplyText)
+		}
+	default:
+	}
+
+	if !acked {
+		return ErrPublishNacked
+	}
+	return nil
+}
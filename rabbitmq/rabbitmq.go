@@ -1,94 +1,97 @@
 package rabbitmq
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
 	"jatis_mobile_api/logs"
 
 	"github.com/rabbitmq/amqp091-go"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	conn    *amqp091.Connection
-	channel *amqp091.Channel
-	logger  = logs.SetupLogger()
-)
+var logger = logs.SetupLogger()
 
-func ConnectRabbitMQ(url string) error {
-	var err error
-	conn, err = amqp091.Dial(url)
-	if err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to connect to RabbitMQ", struct{ RabbitMQURL string }{RabbitMQURL: url})
-		return err
-	}
-	logs.LogWithFields(logger, logrus.InfoLevel, "Connected to RabbitMQ", struct{ RabbitMQURL string }{RabbitMQURL: url})
+// PublishMessage publishes a persistent, mandatory JSON message and waits
+// until the broker confirmed it or ctx is done. See pooledChannel.publish for
+// the errors it returns.
+func PublishMessage(ctx context.Context, exchangeName, routingKey string, body []byte) error {
+	return Publish(ctx, exchangeName, routingKey, amqp091.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	})
+}
 
-	channel, err = conn.Channel()
-	if err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to open a channel", struct{ Error error }{Error: err})
-		return err
-	}
-	logs.LogWithFields(logger, logrus.InfoLevel, "Channel opened successfully", struct{}{})
-	return nil
+// NewMessageID returns a random message ID, which lets a dead-lettered
+// message be replayed or discarded by ID.
+func NewMessageID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
-// type exchange direct
-func PublishMessage(exchangeName, routingKey string, body []byte) error {
-	if channel == nil {
-		err := amqp091.ErrClosed
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Channel is not available", struct{ Error error }{Error: err})
-		return amqp091.ErrClosed
+// Publish publishes a persistent, mandatory message like PublishMessage,
+// keeping the properties and headers of msg. A message without an ID is given
+// one from NewMessageID.
+func Publish(ctx context.Context, exchangeName, routingKey string, msg amqp091.Publishing) error {
+	msg.DeliveryMode = amqp091.Persistent
+	if msg.MessageId == "" {
+		msg.MessageId = NewMessageID()
 	}
-
-	err := channel.Publish(
-		exchangeName, // The exchange to publish to
-		routingKey,   // The routing key used for routing the message
-		false,        // Mandatory
-		false,        // Immediate
-		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
+	err := publishers.with(ctx, func(ch *pooledChannel) error {
+		return ch.publish(ctx, exchangeName, routingKey, msg)
+	})
 	if err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to publish message", struct{ RoutingKey string }{RoutingKey: routingKey})
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to publish message", struct {
+			RoutingKey string
+			Error      error
+		}{RoutingKey: routingKey, Error: err})
 		return err
 	}
 
 	logs.LogWithFields(logger, logrus.InfoLevel, "Message published successfully", struct {
 		RoutingKey string
 		Body       string
-	}{RoutingKey: routingKey, Body: string(body)})
+	}{RoutingKey: routingKey, Body: string(msg.Body)})
 	return nil
 }
 
-func DeclareQueue(queueName string) error {
-	_, err := channel.QueueDeclare(
-		queueName,
-		true,  // Durable
-		false, // Auto-delete
-		false, // Exclusive
-		false, // No-wait
-		amqp091.Table{
-			"x-queue-type": "quorum", // Use quorum queue
-		},
-	)
+// DeclareQueue declares a tenant queue with its dead-letter and retry queues.
+func DeclareQueue(ctx context.Context, queueName string) error {
+	err := declareTenantQueue(ctx, queueName)
 	if err != nil {
 		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to declare queue", struct{ QueueName string }{QueueName: queueName})
 		return err
 	}
 
+	rememberQueue(queueName)
 	logs.LogWithFields(logger, logrus.InfoLevel, "Queue declared successfully", struct{ QueueName string }{QueueName: queueName})
 	return nil
 }
 
-func BindQueue(queueName, exchangeName, routingKey string) error {
-	err := channel.QueueBind(
+func declareQueue(ch *amqp091.Channel, queueName string) error {
+	_, err := ch.QueueDeclare(
 		queueName,
-		routingKey,
-		exchangeName,
-		false,
-		nil,
+		true,  // Durable
+		false, // Auto-delete
+		false, // Exclusive
+		false, // No-wait
+		amqp091.Table{
+			"x-queue-type":              "quorum", // Use quorum queue
+			"x-delivery-limit":          int32(queueSettings.DeliveryLimit),
+			"x-dead-letter-exchange":    DeadLetterExchange,
+			"x-dead-letter-routing-key": queueName,
+		},
 	)
+	return err
+}
+
+func BindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	b := binding{Queue: queueName, Exchange: exchangeName, RoutingKey: routingKey}
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		return bindQueue(ch, b)
+	})
 	if err != nil {
 		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to bind queue to exchange", struct {
 			QueueName    string
@@ -102,6 +105,7 @@ func BindQueue(queueName, exchangeName, routingKey string) error {
 		return err
 	}
 
+	rememberBinding(b)
 	logs.LogWithFields(logger, logrus.InfoLevel, "Queue bound to exchange successfully", struct {
 		QueueName    string
 		ExchangeName string
@@ -115,69 +119,142 @@ func BindQueue(queueName, exchangeName, routingKey string) error {
 	return nil
 }
 
-func ConsumeMessages(queueName string) error {
-	msgs, err := channel.Consume(
-		queueName,
-		"",
-		false, // Auto-ack
-		false,
-		false,
-		false,
-		nil,
-	)
+func UnbindQueue(ctx context.Context, queueName, exchangeName, routingKey string) error {
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		return ch.QueueUnbind(
+			queueName,
+			routingKey,
+			exchangeName,
+			nil,
+		)
+	})
 	if err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to register consumer", struct{ QueueName string }{QueueName: queueName})
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to unbind queue from exchange", struct {
+			QueueName    string
+			ExchangeName string
+			RoutingKey   string
+		}{
+			QueueName:    queueName,
+			ExchangeName: exchangeName,
+			RoutingKey:   routingKey,
+		})
 		return err
 	}
 
-	logs.LogWithFields(logger, logrus.InfoLevel, "Consumer started successfully", struct{ QueueName string }{QueueName: queueName})
-
-	go func() {
-		for msg := range msgs {
-			processMessage(msg)
-		}
-	}()
+	forgetBinding(binding{Queue: queueName, Exchange: exchangeName, RoutingKey: routingKey})
+	logs.LogWithFields(logger, logrus.InfoLevel, "Queue unbound from exchange successfully", struct {
+		QueueName    string
+		ExchangeName string
+		RoutingKey   string
+	}{
+		QueueName:    queueName,
+		ExchangeName: exchangeName,
+		RoutingKey:   routingKey,
+	})
 
 	return nil
 }
 
-func processMessage(msg amqp091.Delivery) {
-	logs.LogWithFields(logger, logrus.InfoLevel, "Processing message", struct{ Body string }{Body: string(msg.Body)})
+func DeleteQueue(ctx context.Context, queueName string) (int, error) {
+	var messageCount int
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		var err error
+		messageCount, err = ch.QueueDelete(queueName, false, false, false)
+		return err
+	})
+	if err != nil {
+		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to delete queue", struct{ QueueName string }{QueueName: queueName})
+		return 0, err
+	}
 
-	if err := msg.Ack(false); err != nil {
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to acknowledge message", struct{ Error error }{Error: err})
-	} else {
-		logs.LogWithFields(logger, logrus.InfoLevel, "Message acknowledged", struct{ DeliveryTag uint64 }{DeliveryTag: msg.DeliveryTag})
+	forgetQueue(queueName)
+	if err := deleteCompanionQueues(ctx, queueName); err != nil {
+		logs.LogWithFields(logger, logrus.WarnLevel, "Failed to delete dead-letter and retry queues", struct {
+			QueueName string
+			Error     error
+		}{QueueName: queueName, Error: err})
 	}
+	logs.LogWithFields(logger, logrus.InfoLevel, "Queue deleted successfully", struct {
+		QueueName    string
+		MessageCount int
+	}{QueueName: queueName, MessageCount: messageCount})
+	return messageCount, nil
 }
 
-func GetChannel() (*amqp091.Channel, error) {
-	if channel == nil {
-		err := amqp091.ErrClosed
-		logs.LogWithFields(logger, logrus.ErrorLevel, "Channel is not available", struct{ Error error }{Error: err})
-		return nil, amqp091.ErrClosed
-	}
-	logs.LogWithFields(logger, logrus.InfoLevel, "Channel retrieved successfully", struct{}{})
-	return channel, nil
+// QueueStats returns the number of ready messages in a queue and the number
+// of its consumers.
+func QueueStats(ctx context.Context, queueName string) (int, int, error) {
+	var queue amqp091.Queue
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		var err error
+		queue, err = ch.QueueDeclarePassive(queueName, true, false, false, false, nil)
+		return err
+	})
+	return queue.Messages, queue.Consumers, err
 }
 
-func Close() {
-	if channel != nil {
-		if err := channel.Close(); err != nil {
-			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to close channel", struct{ Error error }{Error: err})
-		} else {
-			logs.LogWithFields(logger, logrus.InfoLevel, "Channel closed successfully", struct{ Error error }{Error: err})
-		}
-	}
-	if conn != nil {
-		if err := conn.Close(); err != nil {
-			logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to close connection", struct{ Error error }{Error: err})
-		} else {
-			logs.LogWithFields(logger, logrus.InfoLevel, "Connection closed successfully", struct{ Error error }{Error: err})
+// MoveMessages drains every ready message from one queue into another through
+// the default exchange. A message is only acked on the source queue once the
+// broker has confirmed it on the destination, so a failure never loses
+// messages. It stops between messages once ctx is done.
+func MoveMessages(ctx context.Context, fromQueue, toQueue string) (int, error) {
+	moved := 0
+	err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			msg, ok, err := ch.Get(fromQueue, false)
+			if err != nil {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to get message from queue", struct {
+					QueueName string
+					Error     error
+				}{QueueName: fromQueue, Error: err})
+				return err
+			}
+			if !ok {
+				return nil
+			}
+
+			err = publishers.with(ctx, func(pc *pooledChannel) error {
+				return pc.publish(ctx, "", toQueue, amqp091.Publishing{
+					Headers:       msg.Headers,
+					ContentType:   msg.ContentType,
+					DeliveryMode:  msg.DeliveryMode,
+					CorrelationId: msg.CorrelationId,
+					MessageId:     msg.MessageId,
+					Timestamp:     msg.Timestamp,
+					Type:          msg.Type,
+					Body:          msg.Body,
+				})
+			})
+			if err != nil {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to republish message", struct {
+					FromQueue string
+					ToQueue   string
+					Error     error
+				}{FromQueue: fromQueue, ToQueue: toQueue, Error: err})
+				if nackErr := msg.Nack(false, true); nackErr != nil {
+					logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to requeue message", struct{ Error error }{Error: nackErr})
+				}
+				return err
+			}
+
+			if err := msg.Ack(false); err != nil {
+				logs.LogWithFields(logger, logrus.ErrorLevel, "Failed to acknowledge moved message", struct{ Error error }{Error: err})
+				return err
+			}
+			moved++
 		}
+	})
+	if err != nil {
+		return moved, err
 	}
-}
 
-func IsClosed() bool {
-	return conn == nil || conn.IsClosed()
+	logs.LogWithFields(logger, logrus.InfoLevel, "Messages moved successfully", struct {
+		FromQueue string
+		ToQueue   string
+		Count     int
+	}{FromQueue: fromQueue, ToQueue: toQueue, Count: moved})
+	return moved, nil
 }
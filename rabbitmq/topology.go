@@ -0,0 +1,101 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// binding is a queue bound to an exchange under a routing key.
+type binding struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+}
+
+// The queues and bindings declared through this package since it connected,
+// asserted again after a reconnect.
+var (
+	topologyMu sync.Mutex
+	queues     = map[string]struct{}{}
+	bindings   = map[binding]struct{}{}
+)
+
+func rememberQueue(queueName string) {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+	queues[queueName] = struct{}{}
+}
+
+func rememberBinding(b binding) {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+	bindings[b] = struct{}{}
+}
+
+func forgetBinding(b binding) {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+	delete(bindings, b)
+}
+
+// forgetQueue forgets a deleted queue together with its bindings and
+// consumers, which the broker removed with it.
+func forgetQueue(queueName string) {
+	topologyMu.Lock()
+	delete(queues, queueName)
+	for b := range bindings {
+		if b.Queue == queueName {
+			delete(bindings, b)
+		}
+	}
+	topologyMu.Unlock()
+
+	forgetConsumers(queueName)
+}
+
+func bindQueue(ch *amqp091.Channel, b binding) error {
+	return ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, nil)
+}
+
+// restore declares the remembered queues, with their dead-letter and retry
+// queues, and bindings on the current connection and then resubscribes the
+// active consumers. Every declaration runs on a channel of its own, since a
+// failed one closes its channel.
+func restore() {
+	ctx := context.Background()
+	topologyMu.Lock()
+	queueNames := make([]string, 0, len(queues))
+	for queueName := range queues {
+		queueNames = append(queueNames, queueName)
+	}
+	queueBindings := make([]binding, 0, len(bindings))
+	for b := range bindings {
+		queueBindings = append(queueBindings, b)
+	}
+	topologyMu.Unlock()
+
+	for _, queueName := range queueNames {
+		if err := declareTenantQueue(ctx, queueName); err != nil {
+			emit(Event{Type: EventRestoreFailed, Queue: queueName, Err: err})
+		}
+	}
+	for _, b := range queueBindings {
+		err := withManagementChannel(ctx, func(ch *amqp091.Channel) error {
+			return bindQueue(ch, b)
+		})
+		if err != nil {
+			emit(Event{Type: EventRestoreFailed, Queue: b.Queue, Err: err})
+		}
+	}
+	emit(Event{Type: EventTopologyRestored})
+
+	for _, c := range activeConsumers() {
+		if err := c.start(); err != nil {
+			emit(Event{Type: EventRestoreFailed, Queue: c.queue, Err: err})
+			continue
+		}
+		emit(Event{Type: EventConsumerRestored, Queue: c.queue})
+	}
+}
@@ -0,0 +1,20 @@
+package routes
+
+import (
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/middleware"
+
+	"github.com/labstack/echo/v4"
+)
+
+func RegisterAPIKeyRoutes(e *echo.Echo) {
+	canRead := middleware.RequirePermission(auth.PermAPIKeysRead)
+	canWrite := middleware.RequirePermission(auth.PermAPIKeysWrite)
+
+	keys := e.Group("/tenants/:id/api-keys")
+	keys.POST("", handlers.CreateAPIKeyHandler, canWrite, middleware.TenantDB)
+	keys.GET("", handlers.ListAPIKeysHandler, canRead, middleware.TenantDB)
+	keys.POST("/:keyId/rotate", handlers.RotateAPIKeyHandler, canWrite, middleware.TenantDB)
+	keys.DELETE("/:keyId", handlers.RevokeAPIKeyHandler, canWrite, middleware.TenantDB)
+}
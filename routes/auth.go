@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/handlers"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PublicPaths lists the routes that can be called without an access token.
+var PublicPaths = []string{"/auth/login", "/auth/refresh", "/health"}
+
+func RegisterAuthRoutes(e *echo.Echo, tokens *auth.TokenManager) {
+	e.POST("/auth/login", handlers.LoginHandler(tokens))
+	e.POST("/auth/refresh", handlers.RefreshHandler(tokens))
+	e.POST("/auth/logout", handlers.LogoutHandler)
+}
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/middleware"
+
+	"github.com/labstack/echo/v4"
+)
+
+func RegisterRoleRoutes(e *echo.Echo) {
+	canRead := middleware.RequirePermission(auth.PermRolesRead)
+	canWrite := middleware.RequirePermission(auth.PermRolesWrite)
+
+	e.GET("/tenants/:id/roles", handlers.ListRolesHandler, canRead, middleware.TenantDB)
+	e.POST("/tenants/:id/roles", handlers.CreateRoleHandler, canWrite, middleware.TenantDB)
+	e.DELETE("/tenants/:id/roles/:roleId", handlers.DeleteRoleHandler, canWrite, middleware.TenantDB)
+
+	e.GET("/tenants/:id/users/:userId/roles", handlers.ListUserRolesHandler, canRead, middleware.TenantDB)
+	e.POST("/tenants/:id/users/:userId/roles", handlers.AssignUserRoleHandler, canWrite, middleware.TenantDB)
+	e.DELETE("/tenants/:id/users/:userId/roles/:roleId", handlers.UnassignUserRoleHandler, canWrite, middleware.TenantDB)
+}
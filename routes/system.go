@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/middleware"
+
+	"github.com/labstack/echo/v4"
+)
+
+func RegisterSystemRoutes(e *echo.Echo) {
+	e.GET("/health", handlers.HealthHandler)
+	e.GET("/system/database", handlers.DatabaseStatsHandler, middleware.RequirePermission(auth.PermSystemRead))
+	e.GET("/system/rabbitmq/events", handlers.BrokerEventsHandler, middleware.RequirePermission(auth.PermSystemRead))
+}
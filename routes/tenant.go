@@ -1,14 +1,42 @@
 package routes
 
 import (
+	"jatis_mobile_api/auth"
 	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/middleware"
 
 	"github.com/labstack/echo/v4"
 )
 
-func RegisterTenantRoutes(e *echo.Echo) {
-	e.POST("/tenants", handlers.CreateTenantHandler)
-	e.DELETE("/tenants/:id", handlers.DeleteTenantHandler)
-	e.GET("/consumers", handlers.ConsumerHandler)
-	e.POST("/producers", handlers.ProducerHandler)
+// RegisterTenantRoutes registers the tenant routes. Producer and consumer
+// routes are also available under /t/:tenant for the path tenant resolver.
+func RegisterTenantRoutes(e *echo.Echo, resolveTenant echo.MiddlewareFunc) {
+	e.GET("/tenants", handlers.ListTenantsHandler, middleware.RequirePermission(auth.PermTenantsList))
+	e.POST("/tenants", handlers.CreateTenantHandler, middleware.RequirePermission(auth.PermTenantsCreate))
+	e.GET("/tenants/by-name/:name", handlers.GetTenantByNameHandler, middleware.RequirePermission(auth.PermTenantsList))
+	e.GET("/tenants/:id", handlers.GetTenantHandler, middleware.RequirePermission(auth.PermTenantsRead))
+	e.GET("/tenants/:id/provisioning", handlers.GetTenantProvisioningHandler, middleware.RequirePermission(auth.PermTenantsRead))
+	e.PATCH("/tenants/:id", handlers.UpdateTenantHandler, middleware.RequirePermission(auth.PermTenantsUpdate))
+	e.DELETE("/tenants/:id", handlers.DeleteTenantHandler, middleware.RequirePermission(auth.PermTenantsDelete))
+	e.POST("/tenants/:id/restore", handlers.RestoreTenantHandler, middleware.RequirePermission(auth.PermTenantsRestore))
+
+	canConsume := middleware.RequirePermission(auth.PermMessagesConsume)
+	e.GET("/tenants/:id/consumers", handlers.ListConsumersHandler, canConsume, middleware.TenantDB)
+	e.POST("/tenants/:id/consumers", handlers.StartConsumerHandler, canConsume, middleware.TenantDB)
+	e.DELETE("/tenants/:id/consumers/:tag", handlers.StopConsumerHandler, canConsume, middleware.TenantDB)
+	e.GET("/tenants/:id/queue", handlers.QueueStatsHandler, canConsume, middleware.TenantDB)
+	// Streams last as long as the client stays connected, so they do not hold
+	// a tenant database connection.
+	e.GET("/tenants/:id/stream", handlers.StreamHandler, canConsume)
+	e.GET("/tenants/:id/ws", handlers.WebSocketHandler, canConsume)
+	e.GET("/tenants/:id/dead-letters", handlers.ListDeadLettersHandler, canConsume, middleware.TenantDB)
+	e.POST("/tenants/:id/dead-letters/replay", handlers.ReplayDeadLettersHandler, canConsume, middleware.TenantDB)
+	e.POST("/tenants/:id/dead-letters/discard", handlers.DiscardDeadLettersHandler, canConsume, middleware.TenantDB)
+
+	e.GET("/consumers", handlers.ConsumerHandler, resolveTenant, middleware.RequirePermission(auth.PermMessagesConsume), middleware.TenantDB)
+	e.POST("/producers", handlers.ProducerHandler, resolveTenant, middleware.RequirePermission(auth.PermMessagesPublish), middleware.TenantDB)
+
+	tenantScoped := e.Group("/t/:tenant", resolveTenant)
+	tenantScoped.GET("/consumers", handlers.ConsumerHandler, middleware.RequirePermission(auth.PermMessagesConsume), middleware.TenantDB)
+	tenantScoped.POST("/producers", handlers.ProducerHandler, middleware.RequirePermission(auth.PermMessagesPublish), middleware.TenantDB)
 }
@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/middleware"
+
+	"github.com/labstack/echo/v4"
+)
+
+func RegisterUserRoutes(e *echo.Echo) {
+	canRead := middleware.RequirePermission(auth.PermUsersRead)
+	canWrite := middleware.RequirePermission(auth.PermUsersWrite)
+
+	users := e.Group("/tenants/:id/users")
+	users.POST("", handlers.CreateUserHandler, canWrite, middleware.TenantDB)
+	users.GET("", handlers.ListUsersHandler, canRead, middleware.TenantDB)
+	users.GET("/:userId", handlers.GetUserHandler, canRead, middleware.TenantDB)
+	users.PATCH("/:userId", handlers.UpdateUserHandler, canWrite, middleware.TenantDB)
+	users.DELETE("/:userId", handlers.DeleteUserHandler, canWrite, middleware.TenantDB)
+	users.POST("/:userId/restore", handlers.RestoreUserHandler, canWrite, middleware.TenantDB)
+
+	e.GET("/tenants/:id/password-policy", handlers.GetPasswordPolicyHandler, middleware.RequirePermission(auth.PermTenantsRead), middleware.TenantDB)
+	e.PUT("/tenants/:id/password-policy", handlers.UpdatePasswordPolicyHandler, middleware.RequirePermission(auth.PermTenantsUpdate), middleware.TenantDB)
+}
@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	oldSigningKey = "old-signing-key-0123456789abcdef0123"
+	newSigningKey = "new-signing-key-0123456789abcdef0123"
+)
+
+func newTokenManager(t *testing.T, activeKeyID string, keys ...config.JWTKey) *auth.TokenManager {
+	tokens, err := auth.NewTokenManager(config.Config{
+		JWTKeys:        keys,
+		JWTActiveKeyID: activeKeyID,
+		JWTIssuer:      "test",
+		AccessTokenTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token manager: %v", err)
+	}
+	return tokens
+}
+
+func TestAccessTokenKeyRotation(t *testing.T) {
+	oldKey := config.JWTKey{ID: "old", Secret: oldSigningKey}
+	newKey := config.JWTKey{ID: "new", Secret: newSigningKey}
+
+	before := newTokenManager(t, "old", oldKey)
+	token, err := before.IssueAccessToken(7, 3, []string{auth.RoleTenantMember})
+	assert.NoError(t, err)
+
+	rotated := newTokenManager(t, "new", newKey, oldKey)
+	claims, err := rotated.ParseAccessToken(token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 7, claims.UserID)
+		assert.Equal(t, 3, claims.TenantID)
+		assert.Equal(t, []string{auth.RoleTenantMember}, claims.Roles)
+	}
+
+	retired := newTokenManager(t, "new", newKey)
+	_, err = retired.ParseAccessToken(token)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+	tokens := newTokenManager(t, "new", config.JWTKey{ID: "new", Secret: newSigningKey})
+
+	e := setupEcho()
+	e.Use(middleware.Authenticate(tokens, "/public"))
+	e.GET("/public", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.GET("/private", func(c echo.Context) error {
+		claims, _ := middleware.ClaimsFromContext(c)
+		return c.JSON(http.StatusOK, claims.UserID)
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/public", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/private", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	token, err := tokens.IssueAccessToken(7, 3, nil)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/private", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "7\n", rec.Body.String())
+}
+
+func TestAPIKeyFormat(t *testing.T) {
+	key, prefix, hash, err := auth.NewAPIKey()
+	assert.NoError(t, err)
+
+	parsed, ok := auth.APIKeyPrefix(key)
+	assert.True(t, ok)
+	assert.Equal(t, prefix, parsed)
+	assert.True(t, auth.CheckAPIKey(key, hash))
+	assert.False(t, auth.CheckAPIKey(key+"x", hash))
+
+	_, ok = auth.APIKeyPrefix("not-an-api-key")
+	assert.False(t, ok)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	e := setupEcho()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(middleware.ClaimsContextKey, &auth.Claims{TenantID: 3, APIKeyID: 1, Scopes: []string{auth.PermMessagesPublish}})
+			return next(c)
+		}
+	})
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.POST("/producers", ok, middleware.RequirePermission(auth.PermMessagesPublish))
+	e.GET("/consumers", ok, middleware.RequirePermission(auth.PermMessagesConsume))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/producers", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/consumers", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestCreateAPIKeyScopesLimitedToCaller(t *testing.T) {
+	cases := []struct {
+		name   string
+		claims *auth.Claims
+		scope  string
+	}{
+		{"user without the scope", &auth.Claims{UserID: 1, TenantID: 3, Roles: []string{auth.RoleTenantMember}}, auth.PermUsersWrite},
+		{"API key without the scope", &auth.Claims{TenantID: 3, APIKeyID: 1, Scopes: []string{auth.PermAPIKeysWrite}}, auth.PermRolesWrite},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"name":"ci","scopes":["` + tc.scope + `"]}`
+			req := httptest.NewRequest(http.MethodPost, "/tenants/3/api-keys", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := setupEcho().NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues("3")
+			c.Set("logger", logs.SetupLogger())
+			c.Set(middleware.ClaimsContextKey, tc.claims)
+
+			assert.NoError(t, handlers.CreateAPIKeyHandler(c))
+			assert.Equal(t, http.StatusForbidden, rec.Code)
+		})
+	}
+}
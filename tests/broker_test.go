@@ -0,0 +1,478 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jatis_mobile_api/broker"
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/logs"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMemoryBroker returns an in-memory broker with a tenant queue bound to
+// amq.direct under its own name.
+func newMemoryBroker(t *testing.T, queueName string, settings broker.QueueSettings) *broker.Memory {
+	b := broker.NewMemory(settings)
+	ctx := context.Background()
+	assert.NoError(t, b.DeclareTenantQueue(ctx, queueName))
+	assert.NoError(t, b.BindQueue(ctx, queueName, "amq.direct", queueName))
+	return b
+}
+
+func publishTo(t *testing.T, b broker.Broker, queueName, messageID string) {
+	err := b.Publish(context.Background(), "amq.direct", queueName, broker.Message{MessageID: messageID, Type: "test", Body: []byte(messageID)})
+	assert.NoError(t, err)
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	ctx := context.Background()
+	b := newMemoryBroker(t, "acme", broker.QueueSettings{})
+
+	publishTo(t, b, "acme", "m1")
+	stats, err := b.QueueStats(ctx, "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, broker.QueueStats{Messages: 1}, stats)
+
+	err = b.Publish(ctx, "amq.direct", "unknown", broker.Message{})
+	assert.True(t, errors.Is(err, broker.ErrUnroutable))
+	err = b.Publish(ctx, "missing", "acme", broker.Message{})
+	assert.True(t, broker.IsNotFound(err))
+
+	assert.NoError(t, b.UnbindQueue(ctx, "acme", "amq.direct", "acme"))
+	err = b.Publish(ctx, "amq.direct", "acme", broker.Message{})
+	assert.True(t, errors.Is(err, broker.ErrUnroutable))
+
+	_, err = b.QueueStats(ctx, "unknown")
+	assert.True(t, broker.IsNotFound(err))
+}
+
+func TestMemoryBrokerConsumeAndAck(t *testing.T) {
+	const tenantID = 9101
+	var handled int32
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, func(ctx context.Context, msg rabbitmq.Message) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	ctx := context.Background()
+	b := newMemoryBroker(t, "consume", broker.QueueSettings{})
+	for _, id := range []string{"m1", "m2", "m3"} {
+		publishTo(t, b, "consume", id)
+	}
+
+	_, err := b.Consume(ctx, tenantID, "consume", "worker", 1)
+	assert.NoError(t, err)
+	_, err = b.Consume(ctx, tenantID, "consume", "worker", 1)
+	assert.True(t, errors.Is(err, broker.ErrConsumerExists))
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&handled) == 3 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		consumers := b.Consumers(tenantID)
+		return len(consumers) == 1 && consumers[0].MessagesProcessed == 3
+	}, time.Second, 5*time.Millisecond)
+
+	stats, err := b.QueueStats(ctx, "consume")
+	assert.NoError(t, err)
+	assert.Equal(t, broker.QueueStats{Messages: 0, Consumers: 1}, stats)
+
+	assert.NoError(t, b.StopConsuming(ctx, tenantID, "worker"))
+	assert.True(t, errors.Is(b.StopConsuming(ctx, tenantID, "worker"), broker.ErrConsumerNotFound))
+	assert.Empty(t, b.Consumers(tenantID))
+}
+
+func TestMemoryBrokerPrefetch(t *testing.T) {
+	const tenantID = 9102
+	release := make(chan struct{})
+	var started int32
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, func(ctx context.Context, msg rabbitmq.Message) error {
+		atomic.AddInt32(&started, 1)
+		<-release
+		return nil
+	})
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	ctx := context.Background()
+	b := newMemoryBroker(t, "prefetch", broker.QueueSettings{})
+	for _, id := range []string{"m1", "m2", "m3"} {
+		publishTo(t, b, "prefetch", id)
+	}
+
+	_, err := b.Consume(ctx, tenantID, "prefetch", "worker", 2)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&started) == 2 }, time.Second, 5*time.Millisecond)
+
+	stats, _ := b.QueueStats(ctx, "prefetch")
+	assert.Equal(t, 1, stats.Messages, "messages beyond the prefetch stay in the queue")
+
+	close(release)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&started) == 3 }, time.Second, 5*time.Millisecond)
+	assert.NoError(t, b.StopConsuming(ctx, tenantID, "worker"))
+}
+
+func TestMemoryBrokerRetriesThenDeadLetters(t *testing.T) {
+	const tenantID = 9103
+	var attempts int32
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, func(ctx context.Context, msg rabbitmq.Message) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("temporarily unavailable")
+	})
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	ctx := context.Background()
+	b := newMemoryBroker(t, "retry", broker.QueueSettings{RetryDelays: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}})
+	_, err := b.Consume(ctx, tenantID, "retry", "worker", 1)
+	assert.NoError(t, err)
+	defer b.StopConsuming(ctx, tenantID, "worker")
+
+	publishTo(t, b, "retry", "m1")
+
+	var letters []broker.DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = b.DeadLetters(ctx, "retry", 10)
+		return len(letters) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts), "one attempt and one per retry tier")
+	assert.Equal(t, "m1", letters[0].MessageID)
+	assert.Equal(t, 2, letters[0].Retries)
+	// The message was first dead-lettered when its retry delay expired.
+	assert.Equal(t, "expired", letters[0].Reason)
+}
+
+func TestMemoryBrokerPermanentErrorsAndReplay(t *testing.T) {
+	const tenantID = 9104
+	var fixed atomic.Bool
+	var handled sync.Map
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, func(ctx context.Context, msg rabbitmq.Message) error {
+		if !fixed.Load() {
+			return rabbitmq.Permanent(errors.New("malformed body"))
+		}
+		handled.Store(msg.MessageID, true)
+		return nil
+	})
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	ctx := context.Background()
+	b := newMemoryBroker(t, "replay", broker.QueueSettings{})
+	_, err := b.Consume(ctx, tenantID, "replay", "worker", 1)
+	assert.NoError(t, err)
+	defer b.StopConsuming(ctx, tenantID, "worker")
+
+	for _, id := range []string{"m1", "m2", "m3"} {
+		publishTo(t, b, "replay", id)
+	}
+
+	var letters []broker.DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = b.DeadLetters(ctx, "replay", 10)
+		return len(letters) == 3
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "rejected", letters[0].Reason)
+	assert.Equal(t, 0, letters[0].Retries)
+
+	fixed.Store(true)
+	replayed, err := b.ReplayDeadLetters(ctx, "replay", []string{"m2"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Eventually(t, func() bool {
+		_, ok := handled.Load("m2")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+
+	discarded, err := b.DiscardDeadLetters(ctx, "replay", nil, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, discarded)
+
+	letters, err = b.DeadLetters(ctx, "replay", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "m3", letters[0].MessageID)
+	}
+}
+
+func TestMemoryBrokerDeliveryLimit(t *testing.T) {
+	const tenantID = 9105
+	var deliveries, redeliveries int32
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, func(ctx context.Context, msg rabbitmq.Message) error {
+		atomic.AddInt32(&deliveries, 1)
+		if msg.Redelivered {
+			atomic.AddInt32(&redeliveries, 1)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	ctx := context.Background()
+	b := newMemoryBroker(t, "limit", broker.QueueSettings{DeliveryLimit: 2})
+	publishTo(t, b, "limit", "m1")
+
+	// Stopping a consumer with an unsettled message requeues it, until it
+	// was delivered more often than the delivery limit.
+	for i := int32(1); i <= 3; i++ {
+		_, err := b.Consume(ctx, tenantID, "limit", "worker", 1)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&deliveries) == i }, time.Second, 5*time.Millisecond)
+		assert.NoError(t, b.StopConsuming(ctx, tenantID, "worker"))
+	}
+
+	var letters []broker.DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = b.DeadLetters(ctx, "limit", 10)
+		return len(letters) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "delivery_limit", letters[0].Reason)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&redeliveries))
+}
+
+func TestMemoryBrokerMoveAndDelete(t *testing.T) {
+	ctx := context.Background()
+	b := newMemoryBroker(t, "old", broker.QueueSettings{})
+	assert.NoError(t, b.DeclareTenantQueue(ctx, "new"))
+	publishTo(t, b, "old", "m1")
+	publishTo(t, b, "old", "m2")
+
+	moved, err := b.MoveMessages(ctx, "old", "new")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	deleted, err := b.DeleteQueue(ctx, "new")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	_, err = b.DeadLetters(ctx, "new", 10)
+	assert.True(t, broker.IsNotFound(err), "the dead-letter queue is deleted with its tenant queue")
+
+	// Purging a soft-deleted tenant deletes its queue a second time.
+	deleted, err = b.DeleteQueue(ctx, "new")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestMemoryBrokerStopRequeuesUnsettled(t *testing.T) {
+	const tenantID = 9108
+	ctx := context.Background()
+	b := newMemoryBroker(t, "stopped", broker.QueueSettings{})
+	release := make(chan struct{})
+	defer close(release)
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, func(ctx context.Context, msg rabbitmq.Message) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	info, err := b.Consume(ctx, tenantID, "stopped", "worker", 2)
+	assert.NoError(t, err)
+	assert.False(t, info.Stream)
+	publishTo(t, b, "stopped", "m1")
+	publishTo(t, b, "stopped", "m2")
+	publishTo(t, b, "stopped", "m3")
+	assert.Eventually(t, func() bool {
+		stats, err := b.QueueStats(ctx, "stopped")
+		return err == nil && stats.Messages == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// The unsettled messages are back in the queue as soon as the consumer
+	// is stopped, in their original order, and can be moved along.
+	assert.NoError(t, b.StopConsuming(ctx, tenantID, "worker"))
+	stats, err := b.QueueStats(ctx, "stopped")
+	assert.NoError(t, err)
+	assert.Equal(t, broker.QueueStats{Messages: 3}, stats)
+
+	assert.NoError(t, b.DeclareTenantQueue(ctx, "moved"))
+	moved, err := b.MoveMessages(ctx, "stopped", "moved")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, moved)
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	received := make(chan string, 3)
+	go b.Stream(streamCtx, tenantID, "moved", "reader", 1, func(ctx context.Context, msg broker.Delivery) error {
+		received <- msg.MessageID
+		return nil
+	})
+	assert.Equal(t, "m1", <-received)
+	assert.Equal(t, "m2", <-received)
+	assert.Equal(t, "m3", <-received)
+}
+
+func TestMemoryBrokerStream(t *testing.T) {
+	const tenantID = 9106
+	b := newMemoryBroker(t, "stream", broker.QueueSettings{})
+	publishTo(t, b, "stream", "m1")
+	publishTo(t, b, "stream", "m2")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan string, 3)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Stream(ctx, tenantID, "stream", "stream-1", 1, func(ctx context.Context, msg broker.Delivery) error {
+			received <- msg.MessageID
+			return nil
+		})
+	}()
+
+	assert.Equal(t, "m1", <-received)
+	assert.Equal(t, "m2", <-received)
+	publishTo(t, b, "stream", "m3")
+	assert.Equal(t, "m3", <-received)
+	assert.Len(t, b.Consumers(tenantID), 1, "streams are listed with the other consumers")
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Empty(t, b.Consumers(tenantID))
+	stats, err := b.QueueStats(context.Background(), "stream")
+	assert.NoError(t, err)
+	assert.Equal(t, broker.QueueStats{}, stats, "written messages are acknowledged")
+}
+
+func TestMemoryBrokerStreamEndsAtFailedWrite(t *testing.T) {
+	const tenantID = 9107
+	ctx := context.Background()
+	b := newMemoryBroker(t, "stream-fail", broker.QueueSettings{})
+	publishTo(t, b, "stream-fail", "m1")
+
+	err := b.Stream(ctx, tenantID, "stream-fail", "stream-1", 1, func(ctx context.Context, msg broker.Delivery) error {
+		return errors.New("broken pipe")
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, b.Consumers(tenantID))
+
+	dead, err := b.DeadLetters(ctx, "stream-fail", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, dead, "a failed write does not retry the message")
+
+	received := make(chan broker.Delivery, 1)
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go b.Stream(streamCtx, tenantID, "stream-fail", "stream-2", 1, func(ctx context.Context, msg broker.Delivery) error {
+		received <- msg
+		return nil
+	})
+	msg := <-received
+	assert.Equal(t, "m1", msg.MessageID)
+	assert.True(t, msg.Redelivered)
+
+	err = b.Stream(ctx, tenantID, "missing", "stream-3", 1, nil)
+	assert.True(t, broker.IsNotFound(err))
+}
+
+func TestProducerHandlerWithMemoryBroker(t *testing.T) {
+	b := newMemoryBroker(t, "acme", broker.QueueSettings{})
+	e := echo.New()
+
+	produce := func(tenantName string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/producers", bytes.NewBufferString(`{"text":"hello"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("logger", logs.SetupLogger())
+		c.Set(middleware.BrokerContextKey, broker.Broker(b))
+		c.Set(middleware.TenantContextKey, &models.Tenant{ID: 1, Name: tenantName})
+		assert.NoError(t, handlers.ProducerHandler(c))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, produce("acme").Code)
+	stats, err := b.QueueStats(context.Background(), "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Messages)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, produce("unbound").Code)
+}
+
+func TestReplayProducedDeadLetterByID(t *testing.T) {
+	const tenantID = 9108
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, func(ctx context.Context, msg rabbitmq.Message) error {
+		return rabbitmq.Permanent(errors.New("malformed body"))
+	})
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	ctx := context.Background()
+	b := newMemoryBroker(t, "produced", broker.QueueSettings{})
+	e := echo.New()
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/producers", bytes.NewBufferString(`{"text":"hello"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("logger", logs.SetupLogger())
+		c.Set(middleware.BrokerContextKey, broker.Broker(b))
+		c.Set(middleware.TenantContextKey, &models.Tenant{ID: tenantID, Name: "produced"})
+		assert.NoError(t, handlers.ProducerHandler(c))
+
+		var response struct {
+			MessageID string `json:"message_id"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.NotEmpty(t, response.MessageID)
+		ids = append(ids, response.MessageID)
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+
+	_, err := b.Consume(ctx, tenantID, "produced", "worker", 1)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		dead, _ := b.DeadLetters(ctx, "produced", 10)
+		return len(dead) == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.NoError(t, b.StopConsuming(ctx, tenantID, "worker"))
+
+	replayed, err := b.ReplayDeadLetters(ctx, "produced", []string{ids[1]}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	dead, err := b.DeadLetters(ctx, "produced", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, ids[0], dead[0].MessageID)
+	}
+	stats, err := b.QueueStats(ctx, "produced")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Messages)
+}
+
+func TestHandlerWithoutBroker(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/producers", bytes.NewBufferString(`{"text":"hello"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set("logger", logs.SetupLogger())
+	c.Set(middleware.TenantContextKey, &models.Tenant{ID: 1, Name: "acme"})
+
+	assert.True(t, errors.Is(middleware.Broker(c).Publish(context.Background(), "amq.direct", "acme", broker.Message{}), broker.ErrUnavailable))
+	assert.NotPanics(t, func() { handlers.ProducerHandler(c) })
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestPostgresBrokerWithoutDatabase(t *testing.T) {
+	ctx := context.Background()
+	b := broker.NewPostgres(nil, broker.QueueSettings{}, broker.PostgresSettings{})
+
+	err := b.Publish(ctx, "amq.topic", "acme", broker.Message{})
+	assert.True(t, broker.IsNotFound(err), "only amq.direct and the default exchange exist")
+	assert.True(t, errors.Is(err, broker.ErrNotFound))
+	assert.True(t, broker.IsNotFound(b.BindQueue(ctx, "acme", "amq.fanout", "acme")))
+
+	assert.Empty(t, b.Consumers(1))
+	assert.True(t, errors.Is(b.StopConsuming(ctx, 1, "worker"), broker.ErrConsumerNotFound))
+}
@@ -0,0 +1,19 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartConsumerWithoutConnection(t *testing.T) {
+	_, err := rabbitmq.StartConsumer(1, "tenant", "tenant", 0)
+	assert.True(t, errors.Is(err, amqp091.ErrClosed))
+	assert.Empty(t, rabbitmq.ListConsumers(1), "a consumer that failed to start must not be registered")
+
+	assert.True(t, errors.Is(rabbitmq.StopConsumer(1, "tenant"), rabbitmq.ErrConsumerNotFound))
+}
@@ -0,0 +1,17 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterQueueNames(t *testing.T) {
+	assert.Equal(t, "acme.dlq", rabbitmq.DeadLetterQueue("acme"))
+	assert.Equal(t, "acme.retry.10s", rabbitmq.RetryQueue("acme", 10*time.Second))
+	assert.Equal(t, "acme.retry.1m0s", rabbitmq.RetryQueue("acme", time.Minute))
+	assert.NotEqual(t, rabbitmq.RetryQueue("acme", time.Second), rabbitmq.RetryQueue("acme", 10*time.Second))
+}
@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageHandlerLookup(t *testing.T) {
+	named := func(name string) rabbitmq.Handler {
+		return func(ctx context.Context, msg rabbitmq.Message) error { return errors.New(name) }
+	}
+	call := func(tenantID int, messageType string) string {
+		handler, ok := rabbitmq.HandlerFor(tenantID, messageType)
+		if !ok {
+			return ""
+		}
+		return handler(context.Background(), rabbitmq.Message{}).Error()
+	}
+
+	_, ok := rabbitmq.HandlerFor(7, "invoice.paid")
+	assert.False(t, ok)
+
+	rabbitmq.RegisterHandler(rabbitmq.AnyTenant, rabbitmq.AnyType, named("fallback"))
+	rabbitmq.RegisterHandler(rabbitmq.AnyTenant, "invoice.paid", named("any tenant"))
+	rabbitmq.RegisterHandler(7, rabbitmq.AnyType, named("tenant"))
+	rabbitmq.RegisterHandler(7, "invoice.paid", named("tenant and type"))
+	defer func() {
+		rabbitmq.UnregisterHandler(rabbitmq.AnyTenant, rabbitmq.AnyType)
+		rabbitmq.UnregisterHandler(rabbitmq.AnyTenant, "invoice.paid")
+		rabbitmq.UnregisterHandler(7, rabbitmq.AnyType)
+		rabbitmq.UnregisterHandler(7, "invoice.paid")
+	}()
+
+	assert.Equal(t, "tenant and type", call(7, "invoice.paid"))
+	assert.Equal(t, "tenant", call(7, "invoice.void"))
+	assert.Equal(t, "any tenant", call(8, "invoice.paid"))
+	assert.Equal(t, "fallback", call(8, "invoice.void"))
+}
+
+func TestLogHandlerAcknowledges(t *testing.T) {
+	const tenantID = 9201
+	rabbitmq.RegisterHandler(tenantID, rabbitmq.AnyType, rabbitmq.LogHandler)
+	defer rabbitmq.UnregisterHandler(tenantID, rabbitmq.AnyType)
+
+	err := rabbitmq.Dispatch(context.Background(), rabbitmq.Message{TenantID: tenantID, Type: "tenant.created", Body: []byte("Tenant created successfully")})
+	assert.NoError(t, err)
+}
+
+func TestPermanentHandlerError(t *testing.T) {
+	cause := errors.New("malformed body")
+
+	assert.True(t, rabbitmq.IsPermanent(rabbitmq.Permanent(cause)))
+	assert.True(t, errors.Is(rabbitmq.Permanent(cause), cause))
+	assert.False(t, rabbitmq.IsPermanent(cause))
+	assert.Nil(t, rabbitmq.Permanent(nil))
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/migrations"
+	"jatis_mobile_api/models"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	loaded, err := migrations.Load()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loaded)
+
+	for i, m := range loaded {
+		if i > 0 {
+			assert.Greater(t, m.Version, loaded[i-1].Version, "migrations must be ordered by version")
+		}
+		assert.NotEmpty(t, m.Up, "migration %d_%s has no up SQL", m.Version, m.Name)
+		assert.True(t, m.HasDown(), "migration %d_%s has no down migration", m.Version, m.Name)
+	}
+	assert.Equal(t, "create_tenants", loaded[0].Name)
+}
+
+func TestMigrationChecksum(t *testing.T) {
+	m := migrations.Migration{Version: 1, Name: "create_tenants", Up: "CREATE TABLE tenants ();"}
+	assert.Equal(t, m.Checksum(), m.Checksum())
+	assert.Len(t, m.Checksum(), 64)
+
+	edited := m
+	edited.Up = "CREATE TABLE tenants (id INT);"
+	assert.NotEqual(t, m.Checksum(), edited.Checksum())
+}
+
+func TestLoadTenantMigrations(t *testing.T) {
+	loaded, err := migrations.LoadTenant()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loaded)
+
+	for _, m := range loaded {
+		assert.True(t, m.HasDown(), "tenant migration %d_%s has no down migration", m.Version, m.Name)
+	}
+}
+
+// Tenant migrations that were shipped must never change, or tenant schemas
+// and databases migrated with them fail with ErrChecksumMismatch.
+func TestShippedTenantMigrationsAreUnchanged(t *testing.T) {
+	shipped := map[int64]string{
+		1: "e5c7060f720fd591bffffb205d4a87f7b930d0527f9766df9aba533557631be7",
+		2: "51064748a1309b50d0d37562c82b1a27892753c6768f1a91faeb7c504e8849a0",
+	}
+	shippedToDatabases := map[int64]string{
+		1: "07b48f7b0963242ab9611ee23988e8bd94ad4551ba2c07da6d9482c4bf9e541a",
+		2: "8b4a6e78394ddcf5a6c2e4feb68e54d5ed829994ad03a93ecbb2440ea15033d4",
+	}
+
+	schemaMigrations, err := migrations.LoadTenant()
+	assert.NoError(t, err)
+	databaseMigrations, err := migrations.LoadTenantDatabase()
+	assert.NoError(t, err)
+	assert.Len(t, databaseMigrations, len(schemaMigrations))
+
+	for i, m := range schemaMigrations {
+		if checksum, ok := shipped[m.Version]; ok {
+			assert.Equal(t, checksum, m.Checksum(), "tenant migration %d_%s was modified", m.Version, m.Name)
+		}
+		d := databaseMigrations[i]
+		assert.Equal(t, m.Version, d.Version)
+		if checksum, ok := shippedToDatabases[d.Version]; ok {
+			assert.Equal(t, checksum, d.Checksum(), "tenant database migration %d_%s was modified", d.Version, d.Name)
+		}
+		assert.NotContains(t, d.Up, "REFERENCES", "dedicated tenant databases have no shared tables")
+	}
+}
+
+func TestTenantIsolationMode(t *testing.T) {
+	defer database.SetIsolation(database.IsolationShared)
+
+	assert.NoError(t, database.SetIsolation(""))
+	assert.Equal(t, database.IsolationShared, database.Isolation())
+	assert.NoError(t, database.SetIsolation(database.IsolationSchema))
+	assert.Equal(t, database.IsolationSchema, database.Isolation())
+	assert.Error(t, database.SetIsolation("separate"))
+
+	assert.Equal(t, "tenant_42", database.TenantSchema(42))
+}
+
+// Every shared table holding tenant rows must be covered by a row-level
+// security policy, so that forgetting a tenant_id filter cannot leak rows.
+func TestTenantTablesHaveRowLevelSecurity(t *testing.T) {
+	loaded, err := migrations.Load()
+	assert.NoError(t, err)
+
+	var all strings.Builder
+	for _, m := range loaded {
+		all.WriteString(m.Up)
+	}
+	schema := all.String()
+
+	createTable := regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS (\w+) \((.*?)\n\);`)
+	for _, m := range loaded {
+		for _, match := range createTable.FindAllStringSubmatch(m.Up, -1) {
+			table, columns := match[1], match[2]
+			if !strings.Contains(columns, "tenant_id ") {
+				continue
+			}
+			assert.Contains(t, schema, "ALTER TABLE "+table+" FORCE ROW LEVEL SECURITY", "table %s has no row-level security", table)
+		}
+	}
+}
+
+func TestRowLevelSecurityFailsClosed(t *testing.T) {
+	requireDatabase(t)
+	ctx := context.Background()
+	system := database.SystemDB()
+
+	// Superusers bypass row-level security, so the queries run as a role
+	// that does not.
+	_, err := system.Exec(ctx, `DO $$ BEGIN
+		IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'rls_test') THEN
+			CREATE ROLE rls_test NOLOGIN;
+		END IF;
+	END $$`)
+	if err == nil {
+		_, err = system.Exec(ctx, "GRANT SELECT ON users TO rls_test")
+	}
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var tenants [2]*models.Tenant
+	for i := range tenants {
+		tenants[i] = &models.Tenant{Name: fmt.Sprintf("%s-%d-%d", t.Name(), i, time.Now().UnixNano())}
+		if !assert.NoError(t, models.CreateTenant(system, tenants[i])) {
+			return
+		}
+		tenantID := tenants[i].ID
+		t.Cleanup(func() { models.DeleteTenant(database.SystemDB(), tenantID) })
+
+		user := &models.User{TenantID: tenantID, Username: "rls", Email: "rls@example.com", PasswordHash: "x"}
+		if !assert.NoError(t, models.CreateUser(system, user)) {
+			return
+		}
+	}
+	own, other := tenants[0], tenants[1]
+
+	otherUsers := func(db database.DBTX, currentTenant string) int {
+		var count int
+		err := database.InTx(ctx, db, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, "SET LOCAL ROLE rls_test"); err != nil {
+				return err
+			}
+			if currentTenant != "" {
+				if _, err := tx.Exec(ctx, "SELECT set_config('app.current_tenant', $1, true)", currentTenant); err != nil {
+					return err
+				}
+			}
+			return tx.QueryRow(ctx, "SELECT count(*) FROM users WHERE tenant_id = $1", other.ID).Scan(&count)
+		})
+		assert.NoError(t, err)
+		return count
+	}
+
+	assert.Equal(t, 0, otherUsers(database.GetDB(), ""), "unset tenant")
+	assert.Equal(t, 0, otherUsers(database.GetDB(), strconv.Itoa(own.ID)), "foreign tenant")
+	assert.Equal(t, 1, otherUsers(database.GetDB(), strconv.Itoa(other.ID)), "own tenant")
+	assert.Equal(t, 1, otherUsers(system, ""), "system pool")
+}
@@ -0,0 +1,20 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	settings := rabbitmq.OutboxSettings{RetryDelay: time.Second, MaxRetryDelay: 10 * time.Second}
+
+	assert.Equal(t, time.Second, settings.Backoff(1))
+	assert.Equal(t, 2*time.Second, settings.Backoff(2))
+	assert.Equal(t, 8*time.Second, settings.Backoff(4))
+	assert.Equal(t, 10*time.Second, settings.Backoff(5))
+	assert.Equal(t, 10*time.Second, settings.Backoff(100))
+}
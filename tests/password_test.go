@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupPasswords(t *testing.T, cfg config.Config) {
+	if err := auth.SetupPasswords(cfg); err != nil {
+		t.Fatalf("Failed to set up passwords: %v", err)
+	}
+}
+
+func TestPasswordRehashOnParameterChange(t *testing.T) {
+	setupPasswords(t, config.Config{PasswordAlgorithm: auth.AlgorithmBcrypt, BcryptCost: 4})
+	bcryptHash, err := auth.HashPassword("correct horse battery")
+	assert.NoError(t, err)
+
+	valid, needsRehash := auth.VerifyPassword(bcryptHash, "correct horse battery")
+	assert.True(t, valid)
+	assert.False(t, needsRehash)
+
+	valid, _ = auth.VerifyPassword(bcryptHash, "wrong password")
+	assert.False(t, valid)
+
+	setupPasswords(t, config.Config{PasswordAlgorithm: auth.AlgorithmArgon2id, Argon2Memory: 1024, Argon2Iterations: 1, Argon2Parallelism: 1})
+	valid, needsRehash = auth.VerifyPassword(bcryptHash, "correct horse battery")
+	assert.True(t, valid)
+	assert.True(t, needsRehash)
+
+	argonHash, err := auth.HashPassword("correct horse battery")
+	assert.NoError(t, err)
+	valid, needsRehash = auth.VerifyPassword(argonHash, "correct horse battery")
+	assert.True(t, valid)
+	assert.False(t, needsRehash)
+
+	setupPasswords(t, config.Config{PasswordAlgorithm: auth.AlgorithmArgon2id, Argon2Memory: 2048, Argon2Iterations: 1, Argon2Parallelism: 1})
+	_, needsRehash = auth.VerifyPassword(argonHash, "correct horse battery")
+	assert.True(t, needsRehash)
+}
+
+func TestValidatePassword(t *testing.T) {
+	breachedFile := filepath.Join(t.TempDir(), "breached.txt")
+	// SHA-1 of "password1234" in Have I Been Pwned format, and a plaintext entry.
+	content := "E6B6AFBD6D76BB5D2041542D7D2E3FAC5BB05593:42\nletmein12345\n"
+	if err := os.WriteFile(breachedFile, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write breached password file: %v", err)
+	}
+	setupPasswords(t, config.Config{Argon2Memory: 1024, Argon2Iterations: 1, Argon2Parallelism: 1, BreachedPasswordsFile: breachedFile})
+
+	policy := models.PasswordPolicy{MinLength: 12, CheckBreached: true, HistorySize: 2}
+
+	assert.ErrorIs(t, auth.ValidatePassword(policy, "short", nil), auth.ErrPasswordTooShort)
+	assert.ErrorIs(t, auth.ValidatePassword(policy, "password1234", nil), auth.ErrPasswordBreached)
+	assert.ErrorIs(t, auth.ValidatePassword(policy, "letmein12345", nil), auth.ErrPasswordBreached)
+
+	previous, err := auth.HashPassword("an old passphrase")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, auth.ValidatePassword(policy, "an old passphrase", []string{previous}), auth.ErrPasswordReused)
+	assert.NoError(t, auth.ValidatePassword(policy, "a brand new passphrase", []string{previous}))
+
+	policy.CheckBreached = false
+	assert.NoError(t, auth.ValidatePassword(policy, "password1234", nil))
+}
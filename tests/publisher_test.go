@@ -0,0 +1,17 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishMessageWithoutConnection(t *testing.T) {
+	err := rabbitmq.PublishMessage(context.Background(), "amq.direct", "tenant", []byte(`{}`))
+	assert.True(t, errors.Is(err, amqp091.ErrClosed))
+}
@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/middleware"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequirePermission(t *testing.T) {
+	cases := []struct {
+		name       string
+		roles      []string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"platform admin on any tenant", []string{auth.RolePlatformAdmin}, http.MethodDelete, "/tenants/9", http.StatusOK},
+		{"tenant admin on own tenant", []string{auth.RoleTenantAdmin}, http.MethodPatch, "/tenants/3", http.StatusOK},
+		{"tenant admin on other tenant", []string{auth.RoleTenantAdmin}, http.MethodPatch, "/tenants/9", http.StatusForbidden},
+		{"tenant admin without permission", []string{auth.RoleTenantAdmin}, http.MethodDelete, "/tenants/3", http.StatusForbidden},
+		{"tenant member without permission", []string{auth.RoleTenantMember}, http.MethodPatch, "/tenants/3", http.StatusForbidden},
+		{"no roles", nil, http.MethodGet, "/tenants/3", http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := setupEcho()
+			e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					c.Set(middleware.ClaimsContextKey, &auth.Claims{UserID: 1, TenantID: 3, Roles: tc.roles})
+					return next(c)
+				}
+			})
+			ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+			e.GET("/tenants/:id", ok, middleware.RequirePermission(auth.PermTenantsRead))
+			e.PATCH("/tenants/:id", ok, middleware.RequirePermission(auth.PermTenantsUpdate))
+			e.DELETE("/tenants/:id", ok, middleware.RequirePermission(auth.PermTenantsDelete))
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+			assert.Equal(t, tc.wantStatus, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/rabbitmq"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	settings := rabbitmq.ReconnectSettings{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for i := 0; i < 50; i++ {
+		first := settings.Backoff(1)
+		assert.GreaterOrEqual(t, first, 50*time.Millisecond)
+		assert.LessOrEqual(t, first, 100*time.Millisecond)
+
+		third := settings.Backoff(3)
+		assert.GreaterOrEqual(t, third, 200*time.Millisecond)
+		assert.LessOrEqual(t, third, 400*time.Millisecond)
+
+		capped := settings.Backoff(20)
+		assert.GreaterOrEqual(t, capped, 500*time.Millisecond)
+		assert.LessOrEqual(t, capped, time.Second)
+	}
+}
+
+func TestBrokerEventsHandler(t *testing.T) {
+	type recorded struct {
+		Type    rabbitmq.EventType `json:"type"`
+		Attempt int                `json:"attempt"`
+		Delay   string             `json:"delay"`
+		Error   string             `json:"error"`
+	}
+	list := func() []recorded {
+		rec := httptest.NewRecorder()
+		c := setupEcho().NewContext(httptest.NewRequest(http.MethodGet, "/system/rabbitmq/events", nil), rec)
+		assert.NoError(t, handlers.BrokerEventsHandler(c))
+		var body struct {
+			Events []recorded `json:"events"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return body.Events
+	}
+
+	// The recorded events are kept for the whole process.
+	before := len(list())
+	events := make(chan rabbitmq.Event, 2)
+	handlers.RecordBrokerEvents(events)
+	events <- rabbitmq.Event{Type: rabbitmq.EventReconnectFailed, Attempt: 1, Delay: time.Second, Err: errors.New("connection refused")}
+	events <- rabbitmq.Event{Type: rabbitmq.EventReconnected, Attempt: 2}
+	close(events)
+
+	if !assert.Eventually(t, func() bool { return len(list()) == before+2 }, time.Second, 5*time.Millisecond) {
+		return
+	}
+	assert.Equal(t, []recorded{
+		{Type: rabbitmq.EventReconnected, Attempt: 2},
+		{Type: rabbitmq.EventReconnectFailed, Attempt: 1, Delay: "1s", Error: "connection refused"},
+	}, list()[:2], "newest first")
+}
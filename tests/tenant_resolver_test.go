@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"jatis_mobile_api/middleware"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantStrategies(t *testing.T) {
+	e := setupEcho()
+
+	req := httptest.NewRequest(http.MethodPost, "/producers", nil)
+	req.Host = "acme.api.example.com:8080"
+	req.Header.Set("x-tenant-name", "Header Tenant")
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	lookup, ok := middleware.TenantFromHeader("x-tenant-name")(c)
+	assert.True(t, ok)
+	assert.Equal(t, "Header Tenant", lookup.Name)
+
+	lookup, ok = middleware.TenantFromSubdomain("api.example.com")(c)
+	assert.True(t, ok)
+	assert.Equal(t, "acme", lookup.Name)
+
+	_, ok = middleware.TenantFromSubdomain("other.example.com")(c)
+	assert.False(t, ok)
+
+	c.SetParamNames("tenant")
+	c.SetParamValues("path-tenant")
+	lookup, ok = middleware.TenantFromPathParam("tenant")(c)
+	assert.True(t, ok)
+	assert.Equal(t, "path-tenant", lookup.Name)
+
+	_, ok = middleware.TenantFromTokenClaim()(c)
+	assert.False(t, ok)
+	c.Set(middleware.TenantIDContextKey, 42)
+	lookup, ok = middleware.TenantFromTokenClaim()(c)
+	assert.True(t, ok)
+	assert.Equal(t, 42, lookup.ID)
+}
+
+func TestTenantResolverRequiresTenant(t *testing.T) {
+	e := setupEcho()
+	e.POST("/producers", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, middleware.TenantResolver(time.Minute, middleware.TenantFromHeader("x-tenant-name")))
+
+	req := httptest.NewRequest(http.MethodPost, "/producers", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
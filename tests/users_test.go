@@ -0,0 +1,256 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"jatis_mobile_api/auth"
+	"jatis_mobile_api/config"
+	"jatis_mobile_api/database"
+	"jatis_mobile_api/handlers"
+	"jatis_mobile_api/middleware"
+	"jatis_mobile_api/models"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// userAPI calls the user handlers of one tenant through TenantDB, like the
+// routes registered by RegisterUserRoutes.
+type userAPI struct {
+	t      *testing.T
+	e      *echo.Echo
+	tenant *models.Tenant
+}
+
+func newUserAPI(t *testing.T, e *echo.Echo) *userAPI {
+	tenant := &models.Tenant{Name: provisioningTenantName(t)}
+	if !assert.NoError(t, models.CreateTenant(database.SystemDB(), tenant)) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { models.DeleteTenant(database.SystemDB(), tenant.ID) })
+	return &userAPI{t: t, e: e, tenant: tenant}
+}
+
+func (api *userAPI) call(handler echo.HandlerFunc, method, target string, body interface{}, userID int) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(payload))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := newContext(api.e, nil, req, rec)
+	c.SetParamNames("id", "userId")
+	c.SetParamValues(strconv.Itoa(api.tenant.ID), strconv.Itoa(userID))
+	assert.NoError(api.t, middleware.TenantDB(handler)(c))
+	return rec
+}
+
+func (api *userAPI) create(username string) (*httptest.ResponseRecorder, models.User) {
+	rec := api.call(handlers.CreateUserHandler, http.MethodPost, "/users", map[string]string{
+		"username": username,
+		"email":    username + "@example.com",
+		"password": "correct horse battery",
+	}, 0)
+	var user models.User
+	if rec.Code == http.StatusCreated {
+		assert.NoError(api.t, json.Unmarshal(rec.Body.Bytes(), &user))
+	}
+	return rec, user
+}
+
+func (api *userAPI) list(query string) []models.User {
+	rec := api.call(handlers.ListUsersHandler, http.MethodGet, "/users?"+query, nil, 0)
+	assert.Equal(api.t, http.StatusOK, rec.Code)
+	var page struct {
+		Users []models.User `json:"users"`
+	}
+	assert.NoError(api.t, json.Unmarshal(rec.Body.Bytes(), &page))
+	return page.Users
+}
+
+func userIDs(users []models.User) []int {
+	ids := []int{}
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+func TestUserHandlers(t *testing.T) {
+	requireDatabase(t)
+	setupPasswords(t, config.Config{PasswordAlgorithm: auth.AlgorithmBcrypt, BcryptCost: 4})
+	e := setupEcho()
+	api := newUserAPI(t, e)
+
+	rec, alice := api.create("alice")
+	if !assert.Equal(t, http.StatusCreated, rec.Code) {
+		return
+	}
+	assert.Equal(t, api.tenant.ID, alice.TenantID)
+	assert.Equal(t, "alice@example.com", alice.Email)
+	assert.NotContains(t, rec.Body.String(), "correct horse battery")
+	roles, err := models.GetUserRoles(database.SystemDB(), alice.ID)
+	if assert.NoError(t, err) && assert.Len(t, roles, 1) {
+		assert.Equal(t, auth.RoleTenantMember, roles[0].Name, "new users get the member role")
+	}
+
+	rec, _ = api.create("alice")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	_, bob := api.create("bob")
+
+	assert.Equal(t, []int{alice.ID, bob.ID}, userIDs(api.list("")))
+
+	rec = api.call(handlers.GetUserHandler, http.MethodGet, "/users/"+strconv.Itoa(alice.ID), nil, alice.ID)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		var got models.User
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		assert.Equal(t, "alice", got.Username)
+	}
+
+	rec = api.call(handlers.UpdateUserHandler, http.MethodPatch, "/users/"+strconv.Itoa(alice.ID), map[string]string{"username": "alice2"}, alice.ID)
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		var updated models.User
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &updated))
+		assert.Equal(t, "alice2", updated.Username)
+		assert.Equal(t, "alice@example.com", updated.Email)
+	}
+	rec = api.call(handlers.UpdateUserHandler, http.MethodPatch, "/users/"+strconv.Itoa(alice.ID), map[string]string{"email": "bob@example.com"}, alice.ID)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = api.call(handlers.DeleteUserHandler, http.MethodDelete, "/users/"+strconv.Itoa(bob.ID), nil, bob.ID)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = api.call(handlers.DeleteUserHandler, http.MethodDelete, "/users/"+strconv.Itoa(bob.ID), nil, bob.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "a deleted user cannot be deleted again")
+	assert.Equal(t, []int{alice.ID}, userIDs(api.list("")))
+	assert.Equal(t, []int{alice.ID, bob.ID}, userIDs(api.list("include_deleted=true")))
+	rec = api.call(handlers.GetUserHandler, http.MethodGet, "/users/"+strconv.Itoa(bob.ID), nil, bob.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = api.call(handlers.RestoreUserHandler, http.MethodPost, "/users/"+strconv.Itoa(bob.ID)+"/restore", nil, bob.ID)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = api.call(handlers.RestoreUserHandler, http.MethodPost, "/users/"+strconv.Itoa(bob.ID)+"/restore", nil, bob.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "an active user cannot be restored")
+	assert.Equal(t, []int{alice.ID, bob.ID}, userIDs(api.list("")))
+
+	rec = httptest.NewRecorder()
+	c := newContext(e, nil, httptest.NewRequest(http.MethodGet, "/users/abc", nil), rec)
+	c.SetParamNames("id", "userId")
+	c.SetParamValues(strconv.Itoa(api.tenant.ID), "abc")
+	assert.NoError(t, middleware.TenantDB(handlers.GetUserHandler)(c))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestUserHandlersAcrossTenants(t *testing.T) {
+	requireDatabase(t)
+	setupPasswords(t, config.Config{PasswordAlgorithm: auth.AlgorithmBcrypt, BcryptCost: 4})
+	e := setupEcho()
+	owner, other := newUserAPI(t, e), newUserAPI(t, e)
+
+	rec, user := owner.create("carol")
+	if !assert.Equal(t, http.StatusCreated, rec.Code) {
+		return
+	}
+	target := "/users/" + strconv.Itoa(user.ID)
+
+	assert.Empty(t, other.list("include_deleted=true"))
+	rec = other.call(handlers.GetUserHandler, http.MethodGet, target, nil, user.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = other.call(handlers.UpdateUserHandler, http.MethodPatch, target, map[string]string{"username": "mallory"}, user.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = other.call(handlers.DeleteUserHandler, http.MethodDelete, target, nil, user.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = other.call(handlers.RestoreUserHandler, http.MethodPost, target+"/restore", nil, user.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	stored, err := models.GetUserByID(database.SystemDB(), owner.tenant.ID, user.ID, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "carol", stored.Username)
+	}
+}
+
+// TestCreateUserHandlerRollsBack makes assigning the default role fail and
+// checks that the user is not created without it.
+func TestCreateUserHandlerRollsBack(t *testing.T) {
+	requireDatabase(t)
+	setupPasswords(t, config.Config{PasswordAlgorithm: auth.AlgorithmBcrypt, BcryptCost: 4})
+	ctx := context.Background()
+	db := database.SystemDB()
+	api := newUserAPI(t, setupEcho())
+
+	_, err := db.Exec(ctx, `
+		CREATE OR REPLACE FUNCTION refuse_role_assignment() RETURNS trigger AS $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM users WHERE id = NEW.user_id AND username = 'refused') THEN
+				RAISE EXCEPTION 'role assignment refused';
+			END IF;
+			RETURN NEW;
+		END $$ LANGUAGE plpgsql;
+		CREATE TRIGGER refuse_role_assignment BEFORE INSERT ON user_roles
+			FOR EACH ROW EXECUTE FUNCTION refuse_role_assignment()`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	t.Cleanup(func() {
+		db.Exec(ctx, "DROP TRIGGER refuse_role_assignment ON user_roles; DROP FUNCTION refuse_role_assignment()")
+	})
+
+	rec, _ := api.create("refused")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Empty(t, api.list("include_deleted=true"), "the user is rolled back with the role assignment")
+
+	rec, _ = api.create("accepted")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+}
+
+func TestUpdateUserPassword(t *testing.T) {
+	requireDatabase(t)
+	setupPasswords(t, config.Config{PasswordAlgorithm: auth.AlgorithmBcrypt, BcryptCost: 4})
+	defer config.SetConfig(config.GetConfig())
+	config.SetConfig(config.Config{PasswordHistorySize: 3})
+	ctx := context.Background()
+	db := database.SystemDB()
+	api := newUserAPI(t, setupEcho())
+
+	rec, user := api.create("dave")
+	if !assert.Equal(t, http.StatusCreated, rec.Code) {
+		return
+	}
+	target := "/users/" + strconv.Itoa(user.ID)
+	changePassword := func(password string) int {
+		return api.call(handlers.UpdateUserHandler, http.MethodPatch, target, map[string]string{"password": password}, user.ID).Code
+	}
+
+	assert.Equal(t, http.StatusOK, changePassword("another horse battery"))
+	history, err := models.GetPasswordHistory(db, user.ID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2, "the new password is recorded with the update")
+	assert.Equal(t, http.StatusUnprocessableEntity, changePassword("correct horse battery"), "a recent password cannot be reused")
+
+	_, err = db.Exec(ctx, `
+		CREATE OR REPLACE FUNCTION refuse_password_history() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'password history refused';
+		END $$ LANGUAGE plpgsql;
+		CREATE TRIGGER refuse_password_history BEFORE INSERT ON password_history
+			FOR EACH ROW EXECUTE FUNCTION refuse_password_history()`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	t.Cleanup(func() {
+		db.Exec(ctx, "DROP TRIGGER refuse_password_history ON password_history; DROP FUNCTION refuse_password_history()")
+	})
+
+	assert.Equal(t, http.StatusInternalServerError, changePassword("third horse battery"))
+	stored, err := models.GetUserByID(db, api.tenant.ID, user.ID, false)
+	if assert.NoError(t, err) {
+		valid, _ := auth.VerifyPassword(stored.PasswordHash, "another horse battery")
+		assert.True(t, valid, "the password is not changed without its history entry")
+	}
+}